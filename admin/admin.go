@@ -0,0 +1,196 @@
+package admin
+
+import (
+	"bytes"
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+	"time"
+)
+
+// Account is an administrator of the portal. Admin accounts are kept separately from VPN users and always require a
+// TOTP code of their own to log in.
+type Account struct {
+	Username string `storm:"id"`
+	Password []byte
+	Key      string
+	user.Lockout
+
+	LastCodeStep uint64 // The TOTP time step of the last accepted code, so that codes can't be used twice
+
+	// SessionsNotBefore invalidates every admin session created before it, as for users.
+	SessionsNotBefore time.Time
+}
+
+type ErrAccountNotFound struct {
+	err error
+}
+
+func (e ErrAccountNotFound) Error() string {
+	return e.err.Error()
+}
+
+// New returns an admin account with the given password and a newly generated TOTP key. The caller must Save it.
+func New(name, password string) (*Account, error) {
+	a := &Account{Username: name}
+	if err := a.SetPassword(password); err != nil {
+		return nil, err
+	}
+	if err := a.ResetOTP(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func FromDB(name string) (*Account, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var a = new(Account)
+	if err := db.One("Username", name, a); err != nil {
+		if err == storm.ErrNotFound {
+			return nil, ErrAccountNotFound{err}
+		}
+		return nil, errors.Wrap(err, "while querying DB for admin")
+	}
+	return a, nil
+}
+
+// All returns every admin account in the database.
+func All() ([]Account, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var accounts []Account
+	if err := db.All(&accounts); err != nil {
+		return nil, errors.Wrap(err, "while querying DB for admins")
+	}
+	return accounts, nil
+}
+
+// Save writes the account to the database, replacing any existing account with the same username.
+func (a *Account) Save() error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Save(a); err != nil {
+		return errors.Wrap(err, "while saving admin")
+	}
+	return nil
+}
+
+// Update applies fn to the account's current record and saves the result in a single transaction, then replaces a
+// with it, so that concurrent logins and changes can't overwrite each other. Nothing is saved if fn returns an error.
+func (a *Account) Update(fn func(current *Account) error) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return errors.Wrap(err, "while updating admin")
+	}
+	defer tx.Rollback()
+
+	var current = new(Account)
+	if err := tx.One("Username", a.Username, current); err != nil {
+		if err == storm.ErrNotFound {
+			return ErrAccountNotFound{err}
+		}
+		return errors.Wrap(err, "while querying DB for admin")
+	}
+	if err := fn(current); err != nil {
+		return err
+	}
+	if err := tx.Save(current); err != nil {
+		return errors.Wrap(err, "while saving admin")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "while saving admin")
+	}
+	*a = *current
+	return nil
+}
+
+// Delete removes the account from the database.
+func (a *Account) Delete() error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.DeleteStruct(a); err != nil {
+		return errors.Wrap(err, "while deleting admin")
+	}
+	return nil
+}
+
+func (a *Account) SetPassword(password string) error {
+	var err error
+	if a.Password, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+		return errors.Wrap(err, "failed to set password")
+	}
+	a.SessionsNotBefore = time.Now()
+	return nil
+}
+
+// ResetOTP generates a new TOTP key and invalidates any sessions the account holds. The caller must save the account,
+// through Update if it already exists.
+func (a *Account) ResetOTP() error {
+	k, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "totp-ovpn admin",
+		AccountName: a.Username,
+	})
+	if err != nil {
+		return errors.Wrap(err, "while generating TOTP key")
+	}
+	a.Key = k.URL()
+	a.LastCodeStep = 0
+	a.SessionsNotBefore = time.Now()
+	return nil
+}
+
+// Authenticate checks a password and TOTP code together, counting failures towards a lockout and refusing a code that
+// has already been accepted. The response doesn't reveal which was wrong. It returns user.ErrLockedOut if the account is
+// locked.
+func (a *Account) Authenticate(password, passcode string) (bool, error) {
+	if a.Locked() {
+		return false, user.ErrLockedOut
+	}
+
+	// bcrypt is slow, so the password is checked before the account is read for update rather than while holding the
+	// database, and is then refused if it was changed in the meantime
+	hash := a.Password
+	passwordOK := bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+
+	var ok bool
+	err := a.Update(func(current *Account) error {
+		if current.Locked() {
+			return user.ErrLockedOut
+		}
+		// The code is only used up once the password is known to be right
+		ok = passwordOK && bytes.Equal(current.Password, hash) && user.AcceptCode(current.Key, passcode, &current.LastCodeStep)
+		if ok {
+			current.FailedAttempts = 0
+		} else {
+			current.Fail()
+		}
+		return nil
+	})
+	return ok && err == nil, err
+}
@@ -0,0 +1,74 @@
+// Package audit records security-relevant events, such as logins, enrollment steps, certificate issuance and admin
+// actions, as a structured stream written to any number of sinks.
+package audit
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// Outcomes of an audited event.
+const (
+	Success = "success"
+	Failure = "failure" // the attempt was refused, e.g. a wrong password
+	Error   = "error"   // the attempt couldn't be completed because something went wrong
+)
+
+// Event is a single audited action. User is the account the action concerns, and Actor the administrator who took it
+// if it wasn't the user themselves.
+type Event struct {
+	ID      int       `json:"-" storm:"id,increment"`
+	Time    time.Time `json:"time" storm:"index"`
+	Action  string    `json:"action"`
+	User    string    `json:"user,omitempty" storm:"index"`
+	Actor   string    `json:"actor,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Outcome string    `json:"outcome"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// Sink receives audited events.
+type Sink interface {
+	Write(e Event) error
+}
+
+var (
+	mutex sync.RWMutex
+	sinks []Sink
+)
+
+// SetSinks replaces the sinks events are written to. Until it's called, events are written to the standard logger.
+func SetSinks(s ...Sink) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	sinks = s
+}
+
+// Record writes an event to every sink, stamping it with the current time if it has none. A sink that fails doesn't
+// stop the event reaching the others, and the failure is reported on the standard logger along with the event so that
+// it isn't lost.
+func Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if len(sinks) == 0 {
+		logEvent(e)
+		return
+	}
+	for _, s := range sinks {
+		if err := s.Write(e); err != nil {
+			log.Printf("While writing audit event: %s", err)
+			logEvent(e)
+		}
+	}
+}
+
+func logEvent(e Event) {
+	raw, _ := json.Marshal(e)
+	log.Printf("audit: %s", raw)
+}
@@ -0,0 +1,90 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type memorySink struct {
+	events []Event
+	err    error
+}
+
+func (m *memorySink) Write(e Event) error {
+	m.events = append(m.events, e)
+	return m.err
+}
+
+func TestRecord(t *testing.T) {
+	defer SetSinks()
+
+	first, failing := &memorySink{}, &memorySink{err: errors.New("disk full")}
+	SetSinks(failing, first)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	Record(Event{Action: "login", User: "alice", IP: "192.0.2.1", Outcome: Success})
+	if len(first.events) != 1 {
+		t.Fatalf("A failing sink stopped the event reaching the others, got %d events", len(first.events))
+	}
+	e := first.events[0]
+	if e.Time.IsZero() || e.Time.Location() != time.UTC {
+		t.Errorf("Event wasn't stamped with the current UTC time, got %s", e.Time)
+	}
+	if !strings.Contains(logged.String(), "disk full") || !strings.Contains(logged.String(), `"action":"login"`) {
+		t.Errorf("Sink failure didn't log the event, got %q", logged.String())
+	}
+
+	SetSinks()
+	logged.Reset()
+	Record(Event{Action: "logout", User: "alice", Outcome: Success})
+	if !strings.Contains(logged.String(), `"action":"logout"`) {
+		t.Errorf("Event wasn't logged without any sinks, got %q", logged.String())
+	}
+}
+
+func TestWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		s, err := Open(path)
+		if err != nil {
+			t.Fatalf("Failed to open audit log with error %s", err)
+		}
+		err = s.Write(Event{
+			Time:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			Action:  "admin.user.disable",
+			User:    "alice",
+			Actor:   "root",
+			Outcome: Success,
+		})
+		if err != nil {
+			t.Fatalf("Failed to write event with error %s", err)
+		}
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(raw)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Reopening the audit log didn't append to it, got %q", raw)
+	}
+	want := `{"time":"2024-01-02T03:04:05Z","action":"admin.user.disable","user":"alice","actor":"root","outcome":"success"}`
+	if lines[0] != want {
+		t.Errorf("Event written as %s, expected %s", lines[0], want)
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil || e.User != "alice" {
+		t.Errorf("Event didn't round trip, got %+v with error %v", e, err)
+	}
+}
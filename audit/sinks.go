@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"encoding/json"
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+)
+
+// Writer writes events as JSON lines to an io.Writer such as a file or stdout.
+type Writer struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (s *Writer) Write(e Event) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err = s.w.Write(append(raw, '\n'))
+	return err
+}
+
+// Syslog writes events as JSON to the local syslog daemon, tagged totp-ovpn.
+type Syslog struct {
+	w *syslog.Writer
+}
+
+func NewSyslog() (*Syslog, error) {
+	w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "totp-ovpn")
+	if err != nil {
+		return nil, errors.Wrap(err, "while connecting to syslog")
+	}
+	return &Syslog{w}, nil
+}
+
+func (s *Syslog) Write(e Event) error {
+	raw, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.Outcome == Success {
+		return s.w.Info(string(raw))
+	}
+	return s.w.Warning(string(raw))
+}
+
+// DB stores events in the database, where the admin console reads them back with Recent.
+type DB struct{}
+
+func (DB) Write(e Event) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Save(&e); err != nil {
+		return errors.Wrap(err, "while saving audit event")
+	}
+	return nil
+}
+
+// Open returns the sink for a log target: stdout, syslog, or the path of a file that events are appended to.
+func Open(target string) (Sink, error) {
+	switch target {
+	case "", "stdout":
+		return NewWriter(os.Stdout), nil
+	case "syslog":
+		return NewSyslog()
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening audit log")
+	}
+	return NewWriter(f), nil
+}
+
+// Recent returns up to limit of the most recently stored events, newest first, only including those concerning
+// username if it isn't empty.
+func Recent(username string, limit int) ([]Event, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var events []Event
+	if username == "" {
+		err = db.All(&events, storm.Limit(limit), storm.Reverse())
+	} else {
+		err = db.Find("User", username, &events, storm.Limit(limit), storm.Reverse())
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return nil, errors.Wrap(err, "while querying DB for audit events")
+	}
+	return events, nil
+}
@@ -2,12 +2,15 @@ package cert
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"github.com/pkg/errors"
 	"io"
 	"math/big"
+	"software.sslmate.com/src/go-pkcs12"
 	"time"
 )
 
@@ -38,16 +41,16 @@ func parseCert(certRaw *bytes.Buffer, password []byte) (cert *x509.Certificate,
 	return x509.ParseCertificate(der)
 }
 
-// parseKey attempts to handle RSA and ECDSA private keys in:
-// - raw DER encoding
+// parseKey attempts to handle RSA, ECDSA and Ed25519 private keys in:
+// - raw DER encoding (PKCS#1, SEC 1 or PKCS#8)
 // - PEM encoded DER
 // - PEM encoded DER with PEM encryption (RSA only)
 // - DER in a PEM encoded, unencrypted PKCS#8 container
-// We don't attempt to handle encrypted PKCS#8 containers due to lack of stdlib support.
+// - DER in a PEM encoded or raw PKCS#8 container encrypted with PBES2 (PBKDF2 or scrypt with AES-CBC)
 func parseKey(keyRaw *bytes.Buffer, password []byte) (key interface{}, err error) {
 
 	// If we can decode the cert as a PEM file use the first resulting decoded block
-	// Otherwise hope it's a DER-encoded blob and try parsing it as an RSA or ECDSA key
+	// Otherwise hope it's a DER-encoded blob and try parsing it as an RSA, ECDSA or PKCS#8 key
 	keyPEMBlock, _ := pem.Decode(keyRaw.Bytes())
 	if keyPEMBlock == nil {
 		if key, err := x509.ParsePKCS1PrivateKey(keyRaw.Bytes()); err == nil {
@@ -56,6 +59,14 @@ func parseKey(keyRaw *bytes.Buffer, password []byte) (key interface{}, err error
 		if key, err := x509.ParseECPrivateKey(keyRaw.Bytes()); err == nil {
 			return key, err
 		}
+		if key, err := x509.ParsePKCS8PrivateKey(keyRaw.Bytes()); err == nil {
+			return key, err
+		}
+		if len(password) > 0 {
+			if der, err := decryptPKCS8(keyRaw.Bytes(), password); err == nil {
+				return x509.ParsePKCS8PrivateKey(der)
+			}
+		}
 		return nil, errors.New("unknown file format")
 	}
 
@@ -64,7 +75,8 @@ func parseKey(keyRaw *bytes.Buffer, password []byte) (key interface{}, err error
 			return nil, errors.New("encrypted key but no password provided")
 		}
 
-		// ECDSA keys are normally only stored encrypted in a PKCS#8 container, and we don't support encrypted PKCS#8
+		// Encrypted PKCS#8 keys of any type arrive as ENCRYPTED PRIVATE KEY blocks, handled below. Legacy Proc-Type
+		// encryption is only supported for RSA keys, since other key types are rarely stored that way
 		if keyPEMBlock.Type != "RSA PRIVATE KEY" {
 			return nil, errors.New("unsupported encrypted key type")
 		}
@@ -79,24 +91,68 @@ func parseKey(keyRaw *bytes.Buffer, password []byte) (key interface{}, err error
 	switch keyPEMBlock.Type {
 	case "RSA PRIVATE KEY":
 		return x509.ParsePKCS1PrivateKey(keyPEMBlock.Bytes)
-	case "PRIVATE KEY": // PKCS#8 container, supports RSA and ECDSA keys only but doesn't tell us which it will return
+	case "PRIVATE KEY": // PKCS#8 container, supports RSA, ECDSA and Ed25519 keys but doesn't tell us which it will return
 		return x509.ParsePKCS8PrivateKey(keyPEMBlock.Bytes)
 	case "EC PRIVATE KEY": // Plain PEM formatted ECDSA key
 		return x509.ParseECPrivateKey(keyPEMBlock.Bytes)
+	case "ENCRYPTED PRIVATE KEY": // Encrypted PKCS#8 container
+		if len(password) == 0 {
+			return nil, errors.New("encrypted key but no password provided")
+		}
+		der, err := decryptPKCS8(keyPEMBlock.Bytes, password)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to decrypt key")
+		}
+		return x509.ParsePKCS8PrivateKey(der)
 	}
 
 	return nil, errors.New("unknown/unsupported key type")
 }
 
-// CA is a CA certificate with corresponding private key.
+// checkKeyPair ensures that a private key can be used for signing and matches the public key in the certificate, so
+// that a mismatched key is caught at load time rather than when the first certificate is signed.
+func checkKeyPair(cert *x509.Certificate, key interface{}) (crypto.Signer, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, errors.New("private key does not match certificate")
+	}
+	return signer, nil
+}
+
+// CA is a CA certificate with a corresponding signer. The signer may wrap a private key held in memory, or one held
+// somewhere else entirely such as a PKCS#11 token or a separate signing process.
 type CA struct {
-	cert *x509.Certificate
-	key  interface{}
+	cert   *x509.Certificate
+	signer crypto.Signer
+}
+
+// NewCA returns a CA that signs certificates with the given signer, which must match the public key in the certificate.
+func NewCA(cert *x509.Certificate, signer crypto.Signer) (*CA, error) {
+	if _, err := checkKeyPair(cert, signer); err != nil {
+		return nil, err
+	}
+	return &CA{cert: cert, signer: signer}, nil
+}
+
+// NewCAFromSigner accepts an io.Reader for the CA certificate, in any of the encodings accepted by NewCAFromReaders,
+// and a signer holding the corresponding private key.
+func NewCAFromSigner(certReader io.Reader, signer crypto.Signer, password string) (*CA, error) {
+	var certRaw = new(bytes.Buffer)
+	_, _ = io.Copy(certRaw, certReader)
+	cert, err := parseCert(certRaw, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	return NewCA(cert, signer)
 }
 
 // NewCAFromReaders accepts an io.Reader for the certificate and key to be used for signing certificates, as well as an
-// optional password to decode the received certificate/key. It handles both RSA and ECDSA keys and attempts to read
-// un/encrypted PEM data, raw ASN.1 DER bytes and unencrypted PKCS#8 containers.
+// optional password to decode the received certificate/key. It handles RSA, ECDSA and Ed25519 keys and attempts to read
+// un/encrypted PEM data, raw ASN.1 DER bytes and un/encrypted PKCS#8 containers.
 func NewCAFromReaders(certReader io.Reader, keyReader io.Reader, password string) (result *CA, err error) {
 
 	result = new(CA)
@@ -109,13 +165,75 @@ func NewCAFromReaders(certReader io.Reader, keyReader io.Reader, password string
 
 	var keyRaw = new(bytes.Buffer)
 	_, _ = io.Copy(keyRaw, keyReader)
-	if result.key, err = parseKey(keyRaw, []byte(password)); err != nil {
+	key, err := parseKey(keyRaw, []byte(password))
+	if err != nil {
+		return nil, err
+	}
+
+	if result.signer, err = checkKeyPair(result.cert, key); err != nil {
 		return nil, err
 	}
 
 	return
 }
 
+// NewCAFromPKCS12 accepts an io.Reader for a PKCS#12 (.p12/.pfx) bundle containing the CA certificate and key, and the
+// password protecting it.
+func NewCAFromPKCS12(r io.Reader, password string) (result *CA, err error) {
+
+	var raw = new(bytes.Buffer)
+	if _, err = io.Copy(raw, r); err != nil {
+		return nil, errors.Wrap(err, "while reading")
+	}
+
+	result = new(CA)
+	key, cert, _, err := pkcs12.DecodeChain(raw.Bytes(), password)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode PKCS#12 bundle")
+	}
+	result.cert = cert
+
+	if result.signer, err = checkKeyPair(result.cert, key); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// Certificate returns the CA certificate.
+func (c *CA) Certificate() *x509.Certificate {
+	return c.cert
+}
+
+// Signer returns the signer holding the CA key.
+func (c *CA) Signer() crypto.Signer {
+	return c.signer
+}
+
+// SelfTest signs a throwaway certificate and checks the signature against the CA certificate's public key, proving that
+// the CA key is usable and still matches the certificate. The certificate is discarded.
+func (c *CA) SelfTest() error {
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "totp-ovpn self test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Minute),
+	}
+	// Certifying the CA's own public key means the test certificate's signature can be checked against itself
+	raw, err := x509.CreateCertificate(rand.Reader, &template, c.cert, c.cert.PublicKey, c.signer)
+	if err != nil {
+		return errors.Wrap(err, "unable to sign test certificate")
+	}
+	crt, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return errors.Wrap(err, "unable to parse test certificate")
+	}
+	if err := crt.CheckSignature(crt.SignatureAlgorithm, crt.RawTBSCertificate, crt.Signature); err != nil {
+		return errors.Wrap(err, "test signature doesn't match the CA certificate")
+	}
+	return nil
+}
+
 // SignRequest signs a Request object, replacing the contained certificate with a signed copy of the contained CSR. It
 // guarantees a valid certificate will be produced but does not validate the parameters of the certificate.
 func (c *CA) SignRequest(req *Request) (err error) {
@@ -127,10 +245,9 @@ func (c *CA) SignRequest(req *Request) (err error) {
 	serial := new(big.Int)
 	serial.SetBytes(serialBytes)
 
+	// The signature algorithm is left for x509 to choose based on the CA key; the CSR's own signature algorithm only
+	// reflects the requester's key type, which may not match ours.
 	var certTemplate = x509.Certificate{
-		Signature:          req.csr.Signature,
-		SignatureAlgorithm: req.csr.SignatureAlgorithm,
-
 		PublicKeyAlgorithm: req.csr.PublicKeyAlgorithm,
 		PublicKey:          req.csr.PublicKey,
 
@@ -143,7 +260,7 @@ func (c *CA) SignRequest(req *Request) (err error) {
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 	}
 
-	crtRaw, err := x509.CreateCertificate(rand.Reader, &certTemplate, c.cert, req.csr.PublicKey, c.key)
+	crtRaw, err := x509.CreateCertificate(rand.Reader, &certTemplate, c.cert, req.csr.PublicKey, c.signer)
 	if err != nil {
 		return errors.Wrap(err, "unable to sign certificate request")
 	}
@@ -151,6 +268,7 @@ func (c *CA) SignRequest(req *Request) (err error) {
 	if req.crt, err = x509.ParseCertificate(crtRaw); err != nil {
 		return errors.Wrap(err, "unable to parse signed certificate data")
 	}
+	req.signed = true
 
 	return nil
 }
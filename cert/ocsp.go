@@ -0,0 +1,175 @@
+package cert
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// OCSPValidity is how long an OCSP response may be cached by the client before it must ask again.
+var OCSPValidity = time.Hour
+
+// OCSPResponder answers RFC 6960 OCSP requests for certificates issued by a CA. Responses are signed either by the CA
+// itself or by a delegated responder certificate issued by the CA with the OCSPSigning extended key usage.
+type OCSPResponder struct {
+	issuer *x509.Certificate
+	cert   *x509.Certificate
+	key    crypto.Signer
+
+	// Lookup finds the issued certificate record for a serial number, returning storm.ErrNotFound if the certificate
+	// isn't known. Any other error is treated as a temporary failure. It defaults to FindIssued.
+	Lookup func(serial string) (*Issued, error)
+}
+
+// NewOCSPResponder returns a responder that signs responses with the CA's own key.
+func NewOCSPResponder(ca *CA) (*OCSPResponder, error) {
+	return &OCSPResponder{issuer: ca.cert, cert: ca.cert, key: ca.signer, Lookup: FindIssued}, nil
+}
+
+// NewDelegatedOCSPResponder returns a responder that signs responses with a delegated responder certificate and key,
+// read from certReader and keyReader in any of the encodings accepted by NewCAFromReaders.
+func NewDelegatedOCSPResponder(ca *CA, certReader io.Reader, keyReader io.Reader, password string) (*OCSPResponder, error) {
+	delegate, err := NewCAFromReaders(certReader, keyReader, password)
+	if err != nil {
+		return nil, errors.Wrap(err, "while loading OCSP responder certificate")
+	}
+
+	if err := delegate.cert.CheckSignatureFrom(ca.cert); err != nil {
+		return nil, errors.Wrap(err, "OCSP responder certificate was not issued by the CA")
+	}
+	var canSign bool
+	for _, v := range delegate.cert.ExtKeyUsage {
+		if v == x509.ExtKeyUsageOCSPSigning {
+			canSign = true
+		}
+	}
+	if !canSign {
+		return nil, errors.New("OCSP responder certificate lacks the OCSPSigning extended key usage")
+	}
+
+	return &OCSPResponder{issuer: ca.cert, cert: delegate.cert, key: delegate.signer, Lookup: FindIssued}, nil
+}
+
+// issuedByUs checks that an OCSP request refers to our CA by comparing the issuer name and key hashes.
+func (o *OCSPResponder) issuedByUs(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+
+	var spki struct {
+		Algorithm asn1.RawValue
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(o.issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+
+	h := req.HashAlgorithm.New()
+	h.Write(o.issuer.RawSubject)
+	if !bytes.Equal(h.Sum(nil), req.IssuerNameHash) {
+		return false
+	}
+	h.Reset()
+	h.Write(spki.PublicKey.RightAlign())
+	return bytes.Equal(h.Sum(nil), req.IssuerKeyHash)
+}
+
+// Respond builds a signed OCSP response for a DER-encoded OCSP request. Malformed requests and requests for other
+// issuers receive the appropriate unsigned error response rather than an error.
+func (o *OCSPResponder) Respond(raw []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(raw)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse, nil
+	}
+	if !o.issuedByUs(req) {
+		return ocsp.UnauthorizedErrorResponse, nil
+	}
+
+	now := time.Now().Truncate(time.Minute)
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(OCSPValidity),
+	}
+	if o.cert != o.issuer {
+		template.Certificate = o.cert
+	}
+
+	serial := serialString(req.SerialNumber)
+	switch issued, err := o.Lookup(serial); {
+	case err == nil:
+		template.Status = ocsp.Good
+		if issued.Revoked {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = issued.RevokedAt
+			template.RevocationReason = ocsp.Unspecified
+		}
+	case errors.Cause(err) == storm.ErrNotFound:
+	default:
+		// A signed Unknown could be cached until NextUpdate, so failures get the unsigned tryLater response instead
+		log.Printf("While looking up certificate %s for OCSP: %s", serial, err)
+		return ocsp.TryLaterErrorResponse, nil
+	}
+
+	resp, err := ocsp.CreateResponse(o.issuer, o.cert, template, o.key)
+	if err != nil {
+		return nil, errors.Wrap(err, "while signing OCSP response")
+	}
+	return resp, nil
+}
+
+// ServeHTTP implements the HTTP transport described in RFC 6960 appendix A, accepting requests either as the body of
+// a POST or base64 encoded in the final element of a GET path.
+func (o *OCSPResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var raw []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		// Base64 includes "/", which is escaped in the path, so the path is split before it's unescaped
+		path := r.URL.EscapedPath()
+		encoded := path[strings.LastIndex(path, "/")+1:]
+		if encoded, err = url.PathUnescape(encoded); err == nil {
+			raw, err = base64.StdEncoding.DecodeString(encoded)
+		}
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != "application/ocsp-request" {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		raw, err = io.ReadAll(http.MaxBytesReader(w, r.Body, 10*1024))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+
+	resp, err := o.Respond(raw)
+	if err != nil {
+		log.Printf("While responding to OCSP request: %s", err)
+		resp = ocsp.InternalErrorErrorResponse
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	_, _ = w.Write(resp)
+}
+
+func serialString(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
@@ -0,0 +1,150 @@
+package cert
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ocsp"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOCSPResponder_ServeHTTP(t *testing.T) {
+	c, err := NewCAFromReaders(bytes.NewReader(ca), bytes.NewReader(keyPEMPKCS8RSA), "")
+	if err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+	req, err := NewRequestFromReader(bytes.NewReader(keyCSR))
+	if err != nil {
+		t.Fatalf("Failed to initialise CSR %s", err)
+	}
+	if err := c.SignRequest(req); err != nil {
+		t.Fatalf("Failed to sign request with error %s", err)
+	}
+
+	responder, err := NewOCSPResponder(c)
+	if err != nil {
+		t.Fatalf("Failed to create responder with error %s", err)
+	}
+	issued := map[string]*Issued{}
+	responder.Lookup = func(serial string) (*Issued, error) {
+		if i, ok := issued[serial]; ok {
+			return i, nil
+		}
+		return nil, storm.ErrNotFound
+	}
+
+	srv := httptest.NewServer(responder)
+	defer srv.Close()
+
+	query := func() *ocsp.Response {
+		raw, err := ocsp.CreateRequest(req.Certificate(), c.cert, nil)
+		if err != nil {
+			t.Fatalf("Failed to create OCSP request with error %s", err)
+		}
+		resp, err := http.Post(srv.URL+"/ocsp", "application/ocsp-request", bytes.NewReader(raw))
+		if err != nil {
+			t.Fatalf("Failed to POST OCSP request with error %s", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		parsed, err := ocsp.ParseResponseForCert(body, req.Certificate(), c.cert)
+		if err != nil {
+			t.Fatalf("Failed to parse OCSP response with error %s", err)
+		}
+		return parsed
+	}
+
+	if status := query().Status; status != ocsp.Unknown {
+		t.Errorf("Expected unknown status for unrecorded certificate, got %d", status)
+	}
+
+	// A lookup that fails for any other reason mustn't be answered with a cacheable Unknown
+	lookup := responder.Lookup
+	responder.Lookup = func(serial string) (*Issued, error) {
+		return nil, errors.New("database unavailable")
+	}
+	raw, err := ocsp.CreateRequest(req.Certificate(), c.cert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := responder.Respond(raw); err != nil || !bytes.Equal(resp, ocsp.TryLaterErrorResponse) {
+		t.Errorf("Failed lookup didn't return tryLater, got error %v", err)
+	}
+	responder.Lookup = lookup
+
+	serial := serialString(req.Certificate().SerialNumber)
+	issued[serial] = &Issued{Serial: serial}
+	if status := query().Status; status != ocsp.Good {
+		t.Errorf("Expected good status for recorded certificate, got %d", status)
+	}
+
+	issued[serial].Revoked = true
+	issued[serial].RevokedAt = time.Now().Add(-time.Hour).Truncate(time.Second)
+	resp := query()
+	if resp.Status != ocsp.Revoked {
+		t.Errorf("Expected revoked status for revoked certificate, got %d", resp.Status)
+	}
+	if !resp.RevokedAt.Equal(issued[serial].RevokedAt) {
+		t.Errorf("Expected revocation time %s, got %s", issued[serial].RevokedAt, resp.RevokedAt)
+	}
+}
+
+func TestOCSPResponder_ServeHTTPGet(t *testing.T) {
+	c, err := NewCAFromReaders(bytes.NewReader(ca), bytes.NewReader(keyPEMPKCS8RSA), "")
+	if err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+	responder, err := NewOCSPResponder(c)
+	if err != nil {
+		t.Fatalf("Failed to create responder with error %s", err)
+	}
+	responder.Lookup = func(serial string) (*Issued, error) {
+		return &Issued{Serial: serial}, nil
+	}
+	srv := httptest.NewServer(responder)
+	defer srv.Close()
+
+	// Serial numbers are random, so sign until the encoded request includes a "/" that has to be escaped
+	var req *Request
+	var encoded string
+	for i := 0; i < 50 && !strings.Contains(encoded, "/"); i++ {
+		if req, err = NewRequestFromReader(bytes.NewReader(keyCSR)); err != nil {
+			t.Fatalf("Failed to initialise CSR %s", err)
+		}
+		if err := c.SignRequest(req); err != nil {
+			t.Fatalf("Failed to sign request with error %s", err)
+		}
+		raw, err := ocsp.CreateRequest(req.Certificate(), c.cert, nil)
+		if err != nil {
+			t.Fatalf("Failed to create OCSP request with error %s", err)
+		}
+		encoded = base64.StdEncoding.EncodeToString(raw)
+	}
+	if !strings.Contains(encoded, "/") {
+		t.Fatalf("No OCSP request encoded with a /")
+	}
+
+	resp, err := http.Get(srv.URL + "/ocsp/" + url.PathEscape(encoded))
+	if err != nil {
+		t.Fatalf("Failed to GET OCSP request with error %s", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET returned status %d: %s", resp.StatusCode, body)
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, req.Certificate(), c.cert)
+	if err != nil {
+		t.Fatalf("Failed to parse OCSP response with error %s", err)
+	}
+	if parsed.Status != ocsp.Good {
+		t.Errorf("Expected good status for recorded certificate, got %d", parsed.Status)
+	}
+}
@@ -0,0 +1,32 @@
+//go:build pkcs11
+// +build pkcs11
+
+package cert
+
+import (
+	"crypto"
+	"github.com/ThalesIgnite/crypto11"
+	"github.com/pkg/errors"
+)
+
+// NewPKCS11Signer returns a signer for the key pair labelled keyLabel on the token labelled tokenLabel, using the
+// PKCS#11 module at modulePath (e.g. /usr/lib/softhsm/libsofthsm2.so). The private key never leaves the token.
+func NewPKCS11Signer(modulePath, tokenLabel, pin, keyLabel string) (crypto.Signer, error) {
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       modulePath,
+		TokenLabel: tokenLabel,
+		Pin:        pin,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening PKCS#11 token")
+	}
+
+	signer, err := ctx.FindKeyPair(nil, []byte(keyLabel))
+	if err != nil {
+		return nil, errors.Wrap(err, "while searching PKCS#11 token")
+	}
+	if signer == nil {
+		return nil, errors.Errorf("no key pair labelled %s found on PKCS#11 token", keyLabel)
+	}
+	return signer, nil
+}
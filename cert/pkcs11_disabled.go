@@ -0,0 +1,14 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package cert
+
+import (
+	"crypto"
+	"github.com/pkg/errors"
+)
+
+// NewPKCS11Signer is unavailable unless built with the pkcs11 tag, as PKCS#11 support requires cgo.
+func NewPKCS11Signer(modulePath, tokenLabel, pin, keyLabel string) (crypto.Signer, error) {
+	return nil, errors.New("built without PKCS#11 support, rebuild with -tags pkcs11")
+}
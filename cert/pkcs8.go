@@ -0,0 +1,164 @@
+package cert
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+	"hash"
+)
+
+// Object identifiers from RFC 8018 (PKCS#5 v2.1), RFC 7914 (scrypt) and NIST's AES registrations
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA224 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 8}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type scryptParams struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// prfHash maps a PBKDF2 pseudo-random function to its hash. The PRF is optional and defaults to HMAC-SHA1.
+func prfHash(prf pkix.AlgorithmIdentifier) (func() hash.Hash, error) {
+	switch {
+	case len(prf.Algorithm) == 0, prf.Algorithm.Equal(oidHMACWithSHA1):
+		return sha1.New, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA224):
+		return sha256.New224, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA256):
+		return sha256.New, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA384):
+		return sha512.New384, nil
+	case prf.Algorithm.Equal(oidHMACWithSHA512):
+		return sha512.New, nil
+	}
+	return nil, errors.Errorf("unsupported PBKDF2 pseudo-random function %s", prf.Algorithm)
+}
+
+// aesKeyLength maps an AES-CBC encryption scheme to its key length in bytes.
+func aesKeyLength(scheme asn1.ObjectIdentifier) (int, error) {
+	switch {
+	case scheme.Equal(oidAES128CBC):
+		return 16, nil
+	case scheme.Equal(oidAES192CBC):
+		return 24, nil
+	case scheme.Equal(oidAES256CBC):
+		return 32, nil
+	}
+	return 0, errors.Errorf("unsupported encryption scheme %s", scheme)
+}
+
+// deriveKey runs the PBES2 key derivation function to produce a key of keyLen bytes.
+func deriveKey(kdf pkix.AlgorithmIdentifier, password []byte, keyLen int) ([]byte, error) {
+	switch {
+	case kdf.Algorithm.Equal(oidPBKDF2):
+		var params pbkdf2Params
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.Wrap(err, "invalid PBKDF2 parameters")
+		}
+		h, err := prfHash(params.PRF)
+		if err != nil {
+			return nil, err
+		}
+		return pbkdf2.Key(password, params.Salt, params.IterationCount, keyLen, h), nil
+	case kdf.Algorithm.Equal(oidScrypt):
+		var params scryptParams
+		if _, err := asn1.Unmarshal(kdf.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.Wrap(err, "invalid scrypt parameters")
+		}
+		return scrypt.Key(password, params.Salt, params.CostParameter, params.BlockSize, params.ParallelizationParameter, keyLen)
+	}
+	return nil, errors.Errorf("unsupported key derivation function %s", kdf.Algorithm)
+}
+
+// decryptPKCS8 decrypts a DER-encoded EncryptedPrivateKeyInfo protected by PBES2, returning the DER-encoded PKCS#8
+// PrivateKeyInfo it contains. Only PBKDF2 and scrypt key derivation with AES-CBC encryption are supported, which covers
+// everything OpenSSL has produced by default for the last decade. The older PBES1 schemes aren't supported.
+func decryptPKCS8(der []byte, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.Wrap(err, "not an encrypted PKCS#8 container")
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, errors.Errorf("unsupported PKCS#8 encryption algorithm %s", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, errors.Wrap(err, "invalid PBES2 parameters")
+	}
+
+	keyLen, err := aesKeyLength(params.EncryptionScheme.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil || len(iv) != aes.BlockSize {
+		return nil, errors.New("invalid AES-CBC initialisation vector")
+	}
+
+	key, err := deriveKey(params.KeyDerivationFunc, password, keyLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, errors.New("encrypted data is not a multiple of the block size")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, info.EncryptedData)
+
+	// A wrong password almost always shows up as invalid PKCS#7 padding
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("unable to decrypt key, incorrect password?")
+	}
+	for _, v := range plain[len(plain)-pad:] {
+		if int(v) != pad {
+			return nil, errors.New("unable to decrypt key, incorrect password?")
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
@@ -0,0 +1,121 @@
+package cert
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// SignArgs is a signing request sent to a signing daemon. The digest has already been hashed by the caller.
+type SignArgs struct {
+	Digest     []byte
+	Hash       crypto.Hash
+	PSS        bool
+	SaltLength int
+}
+
+// SignerService exposes a crypto.Signer over net/rpc so that a private key can be kept in a separate process from the
+// web server. Anyone able to connect to the service can have arbitrary digests signed, so it should only be exposed on
+// a unix socket with restrictive permissions.
+type SignerService struct {
+	signer crypto.Signer
+}
+
+// Public returns the DER-encoded public key of the signer. The argument is ignored.
+func (s *SignerService) Public(_ bool, reply *[]byte) (err error) {
+	*reply, err = x509.MarshalPKIXPublicKey(s.signer.Public())
+	return
+}
+
+// Sign signs a digest with the signer.
+func (s *SignerService) Sign(args SignArgs, reply *[]byte) (err error) {
+	var opts crypto.SignerOpts = args.Hash
+	if args.PSS {
+		opts = &rsa.PSSOptions{SaltLength: args.SaltLength, Hash: args.Hash}
+	}
+	*reply, err = s.signer.Sign(nil, args.Digest, opts)
+	return
+}
+
+// ServeSigner answers signing requests on a listener until it's closed.
+func ServeSigner(l net.Listener, signer crypto.Signer) error {
+	srv := rpc.NewServer()
+	if err := srv.RegisterName("Signer", &SignerService{signer}); err != nil {
+		return err
+	}
+	srv.Accept(l)
+	return nil
+}
+
+// RemoteSigner is a crypto.Signer backed by a SignerService listening on a unix socket. It reconnects automatically if
+// the signing daemon is restarted.
+type RemoteSigner struct {
+	path   string
+	mutex  sync.Mutex
+	client *rpc.Client
+	pub    crypto.PublicKey
+}
+
+// DialSigner connects to a signing daemon on the unix socket at path and fetches its public key.
+func DialSigner(path string) (*RemoteSigner, error) {
+	r := &RemoteSigner{path: path}
+
+	var der []byte
+	if err := r.call("Signer.Public", true, &der); err != nil {
+		return nil, errors.Wrap(err, "while fetching public key from signer")
+	}
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid public key from signer")
+	}
+	r.pub = pub
+	return r, nil
+}
+
+// call makes an RPC call, redialling once if the connection has been lost since the last call.
+func (r *RemoteSigner) call(method string, args interface{}, reply interface{}) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		if r.client == nil {
+			client, err := rpc.Dial("unix", r.path)
+			if err != nil {
+				return err
+			}
+			r.client = client
+		}
+		err := r.client.Call(method, args, reply)
+		if err == nil || attempt > 0 {
+			return err
+		}
+		if err != rpc.ErrShutdown && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		r.client.Close()
+		r.client = nil
+	}
+}
+
+func (r *RemoteSigner) Public() crypto.PublicKey {
+	return r.pub
+}
+
+func (r *RemoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	args := SignArgs{Digest: digest, Hash: opts.HashFunc()}
+	if pss, ok := opts.(*rsa.PSSOptions); ok {
+		args.PSS = true
+		args.SaltLength = pss.SaltLength
+	}
+
+	var sig []byte
+	if err := r.call("Signer.Sign", args, &sig); err != nil {
+		return nil, errors.Wrap(err, "remote signer")
+	}
+	return sig, nil
+}
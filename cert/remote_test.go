@@ -0,0 +1,50 @@
+package cert
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoteSigner(t *testing.T) {
+	local, err := NewCAFromReaders(bytes.NewReader(ca), bytes.NewReader(keyPEMPKCS8RSA), "")
+	if err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "signer.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen with error %s", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		ServeSigner(l, local.Signer())
+		close(done)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+
+	signer, err := DialSigner(socket)
+	if err != nil {
+		t.Fatalf("Failed to connect to signer with error %s", err)
+	}
+	remote, err := NewCAFromSigner(bytes.NewReader(ca), signer, "")
+	if err != nil {
+		t.Fatalf("Failed to load CA with remote signer with error %s", err)
+	}
+
+	req, err := NewRequestFromReader(bytes.NewReader(keyCSR))
+	if err != nil {
+		t.Fatalf("Failed to initialise CSR %s", err)
+	}
+	if err := remote.SignRequest(req); err != nil {
+		t.Fatalf("Failed to sign request with error %s", err)
+	}
+	if err := req.Certificate().CheckSignatureFrom(local.cert); err != nil {
+		t.Errorf("Remotely signed certificate doesn't verify: %s", err)
+	}
+}
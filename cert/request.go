@@ -2,6 +2,10 @@ package cert
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
@@ -10,17 +14,48 @@ import (
 	"regexp"
 )
 
+// Errors returned for a rejected CSR carry a message ID, and for some errors arguments, so that the reason can be
+// shown to users in their own language. Message IDs are looked up in the server's message catalogs.
+
 type InvalidNameError struct{}
 
 func (i InvalidNameError) Error() string {
 	return "invalid name"
 }
 
+func (i InvalidNameError) MessageID() string {
+	return "error.invalid_name"
+}
+
+// UnsupportedKeyError is returned for a CSR whose public key isn't acceptable for a client certificate.
+type UnsupportedKeyError struct {
+	msg  string
+	id   string
+	args []interface{}
+}
+
+func (u UnsupportedKeyError) Error() string {
+	return u.msg
+}
+
+func (u UnsupportedKeyError) MessageID() string {
+	return u.id
+}
+
+func (u UnsupportedKeyError) MessageArgs() []interface{} {
+	return u.args
+}
+
 type InvalidDERCSR struct{ msg string }
 
 func (i InvalidDERCSR) Error() string {
 	return i.msg
 }
+
+func (i InvalidDERCSR) MessageID() string {
+	return "error.invalid_csr"
+}
+
 func NewInvalidDERCSR(err error) InvalidDERCSR {
 	i := InvalidDERCSR{
 		msg: fmt.Sprintf("not a valid DER-encoded certificate signing request: %s", err.Error()),
@@ -40,6 +75,43 @@ func parseCSR(csrRaw *bytes.Buffer) (csr *x509.CertificateRequest, err error) {
 
 }
 
+// MinRSABits is the smallest RSA key accepted in a CSR.
+var MinRSABits = 2048
+
+// checkPublicKey applies our key policy to a CSR: RSA keys of at least MinRSABits, ECDSA keys on P-256 or P-384, or
+// Ed25519 keys. These are the key types OpenVPN 2.5+ supports with the default OpenSSL builds.
+func checkPublicKey(pub interface{}) error {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < MinRSABits {
+			return UnsupportedKeyError{
+				fmt.Sprintf("RSA key of %d bits is too small, at least %d bits are required", k.N.BitLen(), MinRSABits),
+				"error.key_too_small", []interface{}{k.N.BitLen(), MinRSABits},
+			}
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() && k.Curve != elliptic.P384() {
+			return UnsupportedKeyError{
+				fmt.Sprintf("unsupported elliptic curve %s", k.Curve.Params().Name),
+				"error.unsupported_curve", []interface{}{k.Curve.Params().Name},
+			}
+		}
+		return nil
+	case ed25519.PublicKey:
+		return nil
+	}
+	return UnsupportedKeyError{"unsupported key type", "error.unsupported_key", nil}
+}
+
+var validName = regexp.MustCompile("^[0-9A-Za-z_.@-]+$")
+
+// ValidName reports whether a username may appear in a certificate's Common Name. Only valid usernames as per
+// https://openvpn.net/community-resources/reference-manual-for-openvpn-2-4 are allowed.
+func ValidName(name string) bool {
+	return validName.MatchString(name)
+}
+
 type Request struct {
 	csr      *x509.CertificateRequest
 	crt      *x509.Certificate
@@ -60,14 +132,40 @@ func NewRequestFromReader(r io.Reader) (req *Request, err error) {
 		return nil, errors.Wrap(err, "while decoding CSR")
 	}
 
+	if err = req.csr.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "invalid CSR signature")
+	}
+
+	if err = checkPublicKey(req.csr.PublicKey); err != nil {
+		return nil, err
+	}
+
 	req.Username = req.csr.Subject.CommonName
 
-	// Only valid usernames as per https://openvpn.net/community-resources/reference-manual-for-openvpn-2-4
-	// are allowed in the Common Name field
-	if ok, _ := regexp.Match("^[0-9A-Za-z_.@-]+$", []byte(req.Username)); !ok {
-		fmt.Println(req.Username)
+	if !ValidName(req.Username) {
 		return nil, InvalidNameError{}
 	}
 
 	return req, nil
 }
+
+// Certificate returns the signed certificate, or nil if the request has not been signed.
+func (r *Request) Certificate() *x509.Certificate {
+	if !r.signed {
+		return nil
+	}
+	return r.crt
+}
+
+// Serial returns the signed certificate's serial number in hex, or an empty string if the request has not been signed.
+func (r *Request) Serial() string {
+	if !r.signed {
+		return ""
+	}
+	return serialString(r.crt.SerialNumber)
+}
+
+// CSR returns the DER encoding of the certificate signing request.
+func (r *Request) CSR() []byte {
+	return r.csr.Raw
+}
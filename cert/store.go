@@ -0,0 +1,150 @@
+package cert
+
+import (
+	"crypto/x509"
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Issued is the record kept in the database for every certificate signed by the CA.
+type Issued struct {
+	Serial    string    `storm:"id"`
+	Username  string    `storm:"index"`
+	NotAfter  time.Time `storm:"index"`
+	Revoked   bool
+	RevokedAt time.Time
+	Notified  time.Time // When the user was last warned that this certificate is about to expire
+	DER       []byte
+}
+
+// Certificate parses the stored certificate.
+func (i *Issued) Certificate() (*x509.Certificate, error) {
+	return x509.ParseCertificate(i.DER)
+}
+
+// Record stores a signed request in the database so that it can be found by later expiry checks.
+func Record(req *Request) error {
+	if !req.signed {
+		return errors.New("request has not been signed")
+	}
+
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	i := Issued{
+		Serial:   serialString(req.crt.SerialNumber),
+		Username: req.Username,
+		NotAfter: req.crt.NotAfter.UTC(),
+		DER:      req.crt.Raw,
+	}
+	if err := db.Save(&i); err != nil {
+		return errors.Wrap(err, "while recording issued certificate")
+	}
+	return nil
+}
+
+// Expiring returns every unrevoked certificate that has not yet expired but will do so within the given duration.
+func Expiring(within time.Duration) ([]Issued, error) {
+	return expiringAt(time.Now(), within)
+}
+
+// expiringAt is Expiring as seen at the given time.
+func expiringAt(now time.Time, within time.Duration) ([]Issued, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var all []Issued
+	// Times are compared as encoded in the index, so they must all be in the same zone
+	now = now.UTC()
+	if err := db.Range("NotAfter", now, now.Add(within), &all); err != nil && err != storm.ErrNotFound {
+		return nil, errors.Wrap(err, "while querying issued certificates")
+	}
+
+	var result []Issued
+	for _, v := range all {
+		if !v.Revoked {
+			result = append(result, v)
+		}
+	}
+	return result, nil
+}
+
+// MarkNotified records that the owner of a certificate has been warned about its expiry.
+func MarkNotified(serial string) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.UpdateField(&Issued{Serial: serial}, "Notified", time.Now()); err != nil {
+		return errors.Wrap(err, "while updating issued certificate")
+	}
+	return nil
+}
+
+// FindIssued returns the issued certificate record for a hex-encoded serial number.
+func FindIssued(serial string) (*Issued, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var i = new(Issued)
+	if err := db.One("Serial", serial, i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// Revoke marks an issued certificate as revoked. Revocation takes effect immediately for OCSP clients.
+func Revoke(serial string) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var i = new(Issued)
+	if err := db.One("Serial", serial, i); err != nil {
+		return errors.Wrap(err, "while querying issued certificates")
+	}
+	if i.Revoked {
+		return nil
+	}
+	i.Revoked = true
+	i.RevokedAt = time.Now()
+	if err := db.Save(i); err != nil {
+		return errors.Wrap(err, "while revoking certificate")
+	}
+	return nil
+}
+
+// ListIssued returns every certificate issued to a user, or every certificate issued if username is empty.
+func ListIssued(username string) ([]Issued, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var result []Issued
+	if username == "" {
+		err = db.All(&result)
+	} else {
+		err = db.Find("Username", username, &result)
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return nil, errors.Wrap(err, "while querying issued certificates")
+	}
+	return result, nil
+}
@@ -0,0 +1,119 @@
+package cert
+
+import (
+	"bytes"
+	"github.com/alowde/totp-ovpn/store"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testZone is a zone other than UTC, so that comparisons between local and stored times are caught.
+var testZone = time.FixedZone("UTC-12", -12*60*60)
+
+// useTestDB points the store at an empty database for the duration of a test.
+func useTestDB(t *testing.T) {
+	path := store.Path
+	store.Path = filepath.Join(t.TempDir(), "test.db")
+	t.Cleanup(func() { store.Path = path })
+}
+
+// signedRequest returns the test CSR signed by the test CA.
+func signedRequest(t *testing.T) *Request {
+	c, err := NewCAFromReaders(bytes.NewReader(ca), bytes.NewReader(keyPEMPKCS8RSA), "")
+	if err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+	req, err := NewRequestFromReader(bytes.NewReader(keyCSR))
+	if err != nil {
+		t.Fatalf("Failed to initialise CSR %s", err)
+	}
+	if err := c.SignRequest(req); err != nil {
+		t.Fatalf("Failed to sign request with error %s", err)
+	}
+	return req
+}
+
+func TestRecord(t *testing.T) {
+	useTestDB(t)
+
+	req, err := NewRequestFromReader(bytes.NewReader(keyCSR))
+	if err != nil {
+		t.Fatalf("Failed to initialise CSR %s", err)
+	}
+	if err := Record(req); err == nil {
+		t.Errorf("Unsigned request was recorded")
+	}
+
+	req = signedRequest(t)
+	req.crt.NotAfter = req.crt.NotAfter.In(testZone)
+	if err := Record(req); err != nil {
+		t.Fatalf("Failed to record certificate with error %s", err)
+	}
+	i, err := FindIssued(req.Serial())
+	if err != nil {
+		t.Fatalf("Failed to find recorded certificate with error %s", err)
+	}
+	if i.Username != req.Username || !i.NotAfter.Equal(req.Certificate().NotAfter) || i.Revoked {
+		t.Errorf("Recorded %+v for %s", i, req.Username)
+	}
+	if issued, err := ListIssued(req.Username); err != nil || len(issued) != 1 {
+		t.Errorf("ListIssued(%s) = %d certificates, error %v", req.Username, len(issued), err)
+	}
+}
+
+func TestExpiring(t *testing.T) {
+	useTestDB(t)
+
+	req := signedRequest(t)
+	if err := Record(req); err != nil {
+		t.Fatalf("Failed to record certificate with error %s", err)
+	}
+	now := time.Now().In(testZone)
+	lifetime := req.Certificate().NotAfter.Sub(now)
+
+	expiring, err := expiringAt(now, lifetime+time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to query expiring certificates with error %s", err)
+	}
+	if len(expiring) != 1 || expiring[0].Serial != req.Serial() {
+		t.Errorf("Expiring(%s) = %+v, want %s", lifetime+time.Hour, expiring, req.Serial())
+	}
+	if expiring, _ = expiringAt(now, lifetime-time.Hour); len(expiring) != 0 {
+		t.Errorf("Expiring(%s) included a certificate expiring after it", lifetime-time.Hour)
+	}
+
+	if err := Revoke(req.Serial()); err != nil {
+		t.Fatalf("Failed to revoke certificate with error %s", err)
+	}
+	if expiring, _ = expiringAt(now, lifetime+time.Hour); len(expiring) != 0 {
+		t.Errorf("Expiring included a revoked certificate")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	useTestDB(t)
+
+	if err := Revoke("00"); err == nil {
+		t.Errorf("Unknown certificate was revoked")
+	}
+
+	req := signedRequest(t)
+	if err := Record(req); err != nil {
+		t.Fatalf("Failed to record certificate with error %s", err)
+	}
+	before := time.Now()
+	if err := Revoke(req.Serial()); err != nil {
+		t.Fatalf("Failed to revoke certificate with error %s", err)
+	}
+	i, err := FindIssued(req.Serial())
+	if err != nil {
+		t.Fatalf("Failed to find revoked certificate with error %s", err)
+	}
+	if !i.Revoked || i.RevokedAt.Before(before.Truncate(time.Second)) {
+		t.Errorf("Revocation wasn't recorded: %+v", i)
+	}
+	if err := Revoke(req.Serial()); err != nil {
+		t.Errorf("Revoking a revoked certificate failed with error %s", err)
+	}
+}
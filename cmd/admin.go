@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/alowde/totp-ovpn/admin"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"strconv"
+)
+
+func init() {
+	rootCmd.AddCommand(adminCmd)
+	adminCmd.AddCommand(addAdminCmd)
+	adminCmd.AddCommand(listAdminsCmd)
+	adminCmd.AddCommand(resetAdminOTPCmd)
+	adminCmd.AddCommand(unlockAdminCmd)
+	adminCmd.AddCommand(removeAdminCmd)
+}
+
+var adminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Functions for managing admin console accounts",
+}
+
+var addAdminCmd = &cobra.Command{
+	Use:   "add",
+	Short: "Add a new admin account",
+	Long: `Call with totp-ovpn admin add [name] [password]. The TOTP URI printed must be added to the admin's
+2FA application, as it's needed to log in to the admin console.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if _, err := admin.FromDB(args[0]); err == nil {
+			log.Fatalf("Admin %s already exists, refusing to overwrite.\n", args[0])
+		}
+		a, err := admin.New(args[0], args[1])
+		if err != nil {
+			log.Fatalf("While creating admin: %v", err)
+		}
+		if err := a.Save(); err != nil {
+			log.Fatalf("While saving admin: %v", err)
+		}
+		fmt.Println(a.Key)
+	},
+}
+
+var listAdminsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Print a list of admin accounts",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		accounts, err := admin.All()
+		if err != nil {
+			log.Fatalf("Error while querying DB: %s\n", err)
+		}
+
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Username", "Locked"})
+		table.SetBorder(false)
+		for _, v := range accounts {
+			table.Append([]string{v.Username, strconv.FormatBool(v.Locked())})
+		}
+		table.Render()
+	},
+}
+
+var resetAdminOTPCmd = &cobra.Command{
+	Use:   "reset-otp",
+	Short: "Generate a new TOTP key for an admin account",
+	Long:  `Call with totp-ovpn admin reset-otp [name]. The new TOTP URI is printed.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		a, err := admin.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading admin: %v", err)
+		}
+		if err := a.Update((*admin.Account).ResetOTP); err != nil {
+			log.Fatalf("While resetting TOTP key: %v", err)
+		}
+		fmt.Println(a.Key)
+	},
+}
+
+var unlockAdminCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Unlock an admin account locked after too many failed logins",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		a, err := admin.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading admin: %v", err)
+		}
+		if err := a.Update(func(current *admin.Account) error { current.Unlock(); return nil }); err != nil {
+			log.Fatalf("While saving admin: %v", err)
+		}
+	},
+}
+
+var removeAdminCmd = &cobra.Command{
+	Use:   "remove",
+	Short: "Remove an admin account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		a, err := admin.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading admin: %v", err)
+		}
+		if err := a.Delete(); err != nil {
+			log.Fatalf("While removing admin: %v", err)
+		}
+	},
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/webhook"
+	"github.com/spf13/cobra"
+)
+
+var AuditLog string
+var AuditDB bool
+
+func addAuditFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&AuditLog, "audit-log", "stdout", "Write audit events as JSON lines to stdout, syslog, a file path, or none")
+	cmd.Flags().BoolVar(&AuditDB, "audit-db", true, "Store audit events in the database for the admin console")
+	addWebhookFlags(cmd)
+}
+
+// setAuditSinks sends audit events to the sinks selected by the audit and webhook flags.
+func setAuditSinks() error {
+	if err := setWebhookEndpoints(); err != nil {
+		return err
+	}
+	var sinks []audit.Sink
+	if AuditLog != "none" {
+		s, err := audit.Open(AuditLog)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, s)
+	}
+	if AuditDB {
+		sinks = append(sinks, audit.DB{})
+	}
+	if len(webhook.Endpoints) > 0 {
+		sinks = append(sinks, webhook.Sink{})
+	}
+	audit.SetSinks(sinks...)
+	return nil
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/server"
+	"github.com/olekukonko/tablewriter"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ExpiringWithin string
+var ExpiringNotify bool
+
+func init() {
+	rootCmd.AddCommand(certCmd)
+	certCmd.AddCommand(expiringCertCmd)
+	certCmd.AddCommand(revokeCertCmd)
+
+	expiringCertCmd.Flags().StringVar(&ExpiringWithin, "within", "30d", "Report certificates expiring within this period (e.g. 30d, 72h)")
+	expiringCertCmd.Flags().BoolVar(&ExpiringNotify, "notify", false, "Notify the owners of expiring certificates")
+	addNotifierFlags(expiringCertCmd)
+	addAuditFlags(revokeCertCmd)
+}
+
+// parseDays extends time.ParseDuration with a "d" suffix for whole days, which is how certificate lifetimes are
+// normally discussed.
+func parseDays(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, errors.Errorf("invalid number of days: %s", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+var certCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Functions for inspecting issued certificates",
+}
+
+var expiringCertCmd = &cobra.Command{
+	Use:   "expiring",
+	Short: "List certificates that are about to expire",
+	Long:  `Call with totp-ovpn cert expiring --within 30d`,
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		within, err := parseDays(ExpiringWithin)
+		if err != nil {
+			log.Fatalf("Invalid --within value: %s\n", err)
+		}
+
+		expiring, err := cert.Expiring(within)
+		if err != nil {
+			log.Fatalf("Error while querying DB: %s\n", err)
+		}
+
+		table := tablewriter.NewWriter(os.Stdout)
+		table.SetHeader([]string{"Username", "Serial", "Expires", "Notified"})
+		table.SetBorder(false)
+		for _, v := range expiring {
+			notified := ""
+			if !v.Notified.IsZero() {
+				notified = v.Notified.Format(time.RFC3339)
+			}
+			table.Append([]string{v.Username, v.Serial, v.NotAfter.Format(time.RFC3339), notified})
+		}
+		table.Render()
+
+		if ExpiringNotify {
+			sent, err := server.NotifyExpiring(within, notifiers())
+			if err != nil {
+				log.Fatalf("Error while notifying users: %s\n", err)
+			}
+			log.Printf("Notified %d user(s)\n", sent)
+		}
+	},
+}
+
+var revokeCertCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke an issued certificate",
+	Long:  `Call with totp-ovpn cert revoke [serial], where serial is the hex serial shown by cert expiring`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := setAuditSinks(); err != nil {
+			log.Fatalf("While opening audit log: %s\n", err)
+		}
+		serial := strings.ToLower(args[0])
+		if err := cert.Revoke(serial); err != nil {
+			audit.Record(audit.Event{Action: "certificate.revoke", Outcome: audit.Error, Detail: err.Error()})
+			log.Fatalf("Error while revoking certificate: %s\n", err)
+		}
+		var owner string
+		if i, err := cert.FindIssued(serial); err == nil {
+			owner = i.Username
+		}
+		audit.Record(audit.Event{Action: "certificate.revoke", User: owner, Outcome: audit.Success, Detail: "serial " + serial})
+	},
+}
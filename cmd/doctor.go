@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/alowde/totp-ovpn/server"
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+var DoctorDBTimeout time.Duration
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+	addServeFlags(doctorCmd)
+	doctorCmd.Flags().StringVar(&server.ClockReferenceURL, "clock-reference", "", "URL of an HTTP server whose Date header is compared with this machine's clock")
+	doctorCmd.Flags().DurationVar(&server.MaxClockSkew, "max-clock-skew", server.MaxClockSkew, "Largest clock difference from --clock-reference to accept")
+	doctorCmd.Flags().DurationVar(&DoctorDBTimeout, "db-timeout", 5*time.Second, "How long to wait for another process to release the database")
+}
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the configuration and environment for problems",
+	Long: `Call with the same flags as totp-ovpn serve. Checks the configuration, the database, the CA and portal
+certificates, file permissions and the clock, and explains how to fix anything wrong. Exits with status 1 if any
+check fails.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		applyServeFlags()
+		store.Timeout = DoctorDBTimeout
+
+		checks := server.Diagnose()
+		labels := map[string]string{server.StatusOK: " ok ", server.StatusWarn: "warn", server.StatusFail: "FAIL"}
+		failures := 0
+		for _, c := range checks {
+			fmt.Printf("[%s] %s: %s\n", labels[c.Status], c.Name, c.Message)
+			if c.Status == server.StatusFail {
+				failures++
+			}
+		}
+		if failures > 0 {
+			fmt.Printf("%d check(s) failed\n", failures)
+			os.Exit(1)
+		}
+	},
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"github.com/alowde/totp-ovpn/notify"
+	"github.com/alowde/totp-ovpn/server"
+	"github.com/spf13/cobra"
+	"log"
+	"net"
+	"net/smtp"
+)
+
+var NotifyLog bool
+var SMTPServer string
+var SMTPFrom string
+var SMTPDomain string
+var SMTPUser string
+var SMTPPassword string
+var SMTPTLS string
+var SMTPTemplateDir string
+
+func addNotifierFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&NotifyLog, "notify-log", false, "Log notifications")
+	cmd.Flags().StringVar(&SMTPServer, "smtp-server", "", "Email notifications through this mail server (host:port)")
+	cmd.Flags().StringVar(&SMTPFrom, "smtp-from", "totp-ovpn@localhost", "Sender address for email notifications")
+	cmd.Flags().StringVar(&SMTPDomain, "smtp-domain", "", "Domain appended to usernames to build email addresses")
+	cmd.Flags().StringVar(&SMTPUser, "smtp-user", "", "Username for mail server authentication")
+	cmd.Flags().StringVar(&SMTPPassword, "smtp-password", "", "Password for mail server authentication")
+	cmd.Flags().StringVar(&SMTPTLS, "smtp-tls", "", "starttls to require STARTTLS, or tls to connect over TLS; by default STARTTLS is used if offered")
+	cmd.Flags().StringVar(&SMTPTemplateDir, "smtp-template-dir", "", "Directory of email template overrides")
+	cmd.Flags().StringVar(&server.PortalURL, "portal-url", "", "Address of the portal, linked from emails")
+}
+
+// notifiers builds the set of notifiers selected by the notifier flags, exiting if they're invalid.
+func notifiers() (n []notify.Notifier) {
+	if NotifyLog {
+		n = append(n, notify.Log{})
+	}
+	if SMTPServer != "" {
+		if SMTPTLS != notify.TLSOpportunistic && SMTPTLS != notify.TLSStartTLS && SMTPTLS != notify.TLSImplicit {
+			log.Fatalf("Invalid --smtp-tls value %s, expected starttls or tls\n", SMTPTLS)
+		}
+		s := notify.SMTP{Addr: SMTPServer, From: SMTPFrom, Domain: SMTPDomain, TLS: SMTPTLS}
+		if SMTPTemplateDir != "" {
+			t, err := notify.LoadTemplates(SMTPTemplateDir)
+			if err != nil {
+				log.Fatalf("While loading email templates: %s\n", err)
+			}
+			s.Templates = t
+		}
+		if SMTPUser != "" {
+			host, _, _ := net.SplitHostPort(SMTPServer)
+			s.Auth = smtp.PlainAuth("", SMTPUser, SMTPPassword, host)
+		}
+		n = append(n, s)
+	}
+	return
+}
@@ -1,11 +1,76 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/alowde/totp-ovpn/server"
+	"github.com/alowde/totp-ovpn/user"
 	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
+var ExpiryWarning string
+var CAPasswordFile string
+
+func init() {
+	addServeFlags(serveCmd)
+	serveCmd.Flags().DurationVar(&server.DrainDelay, "drain-delay", 0, "How long to keep serving with /readyz failing before shutting down")
+	addNotifierFlags(serveCmd)
+	addAuditFlags(serveCmd)
+}
+
+// addServeFlags adds the flags configuring the server to cmd, so that commands checking the configuration accept the
+// same flags as serve.
+func addServeFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&ExpiryWarning, "expiry-warning", "30d", "Warn users this long before their certificate expires")
+	cmd.Flags().StringVar(&server.CACertPath, "ca-cert", "", "CA certificate used to sign client certificates, or a PKCS#12 bundle if --ca-key is not set")
+	cmd.Flags().StringVar(&server.CAKeyPath, "ca-key", "", "Private key for the CA certificate")
+	cmd.Flags().StringVar(&server.CAPassword, "ca-password", "", "Password for an encrypted CA key or PKCS#12 bundle")
+	cmd.Flags().StringVar(&CAPasswordFile, "ca-password-file", "", "Read the CA password from this file")
+	cmd.Flags().StringVar(&server.CASignerSocket, "ca-signer-socket", "", "Unix socket of a signing daemon holding the CA key")
+	cmd.Flags().StringVar(&server.PKCS11Module, "ca-pkcs11-module", "", "PKCS#11 module holding the CA key")
+	cmd.Flags().StringVar(&server.PKCS11Token, "ca-pkcs11-token", "", "Label of the PKCS#11 token holding the CA key")
+	cmd.Flags().StringVar(&server.PKCS11PIN, "ca-pkcs11-pin", "", "PIN for the PKCS#11 token")
+	cmd.Flags().StringVar(&server.PKCS11KeyLabel, "ca-pkcs11-key", "", "Label of the CA key pair on the PKCS#11 token")
+	cmd.Flags().StringVar(&server.OCSPCertPath, "ocsp-cert", "", "Delegated OCSP responder certificate (defaults to the CA)")
+	cmd.Flags().StringVar(&server.OCSPKeyPath, "ocsp-key", "", "Private key for the delegated OCSP responder certificate")
+	cmd.Flags().BoolVar(&server.PersistentSessions, "persistent-sessions", false, "Keep sessions in the database so enrollments survive a restart")
+	cmd.Flags().StringVar(&server.SessionSecretPath, "session-secret", "", "File holding a secret shared by all replicas, which must also share the database; enables sealed session cookies")
+	cmd.Flags().DurationVar(&server.SessionKeyRotation, "session-key-rotation", server.SessionKeyRotation, "How often the session cookie key rotates")
+	cmd.Flags().BoolVar(&server.SlidingSessions, "sliding-sessions", false, "Extend sessions each time they're used")
+	cmd.Flags().DurationVar(&server.SessionSweepInterval, "session-sweep-interval", server.SessionSweepInterval, "How often expired sessions are removed")
+	cmd.Flags().BoolVar(&server.BindSessionIP, "bind-session-ip", false, "Reject sessions used from a different address")
+	cmd.Flags().IntVar(&server.BindSessionPrefix, "bind-session-prefix", 0, "Only require this many leading address bits to match")
+	cmd.Flags().BoolVar(&server.BindSessionUserAgent, "bind-session-user-agent", false, "Reject sessions used with a different User-Agent")
+	cmd.Flags().DurationVar(&server.ReauthWindow, "reauth-window", server.ReauthWindow, "How long a TOTP code authorises sensitive actions")
+	cmd.Flags().StringVar(&server.VPNRemote, "vpn-remote", server.VPNRemote, "Remote line for downloaded OpenVPN profiles")
+	cmd.Flags().StringVar(&server.APITokensPath, "api-tokens", "", "File of admin API tokens, one per line")
+	cmd.Flags().StringVar(&server.APIClientCAPath, "api-client-ca", "", "CA certificate for admin API client certificates")
+	cmd.Flags().StringSliceVar(&server.APIAdminNames, "api-admin-name", nil, "Common Name allowed to use the admin API with a client certificate (repeatable)")
+	cmd.Flags().IntVar(&user.MaxFailedAttempts, "max-failed-attempts", user.MaxFailedAttempts, "Consecutive failed logins before an account is locked")
+	cmd.Flags().DurationVar(&user.LockoutDuration, "lockout-duration", user.LockoutDuration, "How long accounts stay locked")
+	cmd.Flags().StringVar(&server.TemplateDir, "template-dir", "", "Directory of template overrides, branding.json, message catalogs and static files")
+	cmd.Flags().StringVar(&server.ListenAddr, "listen", server.ListenAddr, "Address to serve HTTPS on, or unix:/path for a unix socket")
+	cmd.Flags().StringVar(&server.RedirectAddr, "redirect-listen", server.RedirectAddr, "Address redirecting plain HTTP to HTTPS; empty to disable")
+	cmd.Flags().DurationVar(&server.ReadTimeout, "read-timeout", server.ReadTimeout, "Longest time to read a request")
+	cmd.Flags().DurationVar(&server.WriteTimeout, "write-timeout", server.WriteTimeout, "Longest time to write a response")
+	cmd.Flags().DurationVar(&server.IdleTimeout, "idle-timeout", server.IdleTimeout, "How long idle keep-alive connections are kept open")
+	cmd.Flags().DurationVar(&server.ShutdownTimeout, "shutdown-timeout", server.ShutdownTimeout, "How long in-flight requests may take to finish on shutdown")
+	cmd.Flags().DurationVar(&server.ReloadCheckInterval, "reload-interval", server.ReloadCheckInterval, "How often certificate and CA files are checked for changes; 0 to only reload on SIGHUP")
+	cmd.Flags().StringSliceVar(&server.ACMEDomains, "acme-domain", nil, "Get the portal certificate for this name from an ACME directory (repeatable)")
+	cmd.Flags().StringVar(&server.ACMEDirectoryURL, "acme-directory", server.ACMEDirectoryURL, "ACME directory URL")
+	cmd.Flags().StringVar(&server.ACMEEmail, "acme-email", "", "Contact address for the ACME account")
+	cmd.Flags().StringVar(&server.ACMERootCAPath, "acme-root-ca", "", "CA certificate to trust for the ACME directory, e.g. a test directory's")
+	cmd.Flags().BoolVar(&server.ProxyMode, "proxy", false, "Serve plain HTTP on --listen for a reverse proxy that terminates TLS")
+	cmd.Flags().StringSliceVar(&server.TrustedProxies, "trusted-proxy", nil, "Address or CIDR of a proxy whose forwarding headers are trusted (repeatable)")
+	cmd.Flags().StringVar(&server.ForwardedHeader, "forwarded-header", server.ForwardedHeader, "Header the trusted proxies set to the client's address: X-Forwarded-For or Forwarded")
+	cmd.Flags().StringVar(&server.MetricsAddr, "metrics-listen", "", "Address to serve Prometheus metrics on at /metrics over plain HTTP; empty to disable")
+	cmd.Flags().IntVar(&server.AuthRateLimit, "auth-rate-limit", server.AuthRateLimit, "Login and code attempts allowed per client address per minute; 0 to disable")
+}
+
 var serveCmd = &cobra.Command{
 	Use:   "serve",
 	Short: "Run or configure server",
@@ -13,7 +78,31 @@ var serveCmd = &cobra.Command{
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 
-		fmt.Println(server.Run())
+		applyServeFlags()
+		server.Notifiers = notifiers()
+		if err := setAuditSinks(); err != nil {
+			log.Fatalf("While opening audit log: %s\n", err)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := server.Run(ctx); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
 	},
 }
+
+// applyServeFlags sets the server options that addServeFlags can't set directly.
+func applyServeFlags() {
+	var err error
+	if server.ExpiryWarning, err = parseDays(ExpiryWarning); err != nil {
+		log.Fatalf("Invalid --expiry-warning value: %s\n", err)
+	}
+	if CAPasswordFile != "" {
+		if server.CAPassword, err = readPasswordFile(CAPasswordFile); err != nil {
+			log.Fatalf("While reading CA password: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"crypto"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+var SignerSocket string
+var SignerCertPath string
+var SignerKeyPath string
+var SignerPassword string
+var SignerPasswordFile string
+var SignerPKCS11Module string
+var SignerPKCS11Token string
+var SignerPKCS11PIN string
+var SignerPKCS11Key string
+
+func init() {
+	rootCmd.AddCommand(signerCmd)
+
+	signerCmd.Flags().StringVar(&SignerSocket, "socket", "signer.sock", "Unix socket to listen on")
+	signerCmd.Flags().StringVar(&SignerCertPath, "ca-cert", "", "CA certificate, or a PKCS#12 bundle if --ca-key is not set")
+	signerCmd.Flags().StringVar(&SignerKeyPath, "ca-key", "", "Private key for the CA certificate")
+	signerCmd.Flags().StringVar(&SignerPassword, "ca-password", "", "Password for an encrypted CA key or PKCS#12 bundle")
+	signerCmd.Flags().StringVar(&SignerPasswordFile, "ca-password-file", "", "Read the CA password from this file")
+	signerCmd.Flags().StringVar(&SignerPKCS11Module, "ca-pkcs11-module", "", "PKCS#11 module holding the CA key")
+	signerCmd.Flags().StringVar(&SignerPKCS11Token, "ca-pkcs11-token", "", "Label of the PKCS#11 token holding the CA key")
+	signerCmd.Flags().StringVar(&SignerPKCS11PIN, "ca-pkcs11-pin", "", "PIN for the PKCS#11 token")
+	signerCmd.Flags().StringVar(&SignerPKCS11Key, "ca-pkcs11-key", "", "Label of the CA key pair on the PKCS#11 token")
+}
+
+// readPasswordFile reads a password from the first line of a file.
+func readPasswordFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.SplitN(string(b), "\n", 2)[0], nil
+}
+
+// loadSigner unlocks the CA key selected by the signer flags.
+func loadSigner() (crypto.Signer, error) {
+	if SignerPKCS11Module != "" {
+		return cert.NewPKCS11Signer(SignerPKCS11Module, SignerPKCS11Token, SignerPKCS11PIN, SignerPKCS11Key)
+	}
+
+	certFile, err := os.Open(SignerCertPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening CA certificate")
+	}
+	defer certFile.Close()
+
+	if SignerKeyPath == "" {
+		ca, err := cert.NewCAFromPKCS12(certFile, SignerPassword)
+		if err != nil {
+			return nil, err
+		}
+		return ca.Signer(), nil
+	}
+
+	keyFile, err := os.Open(SignerKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening CA key")
+	}
+	defer keyFile.Close()
+
+	ca, err := cert.NewCAFromReaders(certFile, keyFile, SignerPassword)
+	if err != nil {
+		return nil, err
+	}
+	return ca.Signer(), nil
+}
+
+var signerCmd = &cobra.Command{
+	Use:   "signer",
+	Short: "Run a signing daemon holding the CA key",
+	Long: `Run a signing daemon that holds the CA key and signs on behalf of totp-ovpn serve --ca-signer-socket, so that
+the key never has to be loaded by the web server. The socket is only accessible to the user running the daemon.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if SignerPasswordFile != "" {
+			var err error
+			if SignerPassword, err = readPasswordFile(SignerPasswordFile); err != nil {
+				log.Fatalf("While reading CA password: %s\n", err)
+			}
+		}
+
+		signer, err := loadSigner()
+		if err != nil {
+			log.Fatalf("While loading CA key: %s\n", err)
+		}
+
+		_ = os.Remove(SignerSocket)
+		oldMask := syscall.Umask(0077)
+		l, err := net.Listen("unix", SignerSocket)
+		syscall.Umask(oldMask)
+		if err != nil {
+			log.Fatalf("While listening on %s: %s\n", SignerSocket, err)
+		}
+
+		signalChan := make(chan os.Signal, 1)
+		signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-signalChan
+			l.Close()
+		}()
+
+		if err := cert.ServeSigner(l, signer); err != nil {
+			log.Fatalf("Signer failed: %s\n", err)
+		}
+	},
+}
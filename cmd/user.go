@@ -1,6 +1,10 @@
 package cmd
 
 import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/metrics"
+	"github.com/alowde/totp-ovpn/server"
+	"github.com/alowde/totp-ovpn/store"
 	"github.com/alowde/totp-ovpn/user"
 	"github.com/asdine/storm"
 	"github.com/olekukonko/tablewriter"
@@ -12,13 +16,24 @@ import (
 )
 
 var IncSensitive bool
+var UserEmail string
 
 func init() {
 	rootCmd.AddCommand(userCmd)
 	userCmd.AddCommand(addUserCmd)
 	userCmd.AddCommand(verifyUserCmd)
 	userCmd.AddCommand(listUsersCmd)
+	userCmd.AddCommand(resetPasswordCmd)
+	userCmd.AddCommand(resetOTPCmd)
+	userCmd.AddCommand(disableUserCmd)
+	userCmd.AddCommand(enableUserCmd)
+	userCmd.AddCommand(unlockUserCmd)
+	userCmd.AddCommand(setEmailCmd)
 
+	addUserCmd.Flags().StringVar(&UserEmail, "email", "", "Email address to send the user an invitation and other notifications")
+	addNotifierFlags(addUserCmd)
+	addAuditFlags(verifyUserCmd)
+	addNotifierFlags(verifyUserCmd)
 	listUsersCmd.Flags().BoolVar(&IncSensitive, "include-sensitive", false, "Include sensitive information")
 }
 
@@ -30,10 +45,10 @@ var userCmd = &cobra.Command{
 var addUserCmd = &cobra.Command{
 	Use:   "add",
 	Short: "Add a new user",
-	Long:  `Call with totp-ovpn user add [name] [password]`,
+	Long:  `Call with totp-ovpn user add [name] [password]. With --email, the user is emailed an invitation.`,
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		db, err := storm.Open("my.db")
+		db, err := store.Open()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -56,12 +71,18 @@ var addUserCmd = &cobra.Command{
 			log.Fatalf("User %s already exists and is initialised, refusing to overwrite.\n", args[0])
 		}
 		u = user.New(args[0], args[1])
+		if err := u.SetEmail(UserEmail); err != nil {
+			log.Fatalln(err)
+		}
 		if err := tx.Save(u); err != nil {
 			log.Fatalf("Warning: error while writing to database. User data may be inconsistent. Error: %s\n", err)
 		}
 		if err := tx.Commit(); err != nil {
 			log.Fatalf("Error while committing to DB: %s\n", err)
 		}
+		if err := server.NotifyInvited(u, args[1], notifiers()); err != nil {
+			log.Printf("While sending invitation: %s\n", err)
+		}
 	},
 }
 
@@ -71,7 +92,12 @@ var verifyUserCmd = &cobra.Command{
 	Long:  `It's a user verify function'`,
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		valid, err := user.Verify(args[0], args[1])
+		if err := setAuditSinks(); err != nil {
+			log.Fatalf("While opening audit log: %s\n", err)
+		}
+		// OpenVPN passes the client's address to auth scripts in untrusted_ip
+		valid, err := user.VerifyFrom(args[0], args[1], os.Getenv("untrusted_ip"))
+		recordVerify(args[0], os.Getenv("untrusted_ip"), err)
 		if err != nil {
 			log.Fatalln(errors.Wrap(err, "Encountered an error"))
 		}
@@ -82,12 +108,49 @@ var verifyUserCmd = &cobra.Command{
 	},
 }
 
+// recordVerify audits and counts a VPN login checked by the verify command.
+func recordVerify(name, address string, err error) {
+	e := audit.Event{Action: "vpn.login", User: name, IP: address, Outcome: audit.Success}
+	result := metrics.ResultSuccess
+	switch err {
+	case nil:
+	case user.ErrInvalidPasscode:
+		e.Outcome, e.Detail, result = audit.Failure, err.Error(), metrics.ResultInvalidCode
+	case user.ErrDisabled:
+		e.Outcome, e.Detail, result = audit.Failure, err.Error(), metrics.ResultDisabled
+	case user.ErrLockedOut:
+		e.Outcome, e.Detail, result = audit.Failure, err.Error(), metrics.ResultLockedOut
+	default:
+		e.Outcome, e.Detail, result = audit.Error, err.Error(), metrics.ResultError
+		if _, ok := errors.Cause(err).(user.ErrUserNotFound); ok {
+			e.Outcome, result = audit.Failure, metrics.ResultUnknownUser
+		}
+	}
+	audit.Record(e)
+
+	// VerifyFrom only returns ErrInvalidPasscode after checking the code, so a user locked now was locked by this attempt
+	lockedOut := false
+	if result == metrics.ResultInvalidCode {
+		if u, err := user.FromDB(name); err == nil && u.Locked() {
+			lockedOut = true
+			audit.Record(audit.Event{Action: "lockout", User: name, IP: address, Outcome: audit.Failure,
+				Detail: "too many failed attempts"})
+			if err := server.NotifyLockedOut(u, address, notifiers()); err != nil {
+				log.Printf("While sending lockout notice: %s", err)
+			}
+		}
+	}
+	if err := metrics.CountScriptAuth(result, lockedOut); err != nil {
+		log.Printf("While counting login: %s", err)
+	}
+}
+
 var listUsersCmd = &cobra.Command{
 	Use:   "list",
 	Short: "Print a list of users",
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
-		db, err := storm.Open("my.db")
+		db, err := store.Open()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -100,18 +163,114 @@ var listUsersCmd = &cobra.Command{
 
 		table := tablewriter.NewWriter(os.Stdout)
 		if IncSensitive {
-			table.SetHeader([]string{"Username", "OTP Key", "Initialised"})
+			table.SetHeader([]string{"Username", "Email", "OTP Key", "Initialised", "Disabled"})
 		} else {
-			table.SetHeader([]string{"Username", "Initialised"})
+			table.SetHeader([]string{"Username", "Email", "Initialised", "Disabled"})
 		}
 		table.SetBorder(false)
 		for _, v := range users {
 			if IncSensitive {
-				table.Append([]string{v.Username, v.Key, strconv.FormatBool(v.Initialised)})
+				table.Append([]string{v.Username, v.Email, v.Key, strconv.FormatBool(v.Initialised), strconv.FormatBool(v.Disabled)})
 			} else {
-				table.Append([]string{v.Username, strconv.FormatBool(v.Initialised)})
+				table.Append([]string{v.Username, v.Email, strconv.FormatBool(v.Initialised), strconv.FormatBool(v.Disabled)})
 			}
 		}
 		table.Render()
 	},
 }
+
+var resetPasswordCmd = &cobra.Command{
+	Use:   "reset-password",
+	Short: "Set a new password for an existing user",
+	Long:  `Call with totp-ovpn user reset-password [name] [password]. Any portal sessions the user holds are ended.`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := user.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading user: %v", err)
+		}
+		if err := u.Update(func(current *user.User) error { return current.ResetPassword(args[1]) }); err != nil {
+			log.Fatalf("While setting password: %v", err)
+		}
+	},
+}
+
+var resetOTPCmd = &cobra.Command{
+	Use:   "reset-otp",
+	Short: "Generate a new TOTP key for an existing user",
+	Long:  `Call with totp-ovpn user reset-otp [name]. The user must enroll their 2FA device again, and any portal sessions they hold are ended.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := user.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading user: %v", err)
+		}
+		if err := u.Update((*user.User).ResetOTP); err != nil {
+			log.Fatalf("While resetting TOTP key: %v", err)
+		}
+	},
+}
+
+var disableUserCmd = &cobra.Command{
+	Use:   "disable",
+	Short: "Prevent a user from enrolling or authenticating",
+	Long:  `Call with totp-ovpn user disable [name]. Any portal sessions the user holds are ended.`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := user.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading user: %v", err)
+		}
+		if err := u.Update(func(current *user.User) error { current.Disable(); return nil }); err != nil {
+			log.Fatalf("While saving user: %v", err)
+		}
+	},
+}
+
+var enableUserCmd = &cobra.Command{
+	Use:   "enable",
+	Short: "Re-enable a disabled user",
+	Long:  `Call with totp-ovpn user enable [name]`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := user.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading user: %v", err)
+		}
+		if err := u.Update(func(current *user.User) error { current.Disabled = false; return nil }); err != nil {
+			log.Fatalf("While saving user: %v", err)
+		}
+	},
+}
+
+var setEmailCmd = &cobra.Command{
+	Use:   "set-email",
+	Short: "Set or clear the address a user's notifications are emailed to",
+	Long:  `Call with totp-ovpn user set-email [name] [address], or an empty address to stop emailing the user`,
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := user.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading user: %v", err)
+		}
+		if err := u.Update(func(current *user.User) error { return current.SetEmail(args[1]) }); err != nil {
+			log.Fatalln(err)
+		}
+	},
+}
+
+var unlockUserCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Unlock a user locked after too many failed logins",
+	Long:  `Call with totp-ovpn user unlock [name]`,
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		u, err := user.FromDB(args[0])
+		if err != nil {
+			log.Fatalf("While loading user: %v", err)
+		}
+		if err := u.Update(func(current *user.User) error { current.Unlock(); return nil }); err != nil {
+			log.Fatalf("While saving user: %v", err)
+		}
+	},
+}
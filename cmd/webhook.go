@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"github.com/alowde/totp-ovpn/webhook"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var WebhookURLs []string
+var WebhookSecretFile string
+var WebhookEvents []string
+
+// NotifyWebhook is the deprecated --notify-webhook, which is only accepted by commands that send webhooks.
+var NotifyWebhook string
+
+func addWebhookFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&WebhookURLs, "webhook", nil, "POST signed events as JSON to this URL (repeatable)")
+	cmd.Flags().StringVar(&WebhookSecretFile, "webhook-secret-file", "", "Read the secret webhooks are signed with from this file")
+	cmd.Flags().StringSliceVar(&WebhookEvents, "webhook-event", nil, "Only send events of this type to webhooks (repeatable; default all)")
+	cmd.Flags().DurationVar(&webhook.PollInterval, "webhook-poll-interval", webhook.PollInterval, "How often queued webhook deliveries are checked")
+	cmd.Flags().StringVar(&NotifyWebhook, "notify-webhook", "", "Same as --webhook")
+	_ = cmd.Flags().MarkDeprecated("notify-webhook", "use --webhook with --webhook-secret-file; the URL is sent signed webhook events")
+}
+
+// setWebhookEndpoints configures the endpoints selected by the webhook flags. The deprecated --notify-webhook is
+// treated as another --webhook, since unsigned notifications are no longer sent.
+func setWebhookEndpoints() error {
+	webhook.Endpoints = nil
+	urls := append([]string{}, WebhookURLs...)
+	if NotifyWebhook != "" {
+		urls = append(urls, NotifyWebhook)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	if WebhookSecretFile == "" {
+		return errors.New("--webhook-secret-file is required to sign webhooks")
+	}
+	secret, err := readPasswordFile(WebhookSecretFile)
+	if err != nil {
+		return errors.Wrap(err, "while reading webhook secret")
+	}
+	if secret == "" {
+		return errors.New("webhook secret is empty")
+	}
+	for _, t := range WebhookEvents {
+		if !validWebhookEvent(t) {
+			return errors.Errorf("unknown webhook event %s; expected one of %v", t, webhook.Types)
+		}
+	}
+	if webhook.PollInterval <= 0 {
+		return errors.New("--webhook-poll-interval must be positive")
+	}
+	for _, u := range urls {
+		webhook.Endpoints = append(webhook.Endpoints, webhook.Endpoint{URL: u, Secret: []byte(secret), Events: WebhookEvents})
+	}
+	return nil
+}
+
+func validWebhookEvent(t string) bool {
+	for _, v := range webhook.Types {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
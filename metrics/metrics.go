@@ -0,0 +1,204 @@
+// Package metrics exposes counters and histograms describing authentication, certificate and session activity in the
+// Prometheus text format.
+package metrics
+
+import (
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Sources of authentication attempts.
+const (
+	SourceWeb    = "web"    // the enrollment portal and dashboard
+	SourceAPI    = "api"    // the JSON API
+	SourceAdmin  = "admin"  // the admin console
+	SourceScript = "script" // the OpenVPN auth script, user verify
+)
+
+// Results of authentication attempts.
+const (
+	ResultSuccess         = "success"
+	ResultInvalidPassword = "invalid_password"
+	ResultInvalidCode     = "invalid_code"
+	ResultInvalidLogin    = "invalid_login" // a password and code checked together, as admin logins are
+	ResultLockedOut       = "locked_out"
+	ResultDisabled        = "disabled"
+	ResultUnknownUser     = "unknown_user"
+	ResultNotEnrolled     = "not_enrolled"
+	ResultError           = "error"
+)
+
+const namespace = "totp_ovpn"
+
+// Help text is shared with the counts the auth script keeps in the database, which are reported under the same names.
+const (
+	authAttemptsHelp = "Authentication attempts by source and result."
+	otpFailuresHelp  = "Incorrect TOTP or recovery codes by source."
+	lockoutsHelp     = "Accounts locked after too many failed attempts, by source."
+)
+
+var (
+	AuthAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_attempts_total",
+		Help:      authAttemptsHelp,
+	}, []string{"source", "result"})
+
+	OTPFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "otp_failures_total",
+		Help:      otpFailuresHelp,
+	}, []string{"source"})
+
+	Lockouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "lockouts_total",
+		Help:      lockoutsHelp,
+	}, []string{"source"})
+
+	CertificatesIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "certificates_issued_total",
+		Help:      "Client certificates signed and recorded by the portal. Certificates issued from the command line aren't counted.",
+	})
+
+	CertificatesRevoked = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "certificates_revoked_total",
+		Help:      "Client certificates revoked through the portal, admin console or API. Revocations from the command line aren't counted.",
+	})
+
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to handle portal requests, by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "method", "code"})
+)
+
+// Registry holds every metric exposed by Handler.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		AuthAttempts,
+		OTPFailures,
+		Lockouts,
+		CertificatesIssued,
+		CertificatesRevoked,
+		RequestDuration,
+	)
+}
+
+// Handler serves the metrics in Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// CountAuth counts an authentication attempt, and the incorrect code or lockout it resulted in if any.
+func CountAuth(source, result string, lockedOut bool) {
+	AuthAttempts.WithLabelValues(source, result).Inc()
+	if result == ResultInvalidCode {
+		OTPFailures.WithLabelValues(source).Inc()
+	}
+	if lockedOut {
+		Lockouts.WithLabelValues(source).Inc()
+	}
+}
+
+// sessionCollector reports the counters of a session table.
+type sessionCollector struct {
+	st                                          *session.SessionTable
+	active, created, expired, rejected, revoked *prometheus.Desc
+}
+
+// RegisterSessions adds the counters of a session table to Registry, labelled with the table's name. It replaces any
+// table registered under the same name.
+func RegisterSessions(name string, st *session.SessionTable) error {
+	labels := prometheus.Labels{"table": name}
+	desc := func(metric, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "sessions", metric), help, nil, labels)
+	}
+	c := &sessionCollector{
+		st:       st,
+		active:   desc("active", "Sessions currently held, where the session store can count them."),
+		created:  desc("created_total", "Sessions started."),
+		expired:  desc("expired_total", "Sessions removed after expiring."),
+		rejected: desc("rejected_total", "Session cookies rejected as invalid or expired."),
+		revoked:  desc("revoked_total", "Sessions ended by logout or a credential change."),
+	}
+	if err := Registry.Register(c); err != nil {
+		existing, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return err
+		}
+		Registry.Unregister(existing.ExistingCollector)
+		return Registry.Register(c)
+	}
+	return nil
+}
+
+func (c *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.active
+	ch <- c.created
+	ch <- c.expired
+	ch <- c.rejected
+	ch <- c.revoked
+}
+
+func (c *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.st.Stats()
+	// Sealed sessions live only in cookies, so there's nothing to count
+	if s.Active >= 0 {
+		ch <- prometheus.MustNewConstMetric(c.active, prometheus.GaugeValue, float64(s.Active))
+	}
+	ch <- prometheus.MustNewConstMetric(c.created, prometheus.CounterValue, float64(s.Created))
+	ch <- prometheus.MustNewConstMetric(c.expired, prometheus.CounterValue, float64(s.Expired))
+	ch <- prometheus.MustNewConstMetric(c.rejected, prometheus.CounterValue, float64(s.Rejected))
+	ch <- prometheus.MustNewConstMetric(c.revoked, prometheus.CounterValue, float64(s.Revoked))
+}
+
+// Instrument records how long h takes to handle each request in RequestDuration. Requests are labelled with the
+// pattern of the route that handled them, which keeps the number of label values small whatever paths clients ask for.
+func Instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		RequestDuration.WithLabelValues(route, method(r), strconv.Itoa(sw.status)).Observe(time.Since(start).Seconds())
+	})
+}
+
+// method returns a request's method for use as a label, lumping together any that the portal never handles.
+func method(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions:
+		return r.Method
+	}
+	return "other"
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCountAuth(t *testing.T) {
+	before := testutil.ToFloat64(OTPFailures.WithLabelValues(SourceWeb))
+	CountAuth(SourceWeb, ResultInvalidCode, true)
+	CountAuth(SourceWeb, ResultSuccess, false)
+
+	if got := testutil.ToFloat64(OTPFailures.WithLabelValues(SourceWeb)) - before; got != 1 {
+		t.Errorf("Invalid code counted as %v OTP failures, expected 1", got)
+	}
+	if got := testutil.ToFloat64(Lockouts.WithLabelValues(SourceWeb)); got < 1 {
+		t.Errorf("Lockout wasn't counted")
+	}
+	if got := testutil.ToFloat64(AuthAttempts.WithLabelValues(SourceWeb, ResultSuccess)); got < 1 {
+		t.Errorf("Successful attempt wasn't counted")
+	}
+}
+
+func TestInstrument(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := Instrument(mux)
+	for _, path := range []string{"/users/alice", "/users/bob", "/elsewhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/elsewhere", nil))
+
+	for _, c := range []struct {
+		handler, method, code string
+		count                 uint64
+	}{
+		{"GET /users/{name}", "GET", "418", 2},
+		{"unmatched", "GET", "404", 1},
+		{"unmatched", "other", "404", 1},
+	} {
+		if got := requestCount(t, c.handler, c.method, c.code); got != c.count {
+			t.Errorf("Recorded %d requests to %s %s with status %s, expected %d", got, c.method, c.handler, c.code, c.count)
+		}
+	}
+	if n := testutil.CollectAndCount(RequestDuration); n != 3 {
+		t.Errorf("Requests recorded under %d label sets, expected 3", n)
+	}
+}
+
+// requestCount returns the number of requests recorded in RequestDuration with the given labels.
+func requestCount(t *testing.T, handler, method, code string) uint64 {
+	families, err := Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"handler": handler, "method": method, "code": code}
+	for _, f := range families {
+		if f.GetName() != "totp_ovpn_http_request_duration_seconds" {
+			continue
+		}
+	metrics:
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if want[l.GetName()] != l.GetValue() {
+					continue metrics
+				}
+			}
+			return m.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
+
+func TestRegisterSessions(t *testing.T) {
+	st := session.NewSessionTable(0)
+	if _, _, err := st.Add("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterSessions("portal", st); err != nil {
+		t.Fatalf("Failed to register session table with error %s", err)
+	}
+	// Registering a new table under the same name replaces the old one, as happens when the server restarts
+	st = session.NewSessionTable(0)
+	if err := RegisterSessions("portal", st); err != nil {
+		t.Fatalf("Failed to replace session table with error %s", err)
+	}
+	if _, _, err := st.Add("bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+		# HELP totp_ovpn_sessions_created_total Sessions started.
+		# TYPE totp_ovpn_sessions_created_total counter
+		totp_ovpn_sessions_created_total{table="portal"} 1
+	`
+	if err := testutil.GatherAndCompare(Registry, strings.NewReader(expected), "totp_ovpn_sessions_created_total"); err != nil {
+		t.Error(err)
+	}
+}
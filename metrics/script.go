@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"strings"
+	"sync"
+)
+
+// The auth script runs in a new process for every VPN login, so rather than keeping its counts in memory it adds them
+// to the database, where the server reads them back for each scrape.
+
+const scriptNode = "metrics"
+
+// scriptCount is a count kept in the database. Key is the metric's name, followed by a result for auth attempts.
+type scriptCount struct {
+	Key   string `storm:"id"`
+	Count uint64
+}
+
+const (
+	keyAuthAttempts = "auth_attempts/"
+	keyOTPFailures  = "otp_failures"
+	keyLockouts     = "lockouts"
+)
+
+// CountScriptAuth is CountAuth for the auth script, counting the attempt in the database.
+func CountScriptAuth(result string, lockedOut bool) error {
+	keys := []string{keyAuthAttempts + result}
+	if result == ResultInvalidCode {
+		keys = append(keys, keyOTPFailures)
+	}
+	if lockedOut {
+		keys = append(keys, keyLockouts)
+	}
+
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.From(scriptNode).Begin(true)
+	if err != nil {
+		return errors.Wrap(err, "while starting transaction")
+	}
+	defer tx.Rollback()
+	for _, k := range keys {
+		c := scriptCount{Key: k}
+		if err := tx.One("Key", k, &c); err != nil && err != storm.ErrNotFound {
+			return errors.Wrap(err, "while querying DB for auth script counts")
+		}
+		c.Count++
+		if err := tx.Save(&c); err != nil {
+			return errors.Wrap(err, "while saving auth script counts")
+		}
+	}
+	return tx.Commit()
+}
+
+var (
+	scriptAuthAttempts = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "auth_attempts_total"),
+		authAttemptsHelp, []string{"source", "result"}, nil)
+	scriptOTPFailures = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "otp_failures_total"),
+		otpFailuresHelp, []string{"source"}, nil)
+	scriptLockouts = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "lockouts_total"),
+		lockoutsHelp, []string{"source"}, nil)
+)
+
+// scriptCollector reports the counts kept by the auth script under the same names as the server's own counts, with
+// the source label set to script. It's unchecked, since its metrics share their names with other collectors'.
+type scriptCollector struct{}
+
+var registerScript sync.Once
+
+// RegisterScriptCounts adds the counts kept in the database by the auth script to Registry, if they haven't been
+// already.
+func RegisterScriptCounts() (err error) {
+	registerScript.Do(func() { err = Registry.Register(scriptCollector{}) })
+	return
+}
+
+func (scriptCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (scriptCollector) Collect(ch chan<- prometheus.Metric) {
+	counts, err := scriptCounts()
+	if err != nil {
+		log.Printf("While reading auth script counts: %s", err)
+		return
+	}
+	for _, c := range counts {
+		var m prometheus.Metric
+		switch {
+		case strings.HasPrefix(c.Key, keyAuthAttempts):
+			m, err = prometheus.NewConstMetric(scriptAuthAttempts, prometheus.CounterValue, float64(c.Count),
+				SourceScript, strings.TrimPrefix(c.Key, keyAuthAttempts))
+		case c.Key == keyOTPFailures:
+			m, err = prometheus.NewConstMetric(scriptOTPFailures, prometheus.CounterValue, float64(c.Count), SourceScript)
+		case c.Key == keyLockouts:
+			m, err = prometheus.NewConstMetric(scriptLockouts, prometheus.CounterValue, float64(c.Count), SourceScript)
+		default:
+			continue
+		}
+		if err == nil {
+			ch <- m
+		}
+	}
+}
+
+func scriptCounts() ([]scriptCount, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var counts []scriptCount
+	if err := db.From(scriptNode).All(&counts); err != nil && err != storm.ErrNotFound {
+		return nil, errors.Wrap(err, "while querying DB for auth script counts")
+	}
+	return counts, nil
+}
@@ -0,0 +1,174 @@
+package notify
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"github.com/pkg/errors"
+	htmltemplate "html/template"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+//go:embed templates/*.txt templates/*.html
+var defaultTemplates embed.FS
+
+// Templates build the plain text and HTML parts of emails. Each kind of message has a kind.txt template, which also
+// defines the subject as a "subject" template, and a kind.html template defining the "content" of the shared HTML
+// layout. Messages without a template of their own use message.txt and message.html, which show the message's Subject
+// and Body. Values missing from a message's Data are shown as empty strings.
+type Templates struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+var builtinTemplates = mustParseTemplates()
+
+func mustParseTemplates() *Templates {
+	t, err := LoadTemplates("")
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// LoadTemplates parses the built-in templates, replacing any with templates of the same name in dir if it isn't empty.
+func LoadTemplates(dir string) (*Templates, error) {
+	builtin, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		return nil, err
+	}
+	sources := []fs.FS{builtin}
+	if dir != "" {
+		sources = append(sources, os.DirFS(dir))
+	}
+
+	files := make(map[string][]byte)
+	for _, source := range sources {
+		for _, pattern := range []string{"*.txt", "*.html"} {
+			matches, err := fs.Glob(source, pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range matches {
+				if files[m], err = fs.ReadFile(source, m); err != nil {
+					return nil, errors.Wrapf(err, "while reading template %s", m)
+				}
+			}
+		}
+	}
+
+	layout, err := htmltemplate.New("_layout.html").Option("missingkey=zero").Parse(string(files["_layout.html"]))
+	if err != nil {
+		return nil, errors.Wrap(err, "while parsing template _layout.html")
+	}
+	if layout.Lookup("layout") == nil {
+		return nil, errors.New("no layout template defined")
+	}
+
+	t := &Templates{text: make(map[string]*texttemplate.Template), html: make(map[string]*htmltemplate.Template)}
+	for name, text := range files {
+		switch {
+		case strings.HasPrefix(name, "_"):
+		case strings.HasSuffix(name, ".txt"):
+			tt, err := texttemplate.New(name).Option("missingkey=zero").Parse(string(text))
+			if err != nil {
+				return nil, errors.Wrapf(err, "while parsing template %s", name)
+			}
+			if tt.Lookup("subject") == nil {
+				return nil, errors.Errorf("template %s doesn't define subject", name)
+			}
+			t.text[strings.TrimSuffix(name, ".txt")] = tt
+		default:
+			ht, err := layout.Clone()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := ht.New(name).Parse(string(text)); err != nil {
+				return nil, errors.Wrapf(err, "while parsing template %s", name)
+			}
+			if ht.Lookup("content") == nil || ht.Lookup("subject") == nil {
+				return nil, errors.Errorf("template %s doesn't define content and subject", name)
+			}
+			t.html[strings.TrimSuffix(name, ".html")] = ht
+		}
+	}
+	for kind := range t.text {
+		if t.html[kind] == nil {
+			return nil, errors.Errorf("template %s.txt has no matching %s.html", kind, kind)
+		}
+	}
+	if t.text["message"] == nil {
+		return nil, errors.New("no message template defined")
+	}
+	return t, nil
+}
+
+// render returns the subject, plain text and HTML body of an email for m.
+func (t *Templates) render(m Message) (subject, text, html string, err error) {
+	kind := m.Kind
+	if t.text[kind] == nil {
+		kind = "message"
+	}
+	var buf bytes.Buffer
+	if err := t.text[kind].ExecuteTemplate(&buf, "subject", m); err != nil {
+		return "", "", "", errors.Wrapf(err, "while rendering %s subject", kind)
+	}
+	subject = strings.TrimSpace(buf.String())
+	buf.Reset()
+	if err := t.text[kind].Execute(&buf, m); err != nil {
+		return "", "", "", errors.Wrapf(err, "while rendering %s email", kind)
+	}
+	text = buf.String()
+	buf.Reset()
+	if err := t.html[kind].ExecuteTemplate(&buf, "layout", m); err != nil {
+		return "", "", "", errors.Wrapf(err, "while rendering %s email", kind)
+	}
+	return subject, text, buf.String(), nil
+}
+
+// compose builds a multipart/alternative email holding the plain text and HTML bodies.
+func compose(from, to, subject, text, html string) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", text},
+		{"text/html; charset=utf-8", html},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n", mw.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	_, _ = body.WriteTo(&msg)
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,53 @@
+package notify
+
+import "log"
+
+// Kinds of message, selecting the template used to email them.
+const (
+	KindInvitation = "invitation"
+	KindEnrolled   = "enrolled"
+	KindExpiry     = "expiry"
+	KindLockout    = "lockout"
+)
+
+// Message is a notification addressed to a single user. Subject and Body are a plain summary used by every notifier,
+// while emails are built from the template for Kind, which can also use the values in Data. Data isn't sent by other
+// notifiers, since it can hold secrets such as an invited user's initial password.
+type Message struct {
+	Username string            `json:"username"`
+	Email    string            `json:"email,omitempty"`
+	Kind     string            `json:"kind,omitempty"`
+	Subject  string            `json:"subject"`
+	Body     string            `json:"body"`
+	Data     map[string]string `json:"-"`
+}
+
+// Notifier delivers a Message to a user or on their behalf.
+type Notifier interface {
+	Notify(m Message) error
+}
+
+// Log writes notifications to a logger. It's mostly useful when nothing else is configured, so that notifications at
+// least show up in the server output.
+type Log struct {
+	Logger *log.Logger
+}
+
+func (l Log) Notify(m Message) error {
+	logger := l.Logger
+	if logger == nil {
+		logger = log.New(log.Writer(), "", log.LstdFlags)
+	}
+	logger.Printf("notification for %s: %s", m.Username, m.Subject)
+	return nil
+}
+
+// All sends a message through every notifier, returning the first error encountered after trying them all.
+func All(notifiers []Notifier, m Message) (err error) {
+	for _, n := range notifiers {
+		if e := n.Notify(m); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
@@ -0,0 +1,133 @@
+package notify
+
+import (
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Ways of securing the connection to the mail server.
+const (
+	TLSOpportunistic = ""         // use STARTTLS if the server offers it
+	TLSStartTLS      = "starttls" // refuse to send unless the server offers STARTTLS
+	TLSImplicit      = "tls"      // connect over TLS, usually to port 465
+)
+
+// SMTPTimeout limits how long sending a single email can take.
+var SMTPTimeout = 30 * time.Second
+
+// SMTP emails notifications. Messages are sent to the user's Email if it's set. Otherwise usernames that look like an
+// email address are used as is, or the username is combined with Domain to build the recipient address.
+type SMTP struct {
+	Addr      string // host:port of the mail server
+	From      string
+	Domain    string
+	Auth      smtp.Auth
+	TLS       string      // one of the TLS constants
+	TLSConfig *tls.Config // used to verify the server, which is checked against the system roots if nil
+	Templates *Templates  // the built-in templates are used if nil
+}
+
+func (s SMTP) Notify(m Message) error {
+	to := m.Email
+	if to == "" {
+		to = m.Username
+		if !strings.Contains(to, "@") {
+			if s.Domain == "" {
+				return errors.Errorf("no email address known for %s", m.Username)
+			}
+			to = to + "@" + s.Domain
+		}
+	}
+
+	templates := s.Templates
+	if templates == nil {
+		templates = builtinTemplates
+	}
+	subject, text, html, err := templates.render(m)
+	if err != nil {
+		return err
+	}
+	msg, err := compose(s.From, to, subject, text, html)
+	if err != nil {
+		return errors.Wrap(err, "while composing email")
+	}
+	if err := s.send(to, msg); err != nil {
+		return errors.Wrap(err, "while sending email")
+	}
+	return nil
+}
+
+// send delivers msg to a single recipient. It's smtp.SendMail, but with a choice of TLS modes and a timeout.
+func (s SMTP) send(to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	dialer := &net.Dialer{Timeout: SMTPTimeout}
+	var conn net.Conn
+	switch s.TLS {
+	case TLSImplicit:
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.Addr, config)
+	case TLSOpportunistic, TLSStartTLS:
+		conn, err = dialer.Dial("tcp", s.Addr)
+	default:
+		return errors.Errorf("unknown TLS mode %s", s.TLS)
+	}
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(SMTPTimeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if s.TLS != TLSImplicit {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(config); err != nil {
+				return err
+			}
+		} else if s.TLS == TLSStartTLS {
+			return errors.Errorf("%s doesn't support STARTTLS", s.Addr)
+		}
+	}
+	if s.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.Errorf("%s doesn't support authentication", s.Addr)
+		}
+		if err := c.Auth(s.Auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
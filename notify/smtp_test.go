@@ -0,0 +1,319 @@
+package notify
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTLS returns a server configuration with a certificate for 127.0.0.1, and a client configuration trusting it.
+func testTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mail"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(crt)
+	server := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	return server, &tls.Config{RootCAs: roots}
+}
+
+// received is an email accepted by mailServer.
+type received struct {
+	from, to string
+	auth     string // the decoded AUTH PLAIN response, if the client authenticated
+	secure   bool   // whether the email was sent over TLS
+	data     string
+}
+
+// mailServer is an in-process stand-in for a mail server, supporting just enough SMTP for net/smtp's client.
+type mailServer struct {
+	l        net.Listener
+	tls      *tls.Config
+	implicit bool // TLS from the start rather than by STARTTLS
+	startTLS bool // offer STARTTLS
+
+	mutex sync.Mutex
+	mails []received
+}
+
+func newMailServer(t *testing.T, serverTLS *tls.Config, implicit, startTLS bool) *mailServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mailServer{l: l, tls: serverTLS, implicit: implicit, startTLS: startTLS}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return s
+}
+
+func (s *mailServer) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+	secure := false
+	if s.implicit {
+		conn, secure = tls.Server(conn, s.tls), true
+	}
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ESMTP")
+
+	var msg received
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250-localhost")
+			if s.startTLS && !secure {
+				_ = tp.PrintfLine("250-STARTTLS")
+			}
+			_ = tp.PrintfLine("250 AUTH PLAIN")
+		case "STARTTLS":
+			_ = tp.PrintfLine("220 Ready to start TLS")
+			conn, secure = tls.Server(conn, s.tls), true
+			tp = textproto.NewConn(conn)
+		case "AUTH":
+			_, response, _ := strings.Cut(arg, " ")
+			decoded, _ := base64.StdEncoding.DecodeString(response)
+			msg.auth = string(decoded)
+			_ = tp.PrintfLine("235 Authenticated")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(arg, "FROM:"), "<>")
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = strings.Trim(strings.TrimPrefix(arg, "TO:"), "<>")
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data, msg.secure = string(data), secure
+			s.mutex.Lock()
+			s.mails = append(s.mails, msg)
+			s.mutex.Unlock()
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 Bye")
+			return
+		default:
+			_ = tp.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *mailServer) received() []received {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]received(nil), s.mails...)
+}
+
+// parts returns the decoded subject and the text and HTML bodies of an email.
+func parts(t *testing.T, data string) (string, string, string) {
+	msg, err := mail.ReadMessage(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Email has content type %s", msg.Header.Get("Content-Type"))
+	}
+	bodies := make(map[string]string)
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		b, err := ioutil.ReadAll(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		bodies[contentType] = string(b)
+	}
+	return subject, bodies["text/plain"], bodies["text/html"]
+}
+
+func invitation() Message {
+	return Message{
+		Username: "alice",
+		Email:    "alice@example.com",
+		Kind:     KindInvitation,
+		Subject:  "Invited",
+		Body:     "An account has been created",
+		Data:     map[string]string{"Password": "s3cret<>", "PortalURL": "https://vpn.example.com/"},
+	}
+}
+
+func TestSMTP(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	tests := []struct {
+		name       string
+		implicit   bool
+		offerTLS   bool
+		mode       string
+		wantSecure bool
+		wantErr    bool
+	}{
+		{"starttls", false, true, TLSStartTLS, true, false},
+		{"implicit tls", true, false, TLSImplicit, true, false},
+		{"opportunistic with starttls", false, true, TLSOpportunistic, true, false},
+		{"opportunistic without starttls", false, false, TLSOpportunistic, false, false},
+		{"starttls not offered", false, false, TLSStartTLS, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newMailServer(t, serverTLS, tt.implicit, tt.offerTLS)
+			s := SMTP{
+				Addr:      server.l.Addr().String(),
+				From:      "vpn@example.com",
+				Auth:      smtp.PlainAuth("", "vpn", "password", "127.0.0.1"),
+				TLS:       tt.mode,
+				TLSConfig: clientTLS,
+			}
+			err := s.Notify(invitation())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			mails := server.received()
+			if tt.wantErr {
+				if len(mails) != 0 {
+					t.Errorf("Email was sent without STARTTLS")
+				}
+				return
+			}
+			if len(mails) != 1 {
+				t.Fatalf("Server received %d emails, want 1", len(mails))
+			}
+			m := mails[0]
+			if m.from != s.From || m.to != "alice@example.com" || m.secure != tt.wantSecure {
+				t.Errorf("Email from %s to %s, secure %t", m.from, m.to, m.secure)
+			}
+			if m.auth != "\x00vpn\x00password" {
+				t.Errorf("Client authenticated with %q", m.auth)
+			}
+		})
+	}
+}
+
+func TestSMTPBodies(t *testing.T) {
+	server := newMailServer(t, nil, false, false)
+	s := SMTP{Addr: server.l.Addr().String(), From: "vpn@example.com", Domain: "example.com"}
+
+	m := invitation()
+	if err := s.Notify(m); err != nil {
+		t.Fatal(err)
+	}
+	m.Email, m.Kind = "", ""
+	if err := s.Notify(m); err != nil {
+		t.Fatal(err)
+	}
+	mails := server.received()
+	if len(mails) != 2 {
+		t.Fatalf("Server received %d emails, want 2", len(mails))
+	}
+
+	subject, text, html := parts(t, mails[0].data)
+	if subject != "You've been invited to the VPN" {
+		t.Errorf("Invitation has subject %q", subject)
+	}
+	for _, want := range []string{"alice", "s3cret<>", "https://vpn.example.com/"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Text body doesn't contain %q:\n%s", want, text)
+		}
+	}
+	if !strings.Contains(html, "s3cret&lt;&gt;") || !strings.Contains(html, `href="https://vpn.example.com/"`) {
+		t.Errorf("HTML body doesn't contain the escaped password and portal link:\n%s", html)
+	}
+
+	// Messages without a template of their own are sent with their subject and body, to the username at Domain
+	subject, text, _ = parts(t, mails[1].data)
+	if mails[1].to != "alice@example.com" || subject != m.Subject || !strings.Contains(text, m.Body) {
+		t.Errorf("Untemplated message sent to %s as %q:\n%s", mails[1].to, subject, text)
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	dir := t.TempDir()
+	override := `{{define "subject"}}Welcome {{.Username}}{{end}}Your password is {{.Data.Password}}{{.Data.Missing}}`
+	if err := os.WriteFile(filepath.Join(dir, "invitation.txt"), []byte(override), 0600); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, text, html, err := templates.render(invitation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Welcome alice" || text != "Your password is s3cret<>" {
+		t.Errorf("Override rendered %q, %q", subject, text)
+	}
+	if !strings.Contains(html, "s3cret&lt;&gt;") {
+		t.Errorf("Built-in HTML template wasn't kept")
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "welcome.txt"), []byte(override), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTemplates(dir); err == nil {
+		t.Errorf("Text template without an HTML template was accepted")
+	}
+
+	for _, kind := range []string{KindInvitation, KindEnrolled, KindExpiry, KindLockout} {
+		if _, _, _, err := builtinTemplates.render(Message{Username: "alice", Kind: kind}); err != nil {
+			t.Errorf("Built-in %s template failed: %s", kind, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"io/ioutil"
+	"net/http"
+)
+
+// ACMEDomains are the names to request a portal certificate for from an ACME directory. If any are set the
+// certificate is obtained and renewed automatically, and CertPath and KeyPath are ignored.
+var ACMEDomains []string
+
+// ACMEDirectoryURL is the ACME directory certificates are requested from.
+var ACMEDirectoryURL = autocert.DefaultACMEDirectory
+
+// ACMEEmail is the contact address registered with the ACME account, used by the CA for expiry and problem notices.
+var ACMEEmail string
+
+// ACMERootCAPath optionally points to a CA certificate to trust when connecting to the ACME directory, as needed for a
+// private or test directory such as Pebble.
+var ACMERootCAPath string
+
+func acmeEnabled() bool {
+	return len(ACMEDomains) > 0
+}
+
+// acmeEntry is an item stored by the ACME certificate manager, such as the account key or a certificate and its key.
+type acmeEntry struct {
+	Name string `storm:"id"`
+	Data []byte
+}
+
+// acmeCache implements autocert.Cache in the database, so that certificates survive a restart and are shared with
+// anything else reading the same database.
+type acmeCache struct{}
+
+func (acmeCache) Get(ctx context.Context, name string) ([]byte, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var e acmeEntry
+	if err := db.From("acme").One("Name", name, &e); err != nil {
+		if err == storm.ErrNotFound {
+			return nil, autocert.ErrCacheMiss
+		}
+		return nil, errors.Wrap(err, "while reading ACME cache")
+	}
+	return e.Data, nil
+}
+
+func (acmeCache) Put(ctx context.Context, name string, data []byte) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.From("acme").Save(&acmeEntry{name, data}); err != nil {
+		return errors.Wrap(err, "while writing ACME cache")
+	}
+	return nil
+}
+
+func (acmeCache) Delete(ctx context.Context, name string) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.From("acme").DeleteStruct(&acmeEntry{Name: name}); err != nil && err != storm.ErrNotFound {
+		return errors.Wrap(err, "while deleting from ACME cache")
+	}
+	return nil
+}
+
+// newACMEManager returns a certificate manager for ACMEDomains. It answers TLS-ALPN-01 challenges through its
+// GetCertificate callback, and HTTP-01 challenges through the handler returned by its HTTPHandler method.
+func newACMEManager() (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: ACMEDirectoryURL}
+	if ACMERootCAPath != "" {
+		raw, err := ioutil.ReadFile(ACMERootCAPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading ACME root CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, errors.New("no certificates found in ACME root CA")
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      acmeCache{},
+		HostPolicy: autocert.HostWhitelist(ACMEDomains...),
+		Client:     client,
+		Email:      ACMEEmail,
+	}, nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestACMEManager(t *testing.T) {
+	oldDomains, oldDirectory, oldRoot := ACMEDomains, ACMEDirectoryURL, ACMERootCAPath
+	defer func() { ACMEDomains, ACMEDirectoryURL, ACMERootCAPath = oldDomains, oldDirectory, oldRoot }()
+
+	ACMEDomains = []string{"vpn.example.com"}
+	ACMEDirectoryURL = "https://localhost:14000/dir"
+	ACMERootCAPath, _ = writeTestCertificate(t, t.TempDir())
+	m, err := newACMEManager()
+	if err != nil {
+		t.Fatalf("Failed to create ACME manager with error %s", err)
+	}
+	if m.Client.DirectoryURL != ACMEDirectoryURL {
+		t.Errorf("ACME client uses directory %s, expected %s", m.Client.DirectoryURL, ACMEDirectoryURL)
+	}
+	if m.Client.HTTPClient == nil {
+		t.Errorf("ACME client doesn't trust the configured root CA")
+	}
+	if err := m.HostPolicy(context.Background(), "vpn.example.com"); err != nil {
+		t.Errorf("Configured domain was rejected with error %s", err)
+	}
+	if err := m.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Errorf("Unconfigured domain was accepted")
+	}
+
+	// The redirector answers challenges for configured domains only, and still redirects everything else
+	h := m.HTTPHandler(http.HandlerFunc(redirectTLS))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "http://other.example.com/.well-known/acme-challenge/token", nil)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Challenge for unconfigured domain returned status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("GET", "http://vpn.example.com/login", nil)
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://vpn.example.com/login" {
+		t.Errorf("Plain request wasn't redirected, got status %d to %s", w.Code, w.Header().Get("Location"))
+	}
+
+	ACMERootCAPath = "/nonexistent"
+	if _, err := newACMEManager(); err == nil {
+		t.Errorf("Missing ACME root CA was accepted")
+	}
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/admin"
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/metrics"
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminCookieName holds the admin console session, which is kept apart from any portal session the same browser has.
+const adminCookieName = "totp-ovpn-admin"
+
+var adminSessions *session.SessionTable
+
+// AuditViewLimit is how many audit events the admin console and admin API return at once.
+var AuditViewLimit = 200
+
+// adminHandler returns the handler for the admin console, mounted at /admin/.
+func adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	protect := func(h http.HandlerFunc) http.Handler {
+		return csrfProtectWith(adminSessionFromRequest, h)
+	}
+	mux.Handle("/admin/login", rateLimit(protect(adminLogin)))
+	mux.Handle("POST /admin/logout", protect(adminLogout))
+	mux.Handle("GET /admin/{$}", protect(requireAdminSession(adminUsers)))
+	mux.Handle("POST /admin/users", protect(requireAdminSession(adminInvite)))
+	mux.Handle("POST /admin/users/{name}/{action}", protect(requireAdminSession(adminUserAction)))
+	mux.Handle("GET /admin/certificates", protect(requireAdminSession(adminCertificates)))
+	mux.Handle("POST /admin/certificates/{serial}/revoke", protect(requireAdminSession(adminRevoke)))
+	mux.Handle("GET /admin/audit", protect(requireAdminSession(adminAudit)))
+	return mux
+}
+
+func setAdminCookie(w http.ResponseWriter, r *http.Request, key string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminCookieName,
+		Value:    key,
+		Path:     "/admin",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   requestSecure(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// adminSessionFromRequest returns the admin session belonging to a request's admin cookie.
+func adminSessionFromRequest(r *http.Request) (*session.Session, bool) {
+	c, err := r.Cookie(adminCookieName)
+	if err != nil {
+		return nil, false
+	}
+	s, ok := adminSessions.Get(c.Value)
+	if !ok || s.Step != session.StepAdmin {
+		return nil, false
+	}
+	return s, true
+}
+
+// currentAdmin is currentSession for the admin console.
+func currentAdmin(r *http.Request) (*session.Session, *admin.Account, bool) {
+	s, ok := adminSessionFromRequest(r)
+	if !ok || !bindingMatches(s, r) {
+		return nil, nil, false
+	}
+	a, err := admin.FromDB(s.User)
+	if err != nil || s.Created.Before(a.SessionsNotBefore) {
+		return nil, nil, false
+	}
+	return s, a, true
+}
+
+// requireAdminSession sends requests without a valid admin session to the login page.
+func requireAdminSession(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := currentAdmin(r); !ok {
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminLogin checks an admin's password and TOTP code and starts an admin session.
+func adminLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		_ = renderPageAdminLogin(w, r, "", csrfToken(r))
+		return
+	}
+
+	name := r.PostFormValue("username")
+	a, err := admin.FromDB(name)
+	if err != nil {
+		if _, ok := errors.Cause(err).(admin.ErrAccountNotFound); ok {
+			countAuth(r, nil, name, metrics.ResultUnknownUser)
+			auditAdmin(r, name, "admin.login", "", audit.Failure, "unknown admin")
+		} else {
+			countAuth(r, nil, name, metrics.ResultError)
+			auditAdmin(r, name, "admin.login", "", audit.Error, err.Error())
+		}
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageAdminLogin(w, r, T(requestLanguage(r), "error.login"), csrfToken(r))
+		return
+	}
+	ok, err := a.Authenticate(r.PostFormValue("password"), r.PostFormValue("code"))
+	switch {
+	case ok:
+		countAuth(r, a, a.Username, metrics.ResultSuccess)
+	case err == user.ErrLockedOut:
+		countAuth(r, a, a.Username, metrics.ResultLockedOut)
+	case err != nil:
+		countAuth(r, a, a.Username, metrics.ResultError)
+	default:
+		countAuth(r, a, a.Username, metrics.ResultInvalidLogin)
+	}
+	if err == user.ErrLockedOut {
+		auditAdmin(r, a.Username, "admin.login", "", audit.Failure, refusal(err))
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageAdminLogin(w, r, T(requestLanguage(r), "error.locked_out"), csrfToken(r))
+		return
+	}
+	switch {
+	case err != nil:
+		auditAdmin(r, a.Username, "admin.login", "", audit.Error, err.Error())
+	case !ok:
+		auditAdmin(r, a.Username, "admin.login", "", audit.Failure, "invalid credentials")
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageAdminLogin(w, r, T(requestLanguage(r), "error.login"), csrfToken(r))
+		return
+	}
+
+	if old, ok := adminSessionFromRequest(r); ok {
+		_ = adminSessions.Revoke(old.ID)
+	}
+	s, _, err := adminSessions.Add(a.Username)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.Step = session.StepAdmin
+	bindSession(s, r)
+	key, err := adminSessions.Save(s)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setAdminCookie(w, r, key, int(adminSessions.SessionTime()/time.Second))
+	auditAdmin(r, a.Username, "admin.login", "", audit.Success, "")
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+func adminLogout(w http.ResponseWriter, r *http.Request) {
+	if s, ok := adminSessionFromRequest(r); ok {
+		if err := adminSessions.Revoke(s.ID); err != nil {
+			auditAdmin(r, s.User, "admin.logout", "", audit.Error, err.Error())
+		} else {
+			auditAdmin(r, s.User, "admin.logout", "", audit.Success, "")
+		}
+	}
+	setAdminCookie(w, r, "", -1)
+	http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+}
+
+// adminName returns the name of the admin whose session a request belongs to, for auditing their actions.
+func adminName(r *http.Request) string {
+	if s, ok := adminSessionFromRequest(r); ok {
+		return s.User
+	}
+	return ""
+}
+
+// adminUserRow is the view of a user shown in the admin console.
+type adminUserRow struct {
+	Username    string
+	Initialised bool
+	Disabled    bool
+	Locked      bool
+}
+
+func adminUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := user.All()
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	rows := make([]adminUserRow, 0, len(users))
+	for _, u := range users {
+		rows = append(rows, adminUserRow{u.Username, u.Initialised, u.Disabled, u.Locked()})
+	}
+	_ = renderPageAdminUsers(w, r, rows, csrfToken(r))
+}
+
+// adminInvite creates a user with a generated password, which is shown once so that it can be passed on to them, and
+// emailed to them if an address is given.
+func adminInvite(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.PostFormValue("username"))
+	if !cert.ValidName(name) {
+		http.Error(w, "invalid username", http.StatusBadRequest)
+		return
+	}
+	existing, err := user.FromDB(name)
+	if err != nil {
+		if _, ok := errors.Cause(err).(user.ErrUserNotFound); !ok {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+	} else if existing.Initialised {
+		http.Error(w, "user already exists and is initialised", http.StatusConflict)
+		return
+	}
+
+	password := session.NewToken()
+	u := user.New(name, password)
+	if err := u.SetEmail(strings.TrimSpace(r.PostFormValue("email"))); err != nil {
+		http.Error(w, "invalid email address", http.StatusBadRequest)
+		return
+	}
+	if err := u.Save(); err != nil {
+		auditAdmin(r, adminName(r), "admin.user.invite", name, audit.Error, err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	auditAdmin(r, adminName(r), "admin.user.invite", name, audit.Success, "")
+	notifyInBackground(func() error { return NotifyInvited(u, password, Notifiers) })
+	_ = renderPageAdminPassword(w, r, "title.admin_invited", name, password, csrfToken(r))
+}
+
+// adminUserAction applies one of the user management actions offered on the users page.
+func adminUserAction(w http.ResponseWriter, r *http.Request) {
+	u, err := user.FromDB(r.PathValue("name"))
+	if err != nil {
+		http.Error(w, "user not found", http.StatusNotFound)
+		return
+	}
+
+	action := "admin.user." + r.PathValue("action")
+	update := updateUserEndingSessions
+	var change func(*user.User) error
+	switch r.PathValue("action") {
+	case "disable":
+		change = func(current *user.User) error { current.Disable(); return nil }
+	case "enable":
+		change = func(current *user.User) error { current.Disabled = false; return nil }
+		update = (*user.User).Update
+	case "unlock":
+		change = func(current *user.User) error { current.Unlock(); return nil }
+		update = (*user.User).Update
+	case "reset-otp":
+		change = (*user.User).ResetOTP
+	case "reset-password":
+		password := session.NewToken()
+		if err := updateUserEndingSessions(u, func(current *user.User) error { return current.ResetPassword(password) }); err != nil {
+			auditAdmin(r, adminName(r), action, u.Username, audit.Error, err.Error())
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		auditAdmin(r, adminName(r), action, u.Username, audit.Success, "")
+		_ = renderPageAdminPassword(w, r, "title.admin_password_reset", u.Username, password, csrfToken(r))
+		return
+	default:
+		http.Error(w, "unknown action", http.StatusNotFound)
+		return
+	}
+	if err := update(u, change); err != nil {
+		auditAdmin(r, adminName(r), action, u.Username, audit.Error, err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	auditAdmin(r, adminName(r), action, u.Username, audit.Success, "")
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// adminIssuedRow is the view of an issued certificate shown in the admin console.
+type adminIssuedRow struct {
+	Serial   string
+	Username string
+	NotAfter time.Time
+	Revoked  bool
+}
+
+func adminCertificates(w http.ResponseWriter, r *http.Request) {
+	issued, err := cert.ListIssued(r.URL.Query().Get("user"))
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	rows := make([]adminIssuedRow, 0, len(issued))
+	for _, i := range issued {
+		rows = append(rows, adminIssuedRow{i.Serial, i.Username, i.NotAfter, i.Revoked})
+	}
+	_ = renderPageAdminCertificates(w, r, rows, csrfToken(r))
+}
+
+func adminRevoke(w http.ResponseWriter, r *http.Request) {
+	serial := r.PathValue("serial")
+	if err := revokeCertificate(serial); err != nil {
+		if errors.Cause(err) == storm.ErrNotFound {
+			http.Error(w, "certificate not found", http.StatusNotFound)
+			return
+		}
+		auditAdmin(r, adminName(r), "certificate.revoke", "", audit.Error, err.Error())
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	var owner string
+	if i, err := cert.FindIssued(serial); err == nil {
+		owner = i.Username
+	}
+	auditAdmin(r, adminName(r), "certificate.revoke", owner, audit.Success, "serial "+serial)
+	http.Redirect(w, r, "/admin/certificates", http.StatusSeeOther)
+}
+
+// adminAudit shows the most recent audit events, optionally only those concerning the user given by ?user=.
+func adminAudit(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("user")
+	events, err := audit.Recent(username, AuditViewLimit)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	_ = renderPageAdminAudit(w, r, username, events, csrfToken(r))
+}
+
+// updateUserEndingSessions changes a user's credentials or status through Update and ends any portal sessions they hold.
+func updateUserEndingSessions(u *user.User, change func(*user.User) error) error {
+	if err := u.Update(change); err != nil {
+		return err
+	}
+	if err := sessionTable.RevokeAll(u.Username); err != nil {
+		log.Printf("While revoking sessions for %s: %s", u.Username, err)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/metrics"
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/pkg/errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiSessionHeader carries a fresh session token whenever the token changes, which happens on every save when sessions
+// are sealed. API clients should always use the most recent token they were sent.
+const apiSessionHeader = "X-Session-Token"
+
+// apiHandler returns the handler for the versioned JSON API, mounted at /api/v1/. API clients identify their session
+// with a bearer token rather than a cookie, so API requests aren't subject to CSRF checks.
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("POST /api/v1/enroll", rateLimit(http.HandlerFunc(apiEnroll)))
+	mux.HandleFunc("GET /api/v1/enroll/otpauth", apiOTPAuth)
+	mux.Handle("POST /api/v1/enroll/verify", rateLimit(http.HandlerFunc(apiVerify)))
+	mux.Handle("POST /api/v1/reauth", rateLimit(http.HandlerFunc(apiReauthenticate)))
+	mux.HandleFunc("GET /api/v1/certificate", apiCertificate)
+	mux.HandleFunc("GET /api/v1/profile", apiProfile)
+	addAdminRoutes(mux)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func apiError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+}
+
+// readJSON decodes a request body of at most MaxCSRSize bytes into v.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxCSRSize)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid request body")
+		return false
+	}
+	return true
+}
+
+// bearerToken returns the token from a request's Authorization header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+}
+
+// apiSession is currentSession for API requests, taking the session token from the Authorization header.
+func apiSession(w http.ResponseWriter, r *http.Request) (*session.Session, *user.User, bool) {
+	s, ok := sessionTable.Get(bearerToken(r))
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "session invalid or expired")
+		return nil, nil, false
+	}
+	u, ok := checkSession(s, r)
+	if !ok {
+		apiError(w, http.StatusUnauthorized, "session invalid or expired")
+		return nil, nil, false
+	}
+
+	if SlidingSessions {
+		key, err := sessionTable.Refresh(s)
+		if err != nil {
+			log.Printf("While refreshing session for %s: %s", s.User, err)
+		} else {
+			w.Header().Set(apiSessionHeader, key)
+		}
+	}
+	return s, u, true
+}
+
+// apiSaveSession is saveSession for API requests.
+func apiSaveSession(w http.ResponseWriter, s *session.Session) bool {
+	key, err := sessionTable.Save(s)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return false
+	}
+	w.Header().Set(apiSessionHeader, key)
+	return true
+}
+
+type apiSessionResponse struct {
+	Session  string    `json:"session"`
+	Username string    `json:"username"`
+	Expires  time.Time `json:"expires"`
+	Enrolled bool      `json:"enrolled"`
+}
+
+// apiEnroll is acceptCSR for the API. It takes a PEM-encoded CSR and the user's password, and returns a session token.
+func apiEnroll(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		CSR      string `json:"csr"`
+		Password string `json:"password"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	req, err := cert.NewRequestFromReader(strings.NewReader(body.CSR))
+	if err != nil {
+		auditRequest(r, "enroll.csr", "", audit.Failure, err.Error())
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u, err := user.FromDB(req.Username)
+	if err != nil {
+		if _, ok := errors.Cause(err).(user.ErrUserNotFound); ok {
+			countAuth(r, nil, req.Username, metrics.ResultUnknownUser)
+			auditRequest(r, "enroll.csr", req.Username, audit.Failure, "unknown user")
+			apiError(w, http.StatusForbidden, "user or password invalid")
+			return
+		}
+		auditError(r, "enroll.csr", req.Username, err)
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	err = u.CheckPassword(body.Password)
+	if err == nil && u.Disabled {
+		err = user.ErrDisabled
+	}
+	countAuth(r, u, u.Username, passwordResult(err))
+	if err != nil {
+		auditRequest(r, "enroll.csr", u.Username, audit.Failure, refusal(err))
+		apiError(w, http.StatusForbidden, "user or password invalid")
+		return
+	}
+
+	s, _, err := sessionTable.Add(u.Username)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	s.Step = session.StepAuthenticated
+	s.Data["csr"] = req.CSR()
+	bindSession(s, r)
+	key, err := sessionTable.Save(s)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	auditRequest(r, "enroll.csr", u.Username, audit.Success, "")
+	writeJSON(w, http.StatusCreated, apiSessionResponse{key, u.Username, s.Expires, u.Initialised})
+}
+
+// apiOTPAuth is renderQR for the API, returning the otpauth URI encoding the user's TOTP secret. As with the QR code
+// it's only returned once per session and never once the user has enrolled a device.
+func apiOTPAuth(w http.ResponseWriter, r *http.Request) {
+	s, u, ok := apiSession(w, r)
+	if !ok {
+		return
+	}
+	switch ok, err := revealSecret(s, u); {
+	case err != nil:
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	case !ok:
+		apiError(w, http.StatusNotFound, "not available")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		URI string `json:"uri"`
+	}{u.Key})
+}
+
+// apiVerify is verify2FA for the API. On success the session is rotated and the new token returned along with the
+// issued certificate.
+func apiVerify(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	s, u, ok := apiSession(w, r)
+	if !ok {
+		return
+	}
+	if s.Step != session.StepAuthenticated {
+		apiError(w, http.StatusForbidden, "session invalid or expired")
+		return
+	}
+	if !codeAccepted(r, "enroll.verify", u, body.Code) {
+		apiError(w, http.StatusForbidden, "authentication code invalid")
+		return
+	}
+
+	req, err := issueCertificate(r, s, u)
+	if err == errNoCA {
+		apiError(w, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	s.Step = session.StepVerified
+	s.Reauthenticated = time.Now()
+	delete(s.Data, "csr")
+	s.Data["certificate"] = req.Certificate().Raw
+	s, key, err := sessionTable.Rotate(s)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		apiSessionResponse
+		Certificate string `json:"certificate"`
+	}{
+		apiSessionResponse{key, u.Username, s.Expires, true},
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: req.Certificate().Raw})),
+	})
+}
+
+// apiReauthenticate is reauthenticate for the API.
+func apiReauthenticate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Code string `json:"code"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+
+	s, u, ok := apiSession(w, r)
+	if !ok {
+		return
+	}
+	if s.Step != session.StepVerified || !codeAccepted(r, "reauth", u, body.Code) {
+		apiError(w, http.StatusForbidden, "authentication code invalid")
+		return
+	}
+	s.Reauthenticated = time.Now()
+	if apiSaveSession(w, s) {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apiFreshSession returns a verified session that has supplied a TOTP code within ReauthWindow.
+func apiFreshSession(w http.ResponseWriter, r *http.Request) (*session.Session, bool) {
+	s, _, ok := apiSession(w, r)
+	if !ok {
+		return nil, false
+	}
+	if s.Step != session.StepVerified {
+		apiError(w, http.StatusNotFound, "not available")
+		return nil, false
+	}
+	if time.Since(s.Reauthenticated) > ReauthWindow {
+		apiError(w, http.StatusForbidden, "reauthentication required")
+		return nil, false
+	}
+	return s, true
+}
+
+func apiCertificate(w http.ResponseWriter, r *http.Request) {
+	if s, ok := apiFreshSession(w, r); ok {
+		writeCertificate(w, s.User, s.Data["certificate"])
+	}
+}
+
+func apiProfile(w http.ResponseWriter, r *http.Request) {
+	ca := currentCA()
+	if ca == nil {
+		apiError(w, http.StatusServiceUnavailable, errNoCA.Error())
+		return
+	}
+	if s, ok := apiFreshSession(w, r); ok {
+		writeProfile(w, ca, s.User, s.Data["certificate"])
+	}
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// APITokensPath points to a file of admin API tokens, one per line. Blank lines and lines starting with # are ignored.
+var APITokensPath string
+
+// APIClientCAPath points to a CA certificate that admin API clients may authenticate against with a client certificate.
+// This should not be the CA used to issue VPN certificates. If APIAdminNames is set, only client certificates with one
+// of those Common Names are accepted.
+var APIClientCAPath string
+var APIAdminNames []string
+
+var apiTokens [][sha256.Size]byte
+
+// loadAPITokens reads the admin API tokens from APITokensPath, keeping only their hashes.
+func loadAPITokens() error {
+	apiTokens = nil
+	if APITokensPath == "" {
+		return nil
+	}
+	f, err := os.Open(APITokensPath)
+	if err != nil {
+		return errors.Wrap(err, "while opening API tokens")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		apiTokens = append(apiTokens, sha256.Sum256([]byte(line)))
+	}
+	return errors.Wrap(scanner.Err(), "while reading API tokens")
+}
+
+// apiTLSConfig returns the TLS configuration needed to request client certificates from admin API clients, or nil if
+// client certificate authentication isn't configured. Client certificates are optional at the TLS layer so that the
+// portal keeps working for browsers without one.
+func apiTLSConfig() (*tls.Config, error) {
+	if APIClientCAPath == "" {
+		return nil, nil
+	}
+	raw, err := ioutil.ReadFile(APIClientCAPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading API client CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, errors.New("no certificates found in API client CA")
+	}
+	return &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  pool,
+	}, nil
+}
+
+// adminToken reports whether a token is one of the configured admin API tokens.
+func adminToken(token string) bool {
+	if token == "" {
+		return false
+	}
+	sum := sha256.Sum256([]byte(token))
+	var found bool
+	for _, t := range apiTokens {
+		if subtle.ConstantTimeCompare(sum[:], t[:]) == 1 {
+			found = true
+		}
+	}
+	return found
+}
+
+// adminClientCert reports whether a request presented a client certificate verified against APIClientCAPath and
+// allowed by APIAdminNames.
+func adminClientCert(r *http.Request) bool {
+	if APIClientCAPath == "" || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	if len(APIAdminNames) == 0 {
+		return true
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, name := range APIAdminNames {
+		if name == cn {
+			return true
+		}
+	}
+	return false
+}
+
+// apiAdminActor identifies the admin API client making a request for the audit log: the Common Name of its client
+// certificate, or "api token" if it authenticated with a token.
+func apiAdminActor(r *http.Request) string {
+	if adminClientCert(r) {
+		return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return "api token"
+}
+
+// apiAudit records an action taken through the admin API.
+func apiAudit(r *http.Request, action, username string, err error) {
+	if err != nil {
+		auditAdmin(r, apiAdminActor(r), action, username, audit.Error, err.Error())
+		return
+	}
+	auditAdmin(r, apiAdminActor(r), action, username, audit.Success, "")
+}
+
+// requireAdmin only allows requests authenticated by an admin API token or client certificate.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminToken(bearerToken(r)) && !adminClientCert(r) {
+			apiError(w, http.StatusUnauthorized, "admin authentication required")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func addAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("GET /api/v1/admin/users", requireAdmin(apiListUsers))
+	mux.HandleFunc("POST /api/v1/admin/users", requireAdmin(apiCreateUser))
+	mux.HandleFunc("GET /api/v1/admin/users/{name}", requireAdmin(apiGetUser))
+	mux.HandleFunc("POST /api/v1/admin/users/{name}/disable", requireAdmin(apiDisableUser))
+	mux.HandleFunc("POST /api/v1/admin/users/{name}/enable", requireAdmin(apiEnableUser))
+	mux.HandleFunc("POST /api/v1/admin/users/{name}/unlock", requireAdmin(apiUnlockUser))
+	mux.HandleFunc("POST /api/v1/admin/users/{name}/reset-otp", requireAdmin(apiResetOTP))
+	mux.HandleFunc("POST /api/v1/admin/users/{name}/reset-password", requireAdmin(apiResetPassword))
+	mux.HandleFunc("GET /api/v1/admin/certificates", requireAdmin(apiListCertificates))
+	mux.HandleFunc("POST /api/v1/admin/certificates/{serial}/revoke", requireAdmin(apiRevokeCertificate))
+	mux.HandleFunc("GET /api/v1/admin/audit", requireAdmin(apiListAudit))
+}
+
+// apiUser is the view of a user returned by the admin API. It never includes the user's TOTP key or password.
+type apiUser struct {
+	Username    string `json:"username"`
+	Email       string `json:"email,omitempty"`
+	Initialised bool   `json:"initialised"`
+	Disabled    bool   `json:"disabled"`
+	Locked      bool   `json:"locked"`
+}
+
+func newAPIUser(u *user.User) apiUser {
+	return apiUser{u.Username, u.Email, u.Initialised, u.Disabled, u.Locked()}
+}
+
+type apiIssued struct {
+	Serial    string     `json:"serial"`
+	Username  string     `json:"username"`
+	NotAfter  time.Time  `json:"not_after"`
+	Revoked   bool       `json:"revoked"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newAPIIssued(i *cert.Issued) apiIssued {
+	c := apiIssued{Serial: i.Serial, Username: i.Username, NotAfter: i.NotAfter, Revoked: i.Revoked}
+	if i.Revoked {
+		c.RevokedAt = &i.RevokedAt
+	}
+	return c
+}
+
+// apiLoadUser loads the user named in the request path, writing an error response if they can't be loaded.
+func apiLoadUser(w http.ResponseWriter, r *http.Request) (*user.User, bool) {
+	u, err := user.FromDB(r.PathValue("name"))
+	if err != nil {
+		if _, ok := errors.Cause(err).(user.ErrUserNotFound); ok {
+			apiError(w, http.StatusNotFound, "user not found")
+			return nil, false
+		}
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return nil, false
+	}
+	return u, true
+}
+
+// apiUpdateUser changes a user's credentials or status, ending any sessions they hold, and returns them.
+func apiUpdateUser(w http.ResponseWriter, r *http.Request, action string, u *user.User, change func(*user.User) error) {
+	err := updateUserEndingSessions(u, change)
+	apiAudit(r, action, u.Username, err)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIUser(u))
+}
+
+func apiListUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := user.All()
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	result := make([]apiUser, 0, len(users))
+	for i := range users {
+		result = append(result, newAPIUser(&users[i]))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// apiCreateUser adds a user, as the user add command does, sending them an invitation if an email address is given.
+// Existing users are never overwritten, whether or not they've enrolled; use the reset endpoints to change them.
+func apiCreateUser(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Email    string `json:"email"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	if !cert.ValidName(body.Username) || body.Password == "" {
+		apiError(w, http.StatusBadRequest, "a valid username and password are required")
+		return
+	}
+
+	if _, err := user.FromDB(body.Username); err == nil {
+		apiError(w, http.StatusConflict, "user already exists")
+		return
+	} else if _, ok := errors.Cause(err).(user.ErrUserNotFound); !ok {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	u := user.New(body.Username, body.Password)
+	if err := u.SetEmail(body.Email); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid email address")
+		return
+	}
+	err := u.Save()
+	apiAudit(r, "admin.user.invite", u.Username, err)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	notifyInBackground(func() error { return NotifyInvited(u, body.Password, Notifiers) })
+	writeJSON(w, http.StatusCreated, newAPIUser(u))
+}
+
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	if u, ok := apiLoadUser(w, r); ok {
+		writeJSON(w, http.StatusOK, newAPIUser(u))
+	}
+}
+
+func apiDisableUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := apiLoadUser(w, r)
+	if !ok {
+		return
+	}
+	apiUpdateUser(w, r, "admin.user.disable", u, func(current *user.User) error { current.Disable(); return nil })
+}
+
+func apiEnableUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := apiLoadUser(w, r)
+	if !ok {
+		return
+	}
+	err := u.Update(func(current *user.User) error { current.Disabled = false; return nil })
+	apiAudit(r, "admin.user.enable", u.Username, err)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIUser(u))
+}
+
+func apiUnlockUser(w http.ResponseWriter, r *http.Request) {
+	u, ok := apiLoadUser(w, r)
+	if !ok {
+		return
+	}
+	err := u.Update(func(current *user.User) error { current.Unlock(); return nil })
+	apiAudit(r, "admin.user.unlock", u.Username, err)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIUser(u))
+}
+
+func apiResetOTP(w http.ResponseWriter, r *http.Request) {
+	u, ok := apiLoadUser(w, r)
+	if !ok {
+		return
+	}
+	apiUpdateUser(w, r, "admin.user.reset-otp", u, (*user.User).ResetOTP)
+}
+
+func apiResetPassword(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Password string `json:"password"`
+	}
+	if !readJSON(w, r, &body) {
+		return
+	}
+	if body.Password == "" {
+		apiError(w, http.StatusBadRequest, "a password is required")
+		return
+	}
+	u, ok := apiLoadUser(w, r)
+	if !ok {
+		return
+	}
+	apiUpdateUser(w, r, "admin.user.reset-password", u, func(current *user.User) error {
+		return current.ResetPassword(body.Password)
+	})
+}
+
+// apiListCertificates lists issued certificates, optionally only those belonging to the user given by ?user=.
+func apiListCertificates(w http.ResponseWriter, r *http.Request) {
+	issued, err := cert.ListIssued(r.URL.Query().Get("user"))
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	result := make([]apiIssued, 0, len(issued))
+	for i := range issued {
+		result = append(result, newAPIIssued(&issued[i]))
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func apiRevokeCertificate(w http.ResponseWriter, r *http.Request) {
+	serial := strings.ToLower(r.PathValue("serial"))
+	existing, err := cert.FindIssued(serial)
+	if err != nil {
+		if err == storm.ErrNotFound {
+			apiError(w, http.StatusNotFound, "certificate not found")
+			return
+		}
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if err := revokeCertificate(serial); err != nil {
+		auditAdmin(r, apiAdminActor(r), "certificate.revoke", existing.Username, audit.Error, err.Error())
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	auditAdmin(r, apiAdminActor(r), "certificate.revoke", existing.Username, audit.Success, "serial "+serial)
+	i, err := cert.FindIssued(serial)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeJSON(w, http.StatusOK, newAPIIssued(i))
+}
+
+// apiListAudit lists the most recent audit events, optionally only those concerning the user given by ?user=.
+func apiListAudit(w http.ResponseWriter, r *http.Request) {
+	events, err := audit.Recent(r.URL.Query().Get("user"), AuditViewLimit)
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminToken(t *testing.T) {
+	apiTokens = [][sha256.Size]byte{sha256.Sum256([]byte("s3cret"))}
+	defer func() { apiTokens = nil }()
+
+	r := httptest.NewRequest("GET", "/api/v1/admin/users", nil)
+	r.Header.Set("Authorization", "Bearer s3cret")
+	if !adminToken(bearerToken(r)) {
+		t.Errorf("Configured token was rejected")
+	}
+	r.Header.Set("Authorization", "Bearer wrong")
+	if adminToken(bearerToken(r)) {
+		t.Errorf("Unknown token was accepted")
+	}
+	r.Header.Del("Authorization")
+	if adminToken(bearerToken(r)) {
+		t.Errorf("Missing token was accepted")
+	}
+}
+
+func TestAdminClientCert(t *testing.T) {
+	APIClientCAPath = "ca.pem"
+	defer func() { APIClientCAPath, APIAdminNames = "", nil }()
+
+	r := httptest.NewRequest("GET", "/api/v1/admin/users", nil)
+	if adminClientCert(r) {
+		t.Errorf("Request without a client certificate was accepted")
+	}
+
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "onboarding"}}
+	r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{leaf}}}
+	if !adminClientCert(r) {
+		t.Errorf("Verified client certificate was rejected")
+	}
+
+	APIAdminNames = []string{"someone-else"}
+	if adminClientCert(r) {
+		t.Errorf("Client certificate not in APIAdminNames was accepted")
+	}
+	APIAdminNames = []string{"onboarding"}
+	if !adminClientCert(r) {
+		t.Errorf("Client certificate in APIAdminNames was rejected")
+	}
+}
+
+// apiRequest sends a request with an optional JSON body and bearer token to the API handler, decoding any JSON
+// response into v.
+func apiRequest(t *testing.T, method, path, token string, body, v interface{}) *httptest.ResponseRecorder {
+	var raw []byte
+	if body != nil {
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(raw))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	apiHandler().ServeHTTP(w, r)
+	if v != nil && w.Code < 300 {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s returned invalid JSON: %s", method, path, err)
+		}
+	}
+	return w
+}
+
+// testCSR returns a PEM-encoded CSR for username.
+func testCSR(t *testing.T, username string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: username},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func TestAPIEnrollment(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+	saveMaterial(t)
+	CACertPath, CAKeyPath = writeTestCertificate(t, t.TempDir())
+	if err := loadCAMaterial(); err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+
+	u := user.New("alice", "password")
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	csr := testCSR(t, "alice")
+
+	if w := apiRequest(t, "POST", "/api/v1/enroll", "", "not an object", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid body returned status %d", w.Code)
+	}
+	wrong := map[string]string{"csr": csr, "password": "wrong"}
+	if w := apiRequest(t, "POST", "/api/v1/enroll", "", wrong, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Wrong password returned status %d", w.Code)
+	}
+	var enrolled apiSessionResponse
+	w := apiRequest(t, "POST", "/api/v1/enroll", "", map[string]string{"csr": csr, "password": "password"}, &enrolled)
+	if w.Code != http.StatusCreated || enrolled.Session == "" || enrolled.Username != "alice" || enrolled.Enrolled {
+		t.Fatalf("Enrollment returned status %d and %+v", w.Code, enrolled)
+	}
+
+	if w := apiRequest(t, "GET", "/api/v1/certificate", enrolled.Session, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Certificate request before verification returned status %d", w.Code)
+	}
+
+	var otpauth struct {
+		URI string `json:"uri"`
+	}
+	if w := apiRequest(t, "GET", "/api/v1/enroll/otpauth", enrolled.Session, nil, &otpauth); w.Code != http.StatusOK || otpauth.URI != u.Key {
+		t.Fatalf("otpauth request returned status %d and %q", w.Code, otpauth.URI)
+	}
+	if w := apiRequest(t, "GET", "/api/v1/enroll/otpauth", enrolled.Session, nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Second otpauth request returned status %d", w.Code)
+	}
+
+	if w := apiRequest(t, "POST", "/api/v1/enroll/verify", enrolled.Session, map[string]string{"code": "000000"}, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Wrong code returned status %d", w.Code)
+	}
+	k, err := otp.NewKeyFromURL(u.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.GenerateCode(k.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verified struct {
+		apiSessionResponse
+		Certificate string `json:"certificate"`
+	}
+	w = apiRequest(t, "POST", "/api/v1/enroll/verify", enrolled.Session, map[string]string{"code": code}, &verified)
+	if w.Code != http.StatusOK || !verified.Enrolled || verified.Session == enrolled.Session {
+		t.Fatalf("Verification returned status %d and %+v", w.Code, verified.apiSessionResponse)
+	}
+	if block, _ := pem.Decode([]byte(verified.Certificate)); block == nil || block.Type != "CERTIFICATE" {
+		t.Errorf("Verification didn't return a certificate")
+	}
+
+	// The session is rotated on verification, so the old token no longer works
+	if w := apiRequest(t, "GET", "/api/v1/certificate", enrolled.Session, nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Token from before verification returned status %d", w.Code)
+	}
+	if w := apiRequest(t, "GET", "/api/v1/certificate", verified.Session, nil, nil); w.Code != http.StatusOK {
+		t.Errorf("Certificate request returned status %d", w.Code)
+	}
+	issuer := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: currentCA().Certificate().Raw}))
+	if w := apiRequest(t, "GET", "/api/v1/profile", verified.Session, nil, nil); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), issuer) {
+		t.Errorf("Profile request returned status %d without the CA certificate", w.Code)
+	}
+	if w := apiRequest(t, "POST", "/api/v1/reauth", verified.Session, map[string]string{"code": code}, nil); w.Code != http.StatusForbidden {
+		t.Errorf("Reauthenticating with a used code returned status %d", w.Code)
+	}
+}
+
+func TestAPIAdminUsers(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+	apiTokens = [][sha256.Size]byte{sha256.Sum256([]byte("s3cret"))}
+	defer func() { apiTokens = nil }()
+
+	if w := apiRequest(t, "GET", "/api/v1/admin/users", "", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Unauthenticated request returned status %d", w.Code)
+	}
+	if w := apiRequest(t, "GET", "/api/v1/admin/users", "wrong", nil, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Request with an unknown token returned status %d", w.Code)
+	}
+
+	tests := []struct {
+		name     string
+		body     map[string]string
+		wantCode int
+	}{
+		{"invalid name", map[string]string{"username": "bad name", "password": "password"}, http.StatusBadRequest},
+		{"missing password", map[string]string{"username": "alice"}, http.StatusBadRequest},
+		{"invalid email", map[string]string{"username": "alice", "password": "password", "email": "alice"}, http.StatusBadRequest},
+		{"new user", map[string]string{"username": "alice", "password": "password", "email": "alice@example.com"}, http.StatusCreated},
+		{"existing user", map[string]string{"username": "alice", "password": "another password"}, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := apiRequest(t, "POST", "/api/v1/admin/users", "s3cret", tt.body, nil); w.Code != tt.wantCode {
+				t.Errorf("Creating user returned status %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+	// The conflicting request mustn't have replaced the user's password
+	u, err := user.FromDB("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := u.ValidatePassword("password"); err != nil {
+		t.Errorf("Existing user was overwritten")
+	}
+
+	var got apiUser
+	if w := apiRequest(t, "GET", "/api/v1/admin/users/alice", "s3cret", nil, &got); w.Code != http.StatusOK {
+		t.Errorf("Getting user returned status %d", w.Code)
+	}
+	if want := (apiUser{Username: "alice", Email: "alice@example.com"}); got != want {
+		t.Errorf("Got user %+v, want %+v", got, want)
+	}
+	if w := apiRequest(t, "GET", "/api/v1/admin/users/bob", "s3cret", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("Getting unknown user returned status %d", w.Code)
+	}
+
+	if w := apiRequest(t, "POST", "/api/v1/admin/users/alice/disable", "s3cret", nil, &got); w.Code != http.StatusOK || !got.Disabled {
+		t.Errorf("Disabling user returned status %d and %+v", w.Code, got)
+	}
+	var users []apiUser
+	if w := apiRequest(t, "GET", "/api/v1/admin/users", "s3cret", nil, &users); w.Code != http.StatusOK || len(users) != 1 || !users[0].Disabled {
+		t.Errorf("Listing users returned status %d and %+v", w.Code, users)
+	}
+	if w := apiRequest(t, "POST", "/api/v1/admin/users/alice/enable", "s3cret", nil, &got); w.Code != http.StatusOK || got.Disabled {
+		t.Errorf("Enabling user returned status %d and %+v", w.Code, got)
+	}
+	if w := apiRequest(t, "POST", "/api/v1/admin/users/alice/reset-password", "s3cret", map[string]string{}, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("Resetting password without one returned status %d", w.Code)
+	}
+}
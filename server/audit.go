@@ -0,0 +1,51 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/user"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+)
+
+// auditRequest records an event concerning username, made by the client sending the request.
+func auditRequest(r *http.Request, action, username, outcome, detail string) {
+	audit.Record(audit.Event{Action: action, User: username, IP: clientAddress(r), Outcome: outcome, Detail: detail})
+}
+
+// auditAdmin records an action taken by an administrator, concerning username if it isn't empty.
+func auditAdmin(r *http.Request, actor, action, username, outcome, detail string) {
+	audit.Record(audit.Event{
+		Action:  action,
+		User:    username,
+		Actor:   actor,
+		IP:      clientAddress(r),
+		Outcome: outcome,
+		Detail:  detail,
+	})
+}
+
+// auditError records an action that failed because of err rather than anything the client did.
+func auditError(r *http.Request, action, username string, err error) {
+	auditRequest(r, action, username, audit.Error, err.Error())
+}
+
+func clientAddress(r *http.Request) string {
+	if ip := clientIP(r); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// refusal describes why a credential check failed, for the audit log only since it tells a client more than it should
+// know.
+func refusal(err error) string {
+	switch err {
+	case user.ErrLockedOut:
+		return "locked out"
+	case user.ErrDisabled:
+		return "disabled"
+	case nil, bcrypt.ErrMismatchedHashAndPassword:
+		return "invalid credentials"
+	}
+	return err.Error()
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/alowde/totp-ovpn/session"
+	"net"
+	"net/http"
+)
+
+// BindSessionIP rejects sessions used from an address other than the one they were issued to. If BindSessionPrefix is
+// greater than zero, addresses only need to share that many leading bits, which allows for clients behind a pool of
+// NAT addresses.
+var BindSessionIP bool
+var BindSessionPrefix int
+
+// BindSessionUserAgent rejects sessions used by a client with a different User-Agent from the one they were issued to.
+var BindSessionUserAgent bool
+
+// clientIP returns the address of the client making a request, as reported by any trusted proxies it came through.
+func clientIP(r *http.Request) net.IP {
+	origin, _ := originHop(r)
+	return origin.ip
+}
+
+func userAgentHash(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.UserAgent()))
+	return hex.EncodeToString(sum[:])
+}
+
+// bindSession records the client a session is being issued to.
+func bindSession(s *session.Session, r *http.Request) {
+	if ip := clientIP(r); ip != nil {
+		s.ClientIP = ip.String()
+	}
+	s.UserAgent = userAgentHash(r)
+}
+
+// sameNetwork compares two addresses, requiring only the first prefix bits to match if prefix is greater than zero.
+func sameNetwork(a, b net.IP, prefix int) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if prefix <= 0 {
+		return a.Equal(b)
+	}
+	bits := 128
+	if a.To4() != nil && b.To4() != nil {
+		a, b, bits = a.To4(), b.To4(), 32
+	}
+	if prefix > bits {
+		prefix = bits
+	}
+	mask := net.CIDRMask(prefix, bits)
+	return a.Mask(mask).Equal(b.Mask(mask))
+}
+
+// bindingMatches checks a request against the client a session was issued to, according to the binding settings.
+func bindingMatches(s *session.Session, r *http.Request) bool {
+	if BindSessionIP && !sameNetwork(net.ParseIP(s.ClientIP), clientIP(r), BindSessionPrefix) {
+		return false
+	}
+	if BindSessionUserAgent && s.UserAgent != userAgentHash(r) {
+		return false
+	}
+	return true
+}
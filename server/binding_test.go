@@ -0,0 +1,47 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/session"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBindingMatches(t *testing.T) {
+	oldIP, oldPrefix, oldAgent := BindSessionIP, BindSessionPrefix, BindSessionUserAgent
+	defer func() { BindSessionIP, BindSessionPrefix, BindSessionUserAgent = oldIP, oldPrefix, oldAgent }()
+
+	request := func(addr, agent string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = addr + ":1234"
+		r.Header.Set("User-Agent", agent)
+		return r
+	}
+	s := new(session.Session)
+	bindSession(s, request("192.0.2.10", "browser"))
+
+	tests := []struct {
+		name   string
+		ip     bool
+		prefix int
+		agent  bool
+		r      *http.Request
+		want   bool
+	}{
+		{"unbound", false, 0, false, request("203.0.113.1", "other"), true},
+		{"same address", true, 0, false, request("192.0.2.10", "browser"), true},
+		{"different address", true, 0, false, request("192.0.2.11", "browser"), false},
+		{"same network", true, 24, false, request("192.0.2.11", "browser"), true},
+		{"different network", true, 24, false, request("192.0.3.10", "browser"), false},
+		{"same user agent", false, 0, true, request("203.0.113.1", "browser"), true},
+		{"different user agent", false, 0, true, request("192.0.2.10", "other"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			BindSessionIP, BindSessionPrefix, BindSessionUserAgent = tt.ip, tt.prefix, tt.agent
+			if got := bindingMatches(s, tt.r); got != tt.want {
+				t.Errorf("bindingMatches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/pkg/errors"
+	"os"
+)
+
+var CACertPath string
+var CAKeyPath string
+var CAPassword string
+
+// CASignerSocket is the unix socket of a signing daemon holding the CA key. If set, CAKeyPath is ignored and the key
+// never enters this process.
+var CASignerSocket string
+
+// PKCS11Module, PKCS11Token, PKCS11PIN and PKCS11KeyLabel select a CA key held on a PKCS#11 token. They're ignored if
+// CASignerSocket is set.
+var PKCS11Module string
+var PKCS11Token string
+var PKCS11PIN string
+var PKCS11KeyLabel string
+
+// OCSPCertPath and OCSPKeyPath optionally point to a delegated OCSP responder certificate. If they aren't set OCSP
+// responses are signed by the CA.
+var OCSPCertPath string
+var OCSPKeyPath string
+
+// ca is guarded by materialMutex since it can be reloaded; use currentCA to read it.
+var ca *cert.CA
+
+// loadCA reads the signing CA certificate from CACertPath and connects to the configured signer. If no external signer
+// is configured the key is read from CAKeyPath, or if that isn't set CACertPath is expected to be a PKCS#12 bundle
+// containing both the certificate and key.
+func loadCA() (*cert.CA, error) {
+	certFile, err := os.Open(CACertPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening CA certificate")
+	}
+	defer certFile.Close()
+
+	switch {
+	case CASignerSocket != "":
+		signer, err := cert.DialSigner(CASignerSocket)
+		if err != nil {
+			return nil, errors.Wrap(err, "while connecting to signer")
+		}
+		return cert.NewCAFromSigner(certFile, signer, CAPassword)
+	case PKCS11Module != "":
+		signer, err := cert.NewPKCS11Signer(PKCS11Module, PKCS11Token, PKCS11PIN, PKCS11KeyLabel)
+		if err != nil {
+			return nil, err
+		}
+		return cert.NewCAFromSigner(certFile, signer, CAPassword)
+	}
+
+	if CAKeyPath == "" {
+		return cert.NewCAFromPKCS12(certFile, CAPassword)
+	}
+
+	keyFile, err := os.Open(CAKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening CA key")
+	}
+	defer keyFile.Close()
+
+	return cert.NewCAFromReaders(certFile, keyFile, CAPassword)
+}
+
+// reloadCAFromSigner rereads the CA certificate from CACertPath for a signer that's already connected.
+func reloadCAFromSigner(signer crypto.Signer) (*cert.CA, error) {
+	certFile, err := os.Open(CACertPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening CA certificate")
+	}
+	defer certFile.Close()
+	return cert.NewCAFromSigner(certFile, signer, CAPassword)
+}
+
+// newOCSPResponder builds an OCSP responder for the CA, using the delegated responder certificate if one is configured.
+func newOCSPResponder(ca *cert.CA) (*cert.OCSPResponder, error) {
+	if OCSPCertPath == "" {
+		return cert.NewOCSPResponder(ca)
+	}
+
+	certFile, err := os.Open(OCSPCertPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening OCSP responder certificate")
+	}
+	defer certFile.Close()
+
+	keyFile, err := os.Open(OCSPKeyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "while opening OCSP responder key")
+	}
+	defer keyFile.Close()
+
+	return cert.NewDelegatedOCSPResponder(ca, certFile, keyFile, CAPassword)
+}
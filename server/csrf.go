@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"github.com/alowde/totp-ovpn/session"
+	"net/http"
+)
+
+// csrfCookieName holds the CSRF token for requests made before a session exists, such as the CSR upload form. Once a
+// session exists its own token is used instead.
+const csrfCookieName = "totp-ovpn-csrf"
+
+// csrfFieldName is the form field every state-changing request must include the CSRF token in.
+const csrfFieldName = "csrf_token"
+
+type csrfContextKey struct{}
+
+// anonymousCSRFToken returns the CSRF token from the request's CSRF cookie, issuing a new cookie if there isn't one.
+func anonymousCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(csrfCookieName); err == nil && c.Value != "" {
+		return c.Value
+	}
+	token := session.NewToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   requestSecure(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// csrfProtect rejects state-changing requests that don't carry the expected CSRF token, and makes the token available
+// to handlers through csrfToken so that it can be injected into rendered forms. The expected token is the session's
+// token if the request has a valid portal session, otherwise the token in its CSRF cookie.
+func csrfProtect(h http.Handler) http.Handler {
+	return csrfProtectWith(func(r *http.Request) (*session.Session, bool) { return sessionTable.GetRequest(r) }, h)
+}
+
+// csrfProtectWith is csrfProtect with sessions looked up by the given function, for pages with their own sessions.
+func csrfProtectWith(lookup func(*http.Request) (*session.Session, bool), h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var expected string
+		if s, ok := lookup(r); ok {
+			expected = s.CSRF
+		} else {
+			expected = anonymousCSRFToken(w, r)
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			r.Body = http.MaxBytesReader(w, r.Body, MaxCSRSize)
+			_ = r.ParseMultipartForm(MaxCSRSize)
+			got := r.PostFormValue(csrfFieldName)
+			if got == "" || subtle.ConstantTimeCompare([]byte(got), []byte(expected)) != 1 {
+				http.Error(w, "invalid or missing CSRF token", http.StatusForbidden)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, expected)))
+	})
+}
+
+// csrfToken returns the CSRF token to include in forms rendered in response to a request passed through csrfProtect.
+func csrfToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey{}).(string)
+	return token
+}
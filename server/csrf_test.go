@@ -0,0 +1,105 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/session"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// postForm returns a form POST carrying the given CSRF token, or none if token is empty.
+func postForm(path, token string) *http.Request {
+	form := url.Values{}
+	if token != "" {
+		form.Set(csrfFieldName, token)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func TestCSRFProtect(t *testing.T) {
+	useSessionTables(t)
+	var seen string
+	h := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = csrfToken(r)
+	}))
+
+	_, key, err := sessionTable.Add("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := sessionTable.Get(key)
+	withSession := func(r *http.Request) *http.Request {
+		r.AddCookie(&http.Cookie{Name: session.CookieName, Value: key})
+		return r
+	}
+	withCookie := func(r *http.Request) *http.Request {
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "anonymous"})
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		r        *http.Request
+		wantCode int
+		wantSeen string
+	}{
+		{"missing token", withSession(postForm("/", "")), http.StatusForbidden, ""},
+		{"wrong token", withSession(postForm("/", "wrong")), http.StatusForbidden, ""},
+		{"another session's token", withSession(postForm("/", "anonymous")), http.StatusForbidden, ""},
+		{"valid session token", withSession(postForm("/", s.CSRF)), http.StatusOK, s.CSRF},
+		{"missing anonymous token", withCookie(postForm("/", "")), http.StatusForbidden, ""},
+		{"valid anonymous token", withCookie(postForm("/", "anonymous")), http.StatusOK, "anonymous"},
+		{"GET", withSession(httptest.NewRequest(http.MethodGet, "/", nil)), http.StatusOK, s.CSRF},
+		{"HEAD", withSession(httptest.NewRequest(http.MethodHead, "/", nil)), http.StatusOK, s.CSRF},
+		{"OPTIONS", withCookie(httptest.NewRequest(http.MethodOptions, "/", nil)), http.StatusOK, "anonymous"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = ""
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, tt.r)
+			if w.Code != tt.wantCode {
+				t.Errorf("Request returned status %d, want %d", w.Code, tt.wantCode)
+			}
+			if seen != tt.wantSeen {
+				t.Errorf("Handler saw token %q, want %q", seen, tt.wantSeen)
+			}
+		})
+	}
+}
+
+func TestCSRFProtectIssuesCookie(t *testing.T) {
+	useSessionTables(t)
+	var seen string
+	h := csrfProtect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = csrfToken(r)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var issued *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == csrfCookieName {
+			issued = c
+		}
+	}
+	if issued == nil || issued.Value == "" || issued.Value != seen {
+		t.Fatalf("Form page got token %q with cookie %v", seen, issued)
+	}
+	if !issued.HttpOnly || issued.SameSite != http.SameSiteStrictMode {
+		t.Errorf("CSRF cookie isn't HttpOnly and SameSite=Strict: %v", issued)
+	}
+
+	// Submitting the form with the issued cookie and token is accepted
+	r := postForm("/", seen)
+	r.AddCookie(issued)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("Form submitted with the issued token returned status %d", w.Code)
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/metrics"
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/user"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// MinPasswordLength is the shortest password users may choose for themselves.
+var MinPasswordLength = 12
+
+// login lets users who have already enrolled sign in with their password and a TOTP or recovery code, starting a
+// verified session that leads to their dashboard.
+func login(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		_ = renderPageLogin(w, r, "", csrfToken(r))
+		return
+	}
+
+	invalid := T(requestLanguage(r), "error.login")
+	username := r.PostFormValue("username")
+	u, err := user.FromDB(username)
+	if err != nil || !u.Initialised || u.Disabled {
+		reason, result := "unknown user", metrics.ResultUnknownUser
+		switch {
+		case err != nil:
+		case u.Disabled:
+			reason, result = refusal(user.ErrDisabled), metrics.ResultDisabled
+		default:
+			reason, result = "not enrolled", metrics.ResultNotEnrolled
+		}
+		countAuth(r, nil, username, result)
+		auditRequest(r, "login", username, audit.Failure, reason)
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageLogin(w, r, invalid, csrfToken(r))
+		return
+	}
+	if err := u.CheckPassword(r.PostFormValue("password")); err != nil {
+		if err == user.ErrLockedOut {
+			invalid = T(requestLanguage(r), "error.locked_out")
+		}
+		countAuth(r, u, u.Username, passwordResult(err))
+		auditRequest(r, "login", u.Username, audit.Failure, refusal(err))
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageLogin(w, r, invalid, csrfToken(r))
+		return
+	}
+	ok, err := u.CheckSecondFactor(r.PostFormValue("code"))
+	if err == user.ErrLockedOut {
+		invalid = T(requestLanguage(r), "error.locked_out")
+	}
+	auditCode(r, "login", u, ok, err)
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageLogin(w, r, invalid, csrfToken(r))
+		return
+	}
+
+	if old, ok := sessionTable.GetRequest(r); ok {
+		_ = sessionTable.Revoke(old.ID)
+	}
+	s, _, err := sessionTable.Add(u.Username)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	s.Step = session.StepVerified
+	s.Reauthenticated = time.Now()
+	if current := currentCertificate(u.Username); current != nil {
+		s.Data["certificate"] = current.DER
+	}
+	bindSession(s, r)
+	if err := saveSession(w, r, s); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// currentCertificate returns the user's unrevoked certificate with the latest expiry, or nil if they have none.
+func currentCertificate(username string) *cert.Issued {
+	issued, err := cert.ListIssued(username)
+	if err != nil {
+		log.Printf("While listing certificates for %s: %s", username, err)
+		return nil
+	}
+	var current *cert.Issued
+	for i := range issued {
+		if issued[i].Revoked || time.Now().After(issued[i].NotAfter) {
+			continue
+		}
+		if current == nil || issued[i].NotAfter.After(current.NotAfter) {
+			current = &issued[i]
+		}
+	}
+	return current
+}
+
+// dashboardCertificate is the view of an issued certificate shown on a user's dashboard.
+type dashboardCertificate struct {
+	Serial   string
+	NotAfter time.Time
+	Revoked  bool
+	Expired  bool
+}
+
+// dashboard shows a logged in user their certificates, recent VPN logins and account options.
+func dashboard(w http.ResponseWriter, r *http.Request) {
+	s, u, ok := currentSession(w, r)
+	if !ok || s.Step != session.StepVerified {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	issued, err := cert.ListIssued(u.Username)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(issued, func(i, j int) bool { return issued[i].NotAfter.After(issued[j].NotAfter) })
+	certificates := make([]dashboardCertificate, 0, len(issued))
+	for _, i := range issued {
+		certificates = append(certificates, dashboardCertificate{i.Serial, i.NotAfter, i.Revoked, time.Now().After(i.NotAfter)})
+	}
+
+	_ = renderPageDashboard(w, r, u.Username, certificates, u.Logins, len(u.RecoveryCodes), s.CSRF)
+}
+
+// revokeOwnCertificate lets a user revoke one of their own certificates, such as one on a lost device.
+func revokeOwnCertificate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		// Users are sent here after reauthenticating, and the form to submit again is on the dashboard
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+	s, _, ok := currentSession(w, r)
+	if !ok || s.Step != session.StepVerified {
+		http.Error(w, "nope", http.StatusNotFound)
+		return
+	}
+
+	i, err := cert.FindIssued(r.PostFormValue("serial"))
+	if err != nil || i.Username != s.User {
+		http.Error(w, "certificate not found", http.StatusNotFound)
+		return
+	}
+	if err := revokeCertificate(i.Serial); err != nil {
+		auditError(r, "certificate.revoke", s.User, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, "certificate.revoke", s.User, audit.Success, "serial "+i.Serial)
+	http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+}
+
+// regenerateRecoveryCodes confirms and then replaces the user's recovery codes, showing the new codes once.
+func regenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	s, u, ok := currentSession(w, r)
+	if !ok || s.Step != session.StepVerified {
+		http.Error(w, "nope", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		_ = renderPageRecoveryConfirm(w, r, s.CSRF)
+		return
+	}
+
+	var codes []string
+	if err := u.Update(func(current *user.User) error { codes = current.GenerateRecoveryCodes(); return nil }); err != nil {
+		auditError(r, "recovery.regenerate", u.Username, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, "recovery.regenerate", u.Username, audit.Success, "")
+	_ = renderPageRecoveryCodes(w, r, codes, s.CSRF)
+}
+
+// changePassword lets a user choose a new password after confirming their current one. Every other session they hold
+// is ended.
+func changePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		// Users are sent here after reauthenticating, and the form to submit again is on the dashboard
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+	s, u, ok := currentSession(w, r)
+	if !ok || s.Step != session.StepVerified {
+		http.Error(w, "nope", http.StatusNotFound)
+		return
+	}
+
+	err := u.CheckPassword(r.PostFormValue("current"))
+	countAuth(r, u, u.Username, passwordResult(err))
+	if err != nil {
+		auditRequest(r, "password.change", u.Username, audit.Failure, refusal(err))
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageMessage(w, r, "title.password_not_changed", T(requestLanguage(r), "password.current_invalid"), s.CSRF)
+		return
+	}
+	password := r.PostFormValue("password")
+	if len(password) < MinPasswordLength || password != r.PostFormValue("confirm") {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = renderPageMessage(w, r, "title.password_not_changed", T(requestLanguage(r), "password.mismatch", MinPasswordLength), s.CSRF)
+		return
+	}
+
+	if err := updateUserEndingSessions(u, func(current *user.User) error { return current.ResetPassword(password) }); err != nil {
+		auditError(r, "password.change", u.Username, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, "password.change", u.Username, audit.Success, "")
+
+	// The reset ended this session too, so carry its state over to a new one
+	s, key, err := sessionTable.Rotate(s)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, key)
+	_ = renderPageMessage(w, r, "title.password_changed", T(requestLanguage(r), "password.changed"), s.CSRF)
+}
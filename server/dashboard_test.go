@@ -0,0 +1,316 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveForm posts a form through the portal's routes with the given session, which may be empty.
+func serveForm(path, key string, form url.Values) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if key != "" {
+		withSession(r, key)
+	}
+	return servePortal(r)
+}
+
+func servePortal(r *http.Request) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	addPortalRoutes(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// verifiedSession saves u and returns a verified session for them that last supplied a TOTP code at reauthenticated.
+func verifiedSession(t *testing.T, u *user.User, reauthenticated time.Time) (*session.Session, string) {
+	s, _ := testSession(t, u, session.StepVerified)
+	s.Reauthenticated = reauthenticated
+	key, err := sessionTable.Save(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, key
+}
+
+// currentCode returns the TOTP code for u at the current time.
+func currentCode(t *testing.T, u *user.User) string {
+	k, err := otp.NewKeyFromURL(u.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.GenerateCode(k.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+// issueTestCertificate signs and records a certificate for username with the loaded CA, returning its serial.
+func issueTestCertificate(t *testing.T, username string) string {
+	req, err := cert.NewRequestFromReader(strings.NewReader(testCSR(t, username)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := currentCA().SignRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Record(req); err != nil {
+		t.Fatal(err)
+	}
+	return req.Serial()
+}
+
+// isReauthPage reports whether a response asks for a TOTP code before continuing.
+func isReauthPage(w *httptest.ResponseRecorder) bool {
+	return w.Code == http.StatusOK && strings.Contains(w.Body.String(), `action="/reauth"`)
+}
+
+func TestLogin(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+	u := user.New("alice", "correct horse")
+	u.Initialised = true
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	code := currentCode(t, u)
+
+	submit := func(password, code, token string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"alice"}, "password": {password}, "code": {code}, csrfFieldName: {token}}
+		r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: "anonymous"})
+		return servePortal(r)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		code     string
+		token    string
+		wantCode int
+	}{
+		{"missing CSRF token", "correct horse", code, "", http.StatusForbidden},
+		{"wrong password", "wrong", code, "anonymous", http.StatusForbidden},
+		{"wrong code", "correct horse", "000000", "anonymous", http.StatusForbidden},
+		{"valid", "correct horse", code, "anonymous", http.StatusSeeOther},
+		{"replayed code", "correct horse", code, "anonymous", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := submit(tt.password, tt.code, tt.token)
+			if w.Code != tt.wantCode {
+				t.Fatalf("Login returned status %d, want %d", w.Code, tt.wantCode)
+			}
+			var key string
+			for _, c := range w.Result().Cookies() {
+				if c.Name == session.CookieName {
+					key = c.Value
+				}
+			}
+			if tt.wantCode != http.StatusSeeOther {
+				if key != "" {
+					t.Errorf("Failed login was given a session")
+				}
+				return
+			}
+			if s, ok := sessionTable.Get(key); !ok || s.Step != session.StepVerified || s.User != "alice" {
+				t.Errorf("Login didn't start a verified session: %+v", s)
+			}
+			if w.Header().Get("Location") != "/dashboard" {
+				t.Errorf("Login redirected to %q", w.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+	saveMaterial(t)
+	CACertPath, CAKeyPath = writeTestCertificate(t, t.TempDir())
+	if err := loadCAMaterial(); err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+	serial := issueTestCertificate(t, "alice")
+
+	w := servePortal(httptest.NewRequest(http.MethodGet, "/dashboard", nil))
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login" {
+		t.Errorf("Dashboard without a session returned status %d and location %q", w.Code, w.Header().Get("Location"))
+	}
+
+	_, key := testSession(t, user.New("alice", "password"), session.StepAuthenticated)
+	w = servePortal(withSession(httptest.NewRequest(http.MethodGet, "/dashboard", nil), key))
+	if w.Code != http.StatusSeeOther {
+		t.Errorf("Dashboard for an unverified session returned status %d", w.Code)
+	}
+
+	s, key := verifiedSession(t, user.New("alice", "password"), time.Time{})
+	w = servePortal(withSession(httptest.NewRequest(http.MethodGet, "/dashboard", nil), key))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Dashboard returned status %d", w.Code)
+	}
+	if body := w.Body.String(); !strings.Contains(body, serial) || !strings.Contains(body, s.CSRF) {
+		t.Errorf("Dashboard doesn't list the user's certificate or carry their CSRF token")
+	}
+}
+
+func TestRevokeOwnCertificate(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+	saveMaterial(t)
+	CACertPath, CAKeyPath = writeTestCertificate(t, t.TempDir())
+	if err := loadCAMaterial(); err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+	own, other := issueTestCertificate(t, "alice"), issueTestCertificate(t, "bob")
+
+	u := user.New("alice", "password")
+	stale, staleKey := verifiedSession(t, u, time.Now().Add(-ReauthWindow-time.Minute))
+	fresh, freshKey := verifiedSession(t, u, time.Now())
+
+	tests := []struct {
+		name     string
+		key      string
+		form     url.Values
+		wantCode int
+	}{
+		{"missing CSRF token", freshKey, url.Values{"serial": {own}}, http.StatusForbidden},
+		{"stale session", staleKey, url.Values{"serial": {own}, csrfFieldName: {stale.CSRF}}, http.StatusOK},
+		{"another user's certificate", freshKey, url.Values{"serial": {other}, csrfFieldName: {fresh.CSRF}}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveForm("/dashboard/revoke", tt.key, tt.form); w.Code != tt.wantCode {
+				t.Errorf("Revocation returned status %d, want %d", w.Code, tt.wantCode)
+			}
+			for _, serial := range []string{own, other} {
+				if i, err := cert.FindIssued(serial); err != nil || i.Revoked {
+					t.Errorf("Certificate %s was revoked", serial)
+				}
+			}
+		})
+	}
+	if w := serveForm("/dashboard/revoke", staleKey, url.Values{"serial": {own}, csrfFieldName: {stale.CSRF}}); !isReauthPage(w) {
+		t.Errorf("Stale session wasn't asked to reauthenticate")
+	}
+
+	w := serveForm("/dashboard/revoke", freshKey, url.Values{"serial": {own}, csrfFieldName: {fresh.CSRF}})
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/dashboard" {
+		t.Fatalf("Revocation returned status %d and location %q", w.Code, w.Header().Get("Location"))
+	}
+	if i, err := cert.FindIssued(own); err != nil || !i.Revoked {
+		t.Errorf("Own certificate wasn't revoked")
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+
+	u := user.New("alice", "old password")
+	stale, staleKey := verifiedSession(t, u, time.Now().Add(-ReauthWindow-time.Minute))
+	fresh, freshKey := verifiedSession(t, u, time.Now())
+	form := func(token, current, password, confirm string) url.Values {
+		return url.Values{csrfFieldName: {token}, "current": {current}, "password": {password}, "confirm": {confirm}}
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		form     url.Values
+		wantCode int
+	}{
+		{"missing CSRF token", freshKey, form("", "old password", "new password!", "new password!"), http.StatusForbidden},
+		{"wrong current password", freshKey, form(fresh.CSRF, "wrong", "new password!", "new password!"), http.StatusForbidden},
+		{"mismatched confirmation", freshKey, form(fresh.CSRF, "old password", "new password!", "new password?"), http.StatusBadRequest},
+		{"too short", freshKey, form(fresh.CSRF, "old password", "short", "short"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serveForm("/change-password", tt.key, tt.form); w.Code != tt.wantCode {
+				t.Errorf("Password change returned status %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+	if w := serveForm("/change-password", staleKey, form(stale.CSRF, "old password", "new password!", "new password!")); !isReauthPage(w) {
+		t.Errorf("Stale session wasn't asked to reauthenticate, status %d", w.Code)
+	}
+	if u, err := user.FromDB("alice"); err != nil || u.ValidatePassword("old password") != nil {
+		t.Fatalf("Password was changed by a refused request")
+	}
+
+	w := serveForm("/change-password", freshKey, form(fresh.CSRF, "old password", "new password!", "new password!"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Password change returned status %d", w.Code)
+	}
+	if u, err := user.FromDB("alice"); err != nil || u.ValidatePassword("new password!") != nil {
+		t.Errorf("Password wasn't changed")
+	}
+	// Every existing session ends, and the one that made the change continues under a new key
+	for _, key := range []string{staleKey, freshKey} {
+		if w := servePortal(withSession(httptest.NewRequest(http.MethodGet, "/dashboard", nil), key)); w.Code != http.StatusSeeOther {
+			t.Errorf("Session from before the password change still works")
+		}
+	}
+	var rotated string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == session.CookieName {
+			rotated = c.Value
+		}
+	}
+	if w := servePortal(withSession(httptest.NewRequest(http.MethodGet, "/dashboard", nil), rotated)); w.Code != http.StatusOK {
+		t.Errorf("Rotated session doesn't work, status %d", w.Code)
+	}
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+
+	u := user.New("alice", "password")
+	u.GenerateRecoveryCodes()
+	_, unverifiedKey := testSession(t, u, session.StepAuthenticated)
+	stale, staleKey := verifiedSession(t, u, time.Now().Add(-ReauthWindow-time.Minute))
+	fresh, freshKey := verifiedSession(t, u, time.Now())
+
+	if w := servePortal(withSession(httptest.NewRequest(http.MethodGet, "/recovery-codes", nil), unverifiedKey)); w.Code != http.StatusNotFound {
+		t.Errorf("Unverified session returned status %d", w.Code)
+	}
+	if w := servePortal(withSession(httptest.NewRequest(http.MethodGet, "/recovery-codes", nil), freshKey)); w.Code != http.StatusOK || isReauthPage(w) {
+		t.Errorf("Confirmation page returned status %d", w.Code)
+	}
+	if w := serveForm("/recovery-codes", freshKey, url.Values{}); w.Code != http.StatusForbidden {
+		t.Errorf("Request without a CSRF token returned status %d", w.Code)
+	}
+	if w := serveForm("/recovery-codes", staleKey, url.Values{csrfFieldName: {stale.CSRF}}); !isReauthPage(w) {
+		t.Errorf("Stale session wasn't asked to reauthenticate, status %d", w.Code)
+	}
+	if saved, err := user.FromDB("alice"); err != nil || !reflect.DeepEqual(saved.RecoveryCodes, u.RecoveryCodes) {
+		t.Fatalf("Recovery codes were replaced by a refused request")
+	}
+
+	w := serveForm("/recovery-codes", freshKey, url.Values{csrfFieldName: {fresh.CSRF}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Regeneration returned status %d", w.Code)
+	}
+	saved, err := user.FromDB("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.RecoveryCodes) != user.RecoveryCodeCount || reflect.DeepEqual(saved.RecoveryCodes, u.RecoveryCodes) {
+		t.Errorf("Recovery codes weren't replaced")
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/store"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ClockReferenceURL is fetched by Diagnose to compare this machine's clock with the Date header of the response. Any
+// HTTP server with an accurate clock will do.
+var ClockReferenceURL string
+
+// MaxClockSkew is the largest difference from the reference clock Diagnose accepts. TOTP codes change every 30
+// seconds and one step either side is allowed, so a clock much further out than this rejects valid codes.
+var MaxClockSkew = 15 * time.Second
+
+// Diagnose loads the configured files as Run would and runs the health checks against them, along with checks of the
+// configuration, file permissions, certificate chains and the clock. It's used by the doctor command, and unlike the
+// health endpoints each check's Message says what to do about any problem.
+func Diagnose() []Check {
+	checks := diagnoseConfig()
+	checks = append(checks, diagnosePermissions()...)
+	checks = append(checks, checkDatabase())
+
+	var loaded *cert.CA
+	if CACertPath != "" {
+		c, err := loadCA()
+		if err != nil {
+			checks = append(checks, failed("CA", "Can't load the CA: %s", err))
+		} else {
+			loaded = c
+			checks = append(checks, checkCA(c), diagnoseCAChain(c))
+			if _, err := newOCSPResponder(c); err != nil {
+				checks = append(checks, failed("OCSP responder", "%s. Check --ocsp-cert and --ocsp-key, or unset "+
+					"them to sign OCSP responses with the CA.", err))
+			}
+		}
+	} else {
+		checks = append(checks, checkCA(nil))
+	}
+
+	if !ProxyMode && !acmeEnabled() {
+		if err := loadPortalCertificate(); err != nil {
+			checks = append(checks, failed("portal certificate", "%s. Check that %s and %s exist, match each other "+
+				"and are current.", err, CertPath, KeyPath))
+		} else {
+			checks = append(checks, checkPortalCertificate(), diagnosePortalChain(loaded))
+		}
+	} else {
+		checks = append(checks, checkPortalCertificate())
+	}
+
+	return append(checks, diagnoseClock(loaded))
+}
+
+// diagnoseConfig checks that the settings make sense together and that the files they name can be read.
+func diagnoseConfig() []Check {
+	var checks []Check
+	problem := func(format string, args ...interface{}) {
+		checks = append(checks, failed("configuration", format, args...))
+	}
+	if ProxyMode && acmeEnabled() {
+		problem("--proxy and --acme-domain can't be used together, since the proxy terminates TLS. Remove one.")
+	}
+	if err := parseTrustedProxies(); err != nil {
+		problem("%s. Give each --trusted-proxy as an address or CIDR, and --forwarded-header as X-Forwarded-For or Forwarded.", err)
+	} else if ProxyMode && len(TrustedProxies) == 0 && !strings.HasPrefix(ListenAddr, unixPrefix) {
+		checks = append(checks, warning("configuration", "--proxy is set without any --trusted-proxy, so every "+
+			"client will appear to connect from the proxy's address. Add the proxy's address with --trusted-proxy."))
+	}
+	if BindSessionPrefix < 0 || BindSessionPrefix > 128 {
+		problem("--bind-session-prefix must be between 0 and 128 bits, not %d", BindSessionPrefix)
+	}
+	if CACertPath == "" && (CAKeyPath != "" || CASignerSocket != "" || PKCS11Module != "") {
+		problem("A CA key or signer is configured without --ca-cert. Add --ca-cert.")
+	}
+	if OCSPCertPath != "" && OCSPKeyPath == "" || OCSPCertPath == "" && OCSPKeyPath != "" {
+		problem("--ocsp-cert and --ocsp-key must be given together")
+	}
+	if SessionSecretPath != "" {
+		if secret, err := ioutil.ReadFile(SessionSecretPath); err != nil {
+			problem("Can't read the session secret: %s", err)
+		} else if _, err := session.NewSealer(bytes.TrimSpace(secret), SessionKeyRotation); err != nil {
+			problem("The session secret in %s can't be used: %s", SessionSecretPath, err)
+		}
+	}
+	if err := loadAPITokens(); err != nil {
+		problem("%s", err)
+	}
+	if _, err := apiTLSConfig(); err != nil {
+		problem("%s. Check --api-client-ca.", err)
+	}
+	if err := LoadTemplates(); err != nil {
+		problem("Can't load templates: %s. Fix or remove the overrides in %s.", err, TemplateDir)
+	}
+	if len(checks) == 0 {
+		checks = append(checks, passed("configuration", "Settings are consistent"))
+	}
+	return checks
+}
+
+// diagnosePermissions checks that files holding keys, secrets and the database can't be read by other users.
+func diagnosePermissions() []Check {
+	type file struct {
+		path     string
+		required bool
+	}
+	files := []file{{store.Path, false}}
+	if !ProxyMode && !acmeEnabled() {
+		files = append(files, file{KeyPath, true})
+	}
+	if CACertPath != "" && CASignerSocket == "" && PKCS11Module == "" {
+		if CAKeyPath != "" {
+			files = append(files, file{CAKeyPath, true})
+		} else {
+			// A PKCS#12 bundle holds the key as well as the certificate
+			files = append(files, file{CACertPath, true})
+		}
+	}
+	for _, path := range []string{OCSPKeyPath, SessionSecretPath, APITokensPath} {
+		if path != "" {
+			files = append(files, file{path, true})
+		}
+	}
+
+	var checks []Check
+	for _, f := range files {
+		name := "permissions of " + f.path
+		info, err := os.Stat(f.path)
+		switch {
+		case os.IsNotExist(err) && !f.required:
+			checks = append(checks, passed(name, "Doesn't exist yet, and will be created with mode 0600"))
+		case err != nil:
+			checks = append(checks, failed(name, "%s", err))
+		case info.Mode().Perm()&0077 != 0:
+			checks = append(checks, warning(name, "Mode %04o lets other users read it. Run chmod 600 %s.",
+				info.Mode().Perm(), f.path))
+		default:
+			checks = append(checks, passed(name, "Mode %04o", info.Mode().Perm()))
+		}
+	}
+	return checks
+}
+
+// diagnoseCAChain checks that the CA certificate can sign the client certificates OpenVPN will be asked to accept.
+func diagnoseCAChain(c *cert.CA) Check {
+	crt := c.Certificate()
+	if !crt.BasicConstraintsValid || !crt.IsCA {
+		return failed("CA chain", "%s isn't marked as a CA certificate, so OpenVPN will reject certificates it signs. "+
+			"Issue a CA certificate with basicConstraints CA:TRUE.", CACertPath)
+	}
+	if crt.KeyUsage != 0 && crt.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return failed("CA chain", "%s doesn't allow certificate signing. Issue a CA certificate with the keyCertSign "+
+			"key usage.", CACertPath)
+	}
+	return passed("CA chain", "%s can sign client certificates", crt.Subject.CommonName)
+}
+
+// diagnosePortalChain checks that the portal certificate is usable for a TLS server and that clients can verify it,
+// either through the system's trusted roots or by trusting the VPN CA.
+func diagnosePortalChain(c *cert.CA) Check {
+	materialMutex.RLock()
+	pc := portalCertificate
+	materialMutex.RUnlock()
+	leaf := pc.Leaf
+
+	if len(leaf.ExtKeyUsage) > 0 {
+		serverAuth := false
+		for _, u := range leaf.ExtKeyUsage {
+			serverAuth = serverAuth || u == x509.ExtKeyUsageServerAuth || u == x509.ExtKeyUsageAny
+		}
+		if !serverAuth {
+			return failed("portal chain", "%s isn't valid for TLS servers. Issue it with the serverAuth extended key "+
+				"usage.", CertPath)
+		}
+	}
+	if len(leaf.DNSNames) == 0 && len(leaf.IPAddresses) == 0 {
+		return warning("portal chain", "%s has no subject alternative names, which browsers require. Reissue it "+
+			"with the portal's host name as a DNS name.", CertPath)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range pc.Certificate[1:] {
+		if crt, err := x509.ParseCertificate(der); err == nil {
+			intermediates.AddCert(crt)
+		}
+	}
+	opts := x509.VerifyOptions{Intermediates: intermediates}
+	if _, err := leaf.Verify(opts); err == nil {
+		return passed("portal chain", "%s is trusted by this system's roots", CertPath)
+	}
+	if c != nil {
+		opts.Roots = x509.NewCertPool()
+		opts.Roots.AddCert(c.Certificate())
+		if _, err := leaf.Verify(opts); err == nil {
+			return passed("portal chain", "%s is signed by the VPN CA, so browsers must trust the CA", CertPath)
+		}
+	}
+	return warning("portal chain", "%s isn't trusted by this system's roots or signed by the VPN CA, so browsers "+
+		"will warn users about it. Include any intermediate certificates in %s, or use a publicly trusted "+
+		"certificate.", CertPath, CertPath)
+}
+
+// diagnoseClock checks this machine's clock, which TOTP codes depend on, against a reference server if one is
+// configured, and against times recorded earlier.
+func diagnoseClock(c *cert.CA) Check {
+	const advice = "TOTP codes will be rejected until it's fixed. Enable time synchronisation, e.g. with " +
+		"timedatectl set-ntp true."
+	now := time.Now()
+
+	if ClockReferenceURL != "" {
+		client := http.Client{Timeout: 10 * time.Second}
+		start := time.Now()
+		resp, err := client.Head(ClockReferenceURL)
+		if err != nil {
+			return warning("clock", "Can't reach %s to compare clocks: %s", ClockReferenceURL, err)
+		}
+		resp.Body.Close()
+		reference, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			return warning("clock", "%s didn't send a usable Date header", ClockReferenceURL)
+		}
+		// The Date header is truncated to the second and was set at some point during the request
+		local := start.Add(time.Since(start) / 2).Truncate(time.Second)
+		skew := local.Sub(reference)
+		if skew < 0 {
+			skew = -skew
+		}
+		if skew > MaxClockSkew {
+			return failed("clock", "This machine's clock is %s out from %s. %s", skew, ClockReferenceURL, advice)
+		}
+		return passed("clock", "Within %s of %s", skew, ClockReferenceURL)
+	}
+
+	if c != nil && now.Before(c.Certificate().NotBefore) {
+		return failed("clock", "This machine's clock is earlier than the CA certificate's start date. %s", advice)
+	}
+	if events, err := audit.Recent("", 1); err == nil && len(events) > 0 && events[0].Time.Sub(now) > MaxClockSkew {
+		return failed("clock", "An audit event was recorded at %s, later than this machine's clock says it is now. "+
+			"%s", events[0].Time.Format(time.RFC3339), advice)
+	}
+	return passed("clock", "No problems found. Use --clock-reference to compare with another server's clock.")
+}
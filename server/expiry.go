@@ -0,0 +1,67 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/notify"
+	"github.com/alowde/totp-ovpn/user"
+	"log"
+	"time"
+)
+
+// ExpiryWarning is how far in advance users are warned that their certificate will expire.
+var ExpiryWarning = 30 * 24 * time.Hour
+
+// ExpiryCheckInterval is how often the server looks for certificates that are about to expire. Zero disables the checks.
+var ExpiryCheckInterval = 12 * time.Hour
+
+// NotifyExpiring warns the owner of every certificate expiring within the given duration, skipping certificates whose
+// owner has already been warned. It returns the number of users successfully notified.
+func NotifyExpiring(within time.Duration, notifiers []notify.Notifier) (sent int, err error) {
+	expiring, err := cert.Expiring(within)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, v := range expiring {
+		if !v.Notified.IsZero() {
+			continue
+		}
+		u, err := user.FromDB(v.Username)
+		if err != nil {
+			// The certificate outlives its owner's account, but they can still be warned at their username
+			u = &user.User{Username: v.Username}
+		}
+		expires := v.NotAfter.Format("2 January 2006")
+		m := message(u, notify.KindExpiry, "Your VPN certificate is about to expire",
+			fmt.Sprintf("The VPN certificate with serial %s issued to %s expires on %s. Please enroll a new "+
+				"certificate before then to avoid losing access to the VPN.", v.Serial, v.Username, expires))
+		m.Data["Serial"] = v.Serial
+		m.Data["Expires"] = expires
+		if sendNotice(notifiers, "certificate.expiry_notice", m) != nil {
+			continue
+		}
+		if e := cert.MarkNotified(v.Serial); e != nil {
+			log.Printf("While marking certificate %s as notified: %s", v.Serial, e)
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// watchExpiry periodically checks for expiring certificates and notifies their owners until ctx is cancelled.
+func watchExpiry(ctx context.Context) {
+	t := time.NewTicker(ExpiryCheckInterval)
+	defer t.Stop()
+	for {
+		if _, err := NotifyExpiring(ExpiryWarning, Notifiers); err != nil {
+			log.Printf("While checking for expiring certificates: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/asdine/storm"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Statuses of a health check. A warning doesn't make the server unhealthy, but needs attention before it does.
+const (
+	StatusOK   = "ok"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+)
+
+// Check is the outcome of a single health check. Message says what was found and, for a warning or failure, what to do
+// about it. It's only shown by the doctor command, since it can include file paths and error details.
+type Check struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"-"`
+}
+
+func passed(name, format string, args ...interface{}) Check {
+	return Check{name, StatusOK, fmt.Sprintf(format, args...)}
+}
+
+func warning(name, format string, args ...interface{}) Check {
+	return Check{name, StatusWarn, fmt.Sprintf(format, args...)}
+}
+
+func failed(name, format string, args ...interface{}) Check {
+	return Check{name, StatusFail, fmt.Sprintf(format, args...)}
+}
+
+// worst returns the most severe status of a set of checks.
+func worst(checks []Check) string {
+	status := StatusOK
+	for _, c := range checks {
+		switch c.Status {
+		case StatusFail:
+			return StatusFail
+		case StatusWarn:
+			status = StatusWarn
+		}
+	}
+	return status
+}
+
+// CertExpiryWarning is how long before the portal or CA certificate expires that health checks warn about it.
+var CertExpiryWarning = 14 * 24 * time.Hour
+
+// draining is set once the server starts shutting down, so that load balancers stop sending it new requests.
+var draining atomic.Bool
+
+func checkDatabase() Check {
+	db, err := store.Open()
+	if err != nil {
+		return failed("database", "Can't open %s: %s. Check that it's writable by this user and that no other "+
+			"process is holding it open.", store.Path, err)
+	}
+	defer db.Close()
+
+	if _, err := db.Count(&user.User{}); err != nil && err != storm.ErrNotFound {
+		return failed("database", "Can't read users from %s: %s. The file may be damaged; restore it from a backup.",
+			store.Path, err)
+	}
+	return passed("database", "%s is readable", store.Path)
+}
+
+// checkCA proves that the CA key is usable by making a test signature.
+func checkCA(c *cert.CA) Check {
+	if c == nil {
+		if CACertPath == "" {
+			return passed("CA", "Not configured, so certificates can't be issued")
+		}
+		return failed("CA", "%s hasn't been loaded", CACertPath)
+	}
+	if err := c.SelfTest(); err != nil {
+		return failed("CA", "Test signature failed: %s. Check that the CA key or signer matches %s and is "+
+			"reachable.", err, CACertPath)
+	}
+	return checkExpiry("CA", c.Certificate(), "Issue a new CA certificate and distribute it to VPN clients")
+}
+
+// checkExpiry warns about a certificate that expires within CertExpiryWarning and fails one that isn't valid now.
+func checkExpiry(name string, c *x509.Certificate, renew string) Check {
+	now := time.Now()
+	switch {
+	case now.After(c.NotAfter):
+		return failed(name, "Expired on %s. %s.", c.NotAfter.Format(time.RFC3339), renew)
+	case now.Before(c.NotBefore):
+		return failed(name, "Not valid until %s. If that's in the past, this machine's clock is wrong.",
+			c.NotBefore.Format(time.RFC3339))
+	case c.NotAfter.Sub(now) < CertExpiryWarning:
+		return warning(name, "Expires in %d days on %s. %s soon.", int(c.NotAfter.Sub(now).Hours()/24),
+			c.NotAfter.Format(time.RFC3339), renew)
+	}
+	return passed(name, "Valid until %s", c.NotAfter.Format(time.RFC3339))
+}
+
+func checkPortalCertificate() Check {
+	switch {
+	case ProxyMode:
+		return passed("portal certificate", "Served by the reverse proxy")
+	case acmeEnabled():
+		return passed("portal certificate", "Obtained from %s", ACMEDirectoryURL)
+	}
+	materialMutex.RLock()
+	c := portalCertificate
+	materialMutex.RUnlock()
+	if c == nil {
+		return failed("portal certificate", "%s hasn't been loaded", CertPath)
+	}
+	return checkExpiry("portal certificate", c.Leaf, "Replace "+CertPath+", which is reloaded automatically")
+}
+
+// healthChecks checks the running server's database, CA and portal certificate.
+func healthChecks() []Check {
+	return []Check{checkDatabase(), checkCA(currentCA()), checkPortalCertificate()}
+}
+
+// writeChecks responds with the status of a set of checks, failing the request if any check failed.
+func writeChecks(w http.ResponseWriter, checks []Check) {
+	status := worst(checks)
+	logFailures(checks)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status == StatusFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(struct {
+		Status string  `json:"status"`
+		Checks []Check `json:"checks"`
+	}{status, checks})
+}
+
+// loggedFailures holds the message last logged for each failing check, so that a failure is logged when it starts or
+// changes rather than on every probe.
+var loggedFailures = struct {
+	sync.Mutex
+	messages map[string]string
+}{messages: make(map[string]string)}
+
+func logFailures(checks []Check) {
+	loggedFailures.Lock()
+	defer loggedFailures.Unlock()
+	for _, c := range checks {
+		if c.Status != StatusFail {
+			delete(loggedFailures.messages, c.Name)
+			continue
+		}
+		if loggedFailures.messages[c.Name] != c.Message {
+			log.Printf("Health check %s failed: %s", c.Name, c.Message)
+			loggedFailures.messages[c.Name] = c.Message
+		}
+	}
+}
+
+// healthz reports whether the server can do its job: reach the database, sign certificates and present a valid
+// certificate.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	writeChecks(w, healthChecks())
+}
+
+// readyz is healthz, but also fails once the server has started shutting down so that it's taken out of rotation.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	checks := healthChecks()
+	if draining.Load() {
+		checks = append(checks, failed("shutdown", "The server is shutting down"))
+	}
+	writeChecks(w, checks)
+}
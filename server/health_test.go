@@ -0,0 +1,124 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"github.com/alowde/totp-ovpn/store"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckExpiry(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		notBefore  time.Time
+		notAfter   time.Time
+		wantStatus string
+	}{
+		{"valid", now.Add(-time.Hour), now.Add(90 * 24 * time.Hour), StatusOK},
+		{"expiring", now.Add(-time.Hour), now.Add(24 * time.Hour), StatusWarn},
+		{"expired", now.Add(-2 * time.Hour), now.Add(-time.Hour), StatusFail},
+		{"not yet valid", now.Add(time.Hour), now.Add(90 * 24 * time.Hour), StatusFail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := checkExpiry("test", &x509.Certificate{NotBefore: tt.notBefore, NotAfter: tt.notAfter}, "Renew it")
+			if c.Status != tt.wantStatus {
+				t.Errorf("checkExpiry() status = %s, want %s (%s)", c.Status, tt.wantStatus, c.Message)
+			}
+		})
+	}
+}
+
+func TestWriteChecks(t *testing.T) {
+	tests := []struct {
+		name     string
+		checks   []Check
+		wantCode int
+	}{
+		{"ok", []Check{passed("a", "fine")}, http.StatusOK},
+		{"warning", []Check{passed("a", "fine"), warning("b", "soon")}, http.StatusOK},
+		{"failure", []Check{warning("a", "soon"), failed("b", "broken"), passed("c", "fine")}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			writeChecks(w, tt.checks)
+			if w.Code != tt.wantCode {
+				t.Errorf("writeChecks() code = %d, want %d", w.Code, tt.wantCode)
+			}
+			var body struct {
+				Status string
+				Checks []map[string]string
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Status != worst(tt.checks) || len(body.Checks) != len(tt.checks) {
+				t.Errorf("writeChecks() body = %s", w.Body)
+			}
+			for _, c := range body.Checks {
+				if _, ok := c["Message"]; ok {
+					t.Errorf("Check message was exposed: %s", w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagnosePermissions(t *testing.T) {
+	saveMaterial(t)
+	oldPath, oldProxy := store.Path, ProxyMode
+	defer func() { store.Path, ProxyMode = oldPath, oldProxy }()
+	dir := t.TempDir()
+	CertPath, KeyPath = writeTestCertificate(t, dir)
+	store.Path, ProxyMode, CACertPath = filepath.Join(dir, "my.db"), false, ""
+
+	statuses := func() map[string]string {
+		s := make(map[string]string)
+		for _, c := range diagnosePermissions() {
+			s[c.Name] = c.Status
+		}
+		return s
+	}
+	keyCheck, dbCheck := "permissions of "+KeyPath, "permissions of "+store.Path
+	if s := statuses(); s[keyCheck] != StatusOK || s[dbCheck] != StatusOK {
+		t.Errorf("Private key and missing database weren't accepted: %v", s)
+	}
+	if err := os.Chmod(KeyPath, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s := statuses(); s[keyCheck] != StatusWarn {
+		t.Errorf("World-readable private key wasn't reported: %v", s)
+	}
+	if err := os.Remove(KeyPath); err != nil {
+		t.Fatal(err)
+	}
+	if s := statuses(); s[keyCheck] != StatusFail {
+		t.Errorf("Missing private key wasn't reported: %v", s)
+	}
+}
+
+func TestDiagnoseClock(t *testing.T) {
+	oldURL := ClockReferenceURL
+	defer func() { ClockReferenceURL = oldURL }()
+	var offset time.Duration
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(offset).UTC().Format(http.TimeFormat))
+	}))
+	defer ts.Close()
+	ClockReferenceURL = ts.URL
+
+	if c := diagnoseClock(nil); c.Status != StatusOK {
+		t.Errorf("Matching clock was reported: %s", c.Message)
+	}
+	offset = 2 * time.Minute
+	if c := diagnoseClock(nil); c.Status != StatusFail {
+		t.Errorf("Clock %s out wasn't reported", offset)
+	}
+}
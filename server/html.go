@@ -1,133 +1,135 @@
 package server
 
 import (
-	"html/template"
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/user"
 	"net/http"
 )
 
-var head = `
-<head>
-	<style>
-	h1 {
-		margin-bottom: 15px;
-		font-family: inherit;
-		font-weight: 500;
-		line-height: 1.2;
-		font-family: -apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,"Helvetica Neue",Arial,sans-serif,"Apple Color Emoji","Segoe UI Emoji","Segoe UI Symbol","Noto Color Emoji"
-    }
-	.lightbox {
-		border-style: solid;
-		border-width: 1px;
-		border-color: rgba(0,0,0,0.25);
-		margin: 0 auto;
-		width: 600px;
-		box-shadow: 0 14px 28px rgba(0,0,0,0.25), 0 10px 10px rgba(0,0,0,0.22);
-		text-align: center;
-		padding: 10px;
-        font-family: -apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,"Helvetica Neue",Arial,sans-serif,"Apple Color Emoji","Segoe UI Emoji","Segoe UI Symbol","Noto Color Emoji";
-	}
-	.inset {
-		display: inline-block; text-align: left;
-	}
-	form {
-		display: table;
-	}
-	.form-item {
-		display: table-row;
-		margin: 5px
-	}
-	.form-label {
-		display: table-cell;
-	}
-	.form-input {
-		display: table-cell;
-		margin-left: 5px;
-	}
-	</style>
-</head>
-<body>
-	<div class="lightbox">
-		<h1>{{.Title}}</h1>
-		<div class="inset">`
-
-var tail = `
-		</div>
-	</div>
-</body>
-`
-
-var qrContent = `
-<p>You can now enroll your two-factor authentication device. Use any TOTP-compliant 2FA application (such as Google
-Authenticator) to scan the below barcode and then supply a code generated from the application.</p>
-
-<div style="text-align: center;"><p><img src="/qr?user={{.User}}" /></p><div>
-
-<form action="verify-2fa" method="post" enctype="multipart/form-data">
-    <p class="form-item"><label class="form-label">Code:</label><input type="text" name="code" id="code" class="form-input"></p>
-	<p class="form-item">&nbsp;</p>
-	<p class="form-item"><input type="submit" value="Submit" name="submit" class="form-input"></p>
-</form>
-`
-
-var csrUploadContent = `
-<p>To enroll a new user you'll need the CSR generated by totp-ovpn on your workstation and a password supplied by your system administrator.<p>
-
-<form action="upload-csr" method="post" enctype="multipart/form-data">
-    <p class="form-item"><label class="form-label">CSR:</label><input type="file" name="fileToUpload" id="fileToUpload" class="form-input"></p>
-    <p class="form-item"><label class="form-label">Password:</label><input type="password" name="password" class="form-input"></p>
-	<p class="form-item">&nbsp;</p>
-	<p class="form-item"><input type="submit" value="Submit" name="submit" class="form-input"></p>
-</form>
-`
-
-var authErrorContent = `
-	The username or password entered were not valid.
-`
-
-var twofaErrorContent = `
-	The authentication code provided was not valid.
-`
-
-func renderPageQR(w http.ResponseWriter, user string) error {
-
-	params := struct {
-		Title string
-		User  string
-	}{"Enroll 2FA Device", user}
-
-	t := template.New("renderPageQR")
-	t, _ = t.Parse(head + qrContent + tail)
-	return t.Execute(w, params)
-
-}
-
-func renderPageEnrollUser(w http.ResponseWriter) error {
-
-	params := struct {
-		Title string
-	}{"Enroll a New User"}
-
-	t := template.New("renderPageEnrollUser")
-	t, _ = t.Parse(head + csrUploadContent + tail)
-	return t.Execute(w, params)
-}
-
-func renderPageAuthError(w http.ResponseWriter, message string) error {
-	params := struct {
-		Title string
-	}{"Authentication Error"}
-
-	t := template.New("renderPageAuthError")
-	t, _ = t.Parse(head + authErrorContent + tail)
-	return t.Execute(w, params)
-}
-
-func renderPage2FAFail(w http.ResponseWriter) error {
-	params := struct {
-		Title string
-	}{"Authentication Token Failed"}
-
-	t := template.New("renderPageAuthError")
-	t, _ = t.Parse(head + twofaErrorContent + tail)
-	return t.Execute(w, params)
+// The render functions below each show one page, whose template is in the templates directory under the page's name.
+// Titles are message IDs, translated along with the rest of the page into the request's language. Messages passed in
+// are shown as given, so callers translate them first.
+
+func renderPageQR(w http.ResponseWriter, r *http.Request, user string, showQR bool, csrf string) error {
+	return render(w, "qr", struct {
+		page
+		User   string
+		ShowQR bool
+	}{newPage(r, "title.qr", csrf), user, showQR})
+}
+
+func renderPageEnrollUser(w http.ResponseWriter, r *http.Request, csrf string) error {
+	return render(w, "enroll", newPage(r, "title.enroll", csrf))
+}
+
+func renderPageEnrolled(w http.ResponseWriter, r *http.Request, user string, csrf string) error {
+	return render(w, "enrolled", struct {
+		page
+		User string
+	}{newPage(r, "title.enrolled", csrf), user})
+}
+
+func renderPageReauth(w http.ResponseWriter, r *http.Request, next string, csrf string) error {
+	return render(w, "reauth", struct {
+		page
+		Next string
+	}{newPage(r, "title.reauth", csrf), next})
+}
+
+func renderPageOTPResetConfirm(w http.ResponseWriter, r *http.Request, csrf string) error {
+	return render(w, "otp-reset-confirm", newPage(r, "title.otp_reset_confirm", csrf))
+}
+
+func renderPageOTPReset(w http.ResponseWriter, r *http.Request, csrf string) error {
+	return render(w, "otp-reset", newPage(r, "title.otp_reset", csrf))
+}
+
+func renderPageLogin(w http.ResponseWriter, r *http.Request, message string, csrf string) error {
+	return render(w, "login", struct {
+		page
+		Message string
+	}{newPage(r, "title.login", csrf), message})
+}
+
+func renderPageDashboard(w http.ResponseWriter, r *http.Request, username string, certificates []dashboardCertificate, logins []user.Login, recoveryCodes int, csrf string) error {
+	return render(w, "dashboard", struct {
+		page
+		User          string
+		Certificates  []dashboardCertificate
+		Logins        []user.Login
+		RecoveryCodes int
+	}{newPage(r, "title.dashboard", csrf), username, certificates, logins, recoveryCodes})
+}
+
+func renderPageRecoveryConfirm(w http.ResponseWriter, r *http.Request, csrf string) error {
+	return render(w, "recovery-confirm", newPage(r, "title.recovery", csrf))
+}
+
+func renderPageRecoveryCodes(w http.ResponseWriter, r *http.Request, codes []string, csrf string) error {
+	return render(w, "recovery-codes", struct {
+		page
+		Codes []string
+	}{newPage(r, "title.recovery", csrf), codes})
+}
+
+func renderPageMessage(w http.ResponseWriter, r *http.Request, title string, message string, csrf string) error {
+	return render(w, "message", struct {
+		page
+		Message string
+	}{newPage(r, title, csrf), message})
+}
+
+// Error pages have no forms, so they don't need a CSRF token.
+
+func renderPageAuthError(w http.ResponseWriter, r *http.Request, message string) error {
+	return render(w, "auth-error", struct {
+		page
+		Message string
+	}{newPage(r, "title.auth_error", ""), message})
+}
+
+func renderPage2FAFail(w http.ResponseWriter, r *http.Request) error {
+	return render(w, "2fa-fail", newPage(r, "title.2fa_fail", ""))
+}
+
+// adminAction holds the parameters for a single user action button on the admin users page.
+type adminAction struct {
+	CSRF, User, Action, Label string
+}
+
+func renderPageAdminLogin(w http.ResponseWriter, r *http.Request, message string, csrf string) error {
+	return render(w, "admin-login", struct {
+		page
+		Message string
+	}{newPage(r, "title.admin_login", csrf), message})
+}
+
+func renderPageAdminUsers(w http.ResponseWriter, r *http.Request, users []adminUserRow, csrf string) error {
+	return render(w, "admin-users", struct {
+		page
+		Users []adminUserRow
+	}{newPage(r, "title.admin_users", csrf), users})
+}
+
+func renderPageAdminPassword(w http.ResponseWriter, r *http.Request, title string, user string, password string, csrf string) error {
+	return render(w, "admin-password", struct {
+		page
+		User     string
+		Password string
+	}{newPage(r, title, csrf), user, password})
+}
+
+func renderPageAdminCertificates(w http.ResponseWriter, r *http.Request, certificates []adminIssuedRow, csrf string) error {
+	return render(w, "admin-certificates", struct {
+		page
+		Certificates []adminIssuedRow
+	}{newPage(r, "title.admin_certificates", csrf), certificates})
+}
+
+func renderPageAdminAudit(w http.ResponseWriter, r *http.Request, username string, events []audit.Event, csrf string) error {
+	return render(w, "admin-audit", struct {
+		page
+		User   string
+		Events []audit.Event
+	}{newPage(r, "title.admin_audit", csrf), username, events})
 }
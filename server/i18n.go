@@ -0,0 +1,206 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultLanguage is used when a request doesn't ask for any language we have a catalog for, and for any message
+// missing from another language's catalog.
+var DefaultLanguage = "en"
+
+// langCookieName remembers a language chosen with the lang query parameter.
+const langCookieName = "totp-ovpn-lang"
+
+//go:embed locales/*.json
+var defaultCatalogs embed.FS
+
+// catalogs maps a language code to its messages, keyed by message ID. Messages are fmt format strings.
+var catalogs = mustParseCatalogs()
+
+func mustParseCatalogs() map[string]map[string]string {
+	sub, err := fs.Sub(defaultCatalogs, "locales")
+	if err != nil {
+		panic(err)
+	}
+	c, err := parseCatalogs(sub, nil)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// parseCatalogs reads a catalog from each JSON file in fsys, named for its language code. Messages in override's
+// catalogs replace those of the same ID, and override may add new languages.
+func parseCatalogs(fsys fs.FS, override fs.FS) (map[string]map[string]string, error) {
+	result := make(map[string]map[string]string)
+	for _, source := range []fs.FS{fsys, override} {
+		if source == nil {
+			continue
+		}
+		matches, err := fs.Glob(source, "*.json")
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			raw, err := fs.ReadFile(source, m)
+			if err != nil {
+				return nil, errors.Wrapf(err, "while reading catalog %s", m)
+			}
+			var messages map[string]string
+			if err := json.Unmarshal(raw, &messages); err != nil {
+				return nil, errors.Wrapf(err, "while parsing catalog %s", m)
+			}
+			lang := strings.ToLower(strings.TrimSuffix(m, path.Ext(m)))
+			if result[lang] == nil {
+				result[lang] = make(map[string]string)
+			}
+			for id, text := range messages {
+				result[lang][id] = text
+			}
+		}
+	}
+	if _, ok := result[DefaultLanguage]; !ok {
+		return nil, errors.Errorf("no catalog for default language %s", DefaultLanguage)
+	}
+	return result, nil
+}
+
+// T returns the message with the given ID in lang, formatted with args. Messages missing from lang's catalog are taken
+// from DefaultLanguage's, and an unknown ID is returned as is so that a missing translation is obvious but harmless.
+func T(lang, id string, args ...interface{}) string {
+	text, ok := catalogs[lang][id]
+	if !ok {
+		if text, ok = catalogs[DefaultLanguage][id]; !ok {
+			return id
+		}
+	}
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// translateError returns the translated message for an error that carries a message ID, as errors from the cert and
+// user packages do. Other errors are shown as the message with ID fallback, rather than exposing Go error text.
+func translateError(lang string, err error, fallback string) string {
+	cause := errors.Cause(err)
+	m, ok := cause.(interface{ MessageID() string })
+	if !ok {
+		return T(lang, fallback)
+	}
+	if a, ok := cause.(interface{ MessageArgs() []interface{} }); ok {
+		return T(lang, m.MessageID(), a.MessageArgs()...)
+	}
+	return T(lang, m.MessageID())
+}
+
+// requestLanguage picks the language to show a request in: one chosen with the lang query parameter or remembered in
+// a cookie, otherwise the best match for the browser's Accept-Language header.
+func requestLanguage(r *http.Request) string {
+	if lang, ok := knownLanguage(r.URL.Query().Get("lang")); ok {
+		return lang
+	}
+	if c, err := r.Cookie(langCookieName); err == nil {
+		if lang, ok := knownLanguage(c.Value); ok {
+			return lang
+		}
+	}
+	if lang, ok := negotiateLanguage(r.Header.Get("Accept-Language")); ok {
+		return lang
+	}
+	return DefaultLanguage
+}
+
+// knownLanguage returns the catalog matching a language tag, falling back from a regional tag such as de-AT to its
+// base language.
+func knownLanguage(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return "", false
+	}
+	if _, ok := catalogs[tag]; ok {
+		return tag, true
+	}
+	if i := strings.IndexByte(tag, '-'); i > 0 {
+		if _, ok := catalogs[tag[:i]]; ok {
+			return tag[:i], true
+		}
+	}
+	return "", false
+}
+
+// negotiateLanguage returns the known language the Accept-Language header prefers most.
+func negotiateLanguage(header string) (string, bool) {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		w := weighted{strings.TrimSpace(fields[0]), 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+				if err != nil {
+					q = 0
+				}
+				w.q = q
+			}
+		}
+		if w.tag != "" && w.tag != "*" && w.q > 0 {
+			tags = append(tags, w)
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	for _, w := range tags {
+		if lang, ok := knownLanguage(w.tag); ok {
+			return lang, true
+		}
+	}
+	return "", false
+}
+
+// withLanguage remembers a language chosen with the lang query parameter in a cookie, so that it applies to every
+// later page.
+func withLanguage(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lang, ok := knownLanguage(r.URL.Query().Get("lang")); ok {
+			http.SetCookie(w, &http.Cookie{
+				Name:     langCookieName,
+				Value:    lang,
+				Path:     "/",
+				MaxAge:   365 * 24 * 60 * 60,
+				HttpOnly: true,
+				Secure:   requestSecure(r),
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// language is an entry in the language switcher shown on every page.
+type language struct {
+	Code, Name string
+}
+
+// languages returns every language with a catalog, ordered by code.
+func languages() []language {
+	result := make([]language, 0, len(catalogs))
+	for code := range catalogs {
+		result = append(result, language{code, T(code, "language.name")})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Code < result[j].Code })
+	return result
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/pkg/errors"
+	"io/fs"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestRequestLanguage(t *testing.T) {
+	tests := []struct {
+		query, cookie, accept string
+		want                  string
+	}{
+		{"", "", "", "en"},
+		{"", "", "de-DE,de;q=0.9,en;q=0.8", "de"},
+		{"", "", "en;q=0.5, fr-CA", "fr"},
+		{"", "", "ja, es;q=0.9", "en"},
+		{"", "", "fr;q=0, de;q=0.1", "de"},
+		{"", "fr", "de", "fr"},
+		{"de", "fr", "en", "de"},
+		{"xx", "", "fr", "fr"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/?lang="+test.query, nil)
+		if test.cookie != "" {
+			r.Header.Set("Cookie", langCookieName+"="+test.cookie)
+		}
+		r.Header.Set("Accept-Language", test.accept)
+		if got := requestLanguage(r); got != test.want {
+			t.Errorf("Language for %+v was %s, expected %s", test, got, test.want)
+		}
+	}
+}
+
+func TestCatalogs(t *testing.T) {
+	for lang, messages := range catalogs {
+		for id := range catalogs[DefaultLanguage] {
+			if _, ok := messages[id]; !ok {
+				t.Errorf("Catalog %s is missing message %s", lang, id)
+			}
+		}
+		for id := range messages {
+			if _, ok := catalogs[DefaultLanguage][id]; !ok {
+				t.Errorf("Catalog %s has message %s, which %s doesn't", lang, id, DefaultLanguage)
+			}
+		}
+	}
+
+	used := regexp.MustCompile(`\.T "([^"]+)"`)
+	files, err := fs.Glob(builtinTemplates(), "*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		text, err := fs.ReadFile(builtinTemplates(), f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range used.FindAllStringSubmatch(string(text), -1) {
+			if _, ok := catalogs[DefaultLanguage][m[1]]; !ok {
+				t.Errorf("Template %s uses unknown message %s", f, m[1])
+			}
+		}
+	}
+}
+
+func TestTranslateError(t *testing.T) {
+	if got := translateError("de", user.ErrLockedOut, "error.generic"); got != catalogs["de"]["error.locked_out"] {
+		t.Errorf("Lockout was translated as %q", got)
+	}
+	if got := translateError("en", errors.Wrap(cert.InvalidNameError{}, "while parsing CSR"), "error.generic"); got != catalogs["en"]["error.invalid_name"] {
+		t.Errorf("Wrapped invalid name was translated as %q", got)
+	}
+	if got := translateError("fr", fs.ErrNotExist, "error.generic"); got != catalogs["fr"]["error.generic"] {
+		t.Errorf("Error without a message ID was translated as %q", got)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ListenAddr is the address the portal serves HTTPS on, or plain HTTP in ProxyMode. An address of the form unix:/path/to/socket listens on a unix
+// socket instead of TCP.
+var ListenAddr = ":443"
+
+// RedirectAddr is the address of a plain HTTP listener that redirects every request to HTTPS, and answers ACME HTTP-01
+// challenges if ACMEDomains is set. Leave it empty to run without one.
+var RedirectAddr = ":80"
+
+// Timeouts applied to every HTTP server, guarding against clients that hold connections open without making progress.
+var (
+	ReadHeaderTimeout = 10 * time.Second
+	ReadTimeout       = 30 * time.Second
+	WriteTimeout      = 60 * time.Second
+	IdleTimeout       = 2 * time.Minute
+)
+
+// ShutdownTimeout is how long in-flight requests are given to finish when the server is stopped.
+var ShutdownTimeout = 30 * time.Second
+
+// DrainDelay is how long the server keeps accepting requests after it's told to stop, with /readyz failing, so that a
+// load balancer can take it out of rotation before connections are refused.
+var DrainDelay time.Duration
+
+const unixPrefix = "unix:"
+
+// listen opens a listener on addr, which is either a TCP address or a unix socket path prefixed with unix:. A socket
+// file left behind by a previous run is removed first.
+func listen(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, unixPrefix) {
+		l, err := net.Listen("tcp", addr)
+		return l, errors.Wrapf(err, "while listening on %s", addr)
+	}
+
+	path := strings.TrimPrefix(addr, unixPrefix)
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrapf(err, "while removing stale socket %s", path)
+		}
+	}
+	l, err := net.Listen("unix", path)
+	return l, errors.Wrapf(err, "while listening on %s", path)
+}
+
+// newServer returns an http.Server for h with the configured timeouts.
+func newServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ConnContext:       markUnixPeer,
+		ReadHeaderTimeout: ReadHeaderTimeout,
+		ReadTimeout:       ReadTimeout,
+		WriteTimeout:      WriteTimeout,
+		IdleTimeout:       IdleTimeout,
+	}
+}
+
+// redirectTLS sends plain HTTP requests to the same URL over HTTPS, on ListenAddr's port if that isn't the default.
+func redirectTLS(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(r.Host, "[]")
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		name = h
+	}
+	port := "443"
+	if _, p, err := net.SplitHostPort(ListenAddr); err == nil && p != "" && !strings.HasPrefix(ListenAddr, unixPrefix) {
+		port = p
+	}
+	host := net.JoinHostPort(name, port)
+	if port == "443" {
+		host = strings.TrimSuffix(host, ":443")
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+}
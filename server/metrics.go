@@ -0,0 +1,89 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/metrics"
+	"github.com/alowde/totp-ovpn/user"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"strings"
+)
+
+// MetricsAddr is the address to serve Prometheus metrics on at /metrics. They're served over plain HTTP on their own
+// listener so that they needn't be reachable wherever the portal is. Empty disables metrics.
+var MetricsAddr string
+
+// authSource is the metrics source of an authentication attempt made by a request.
+func authSource(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/"):
+		return metrics.SourceAPI
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return metrics.SourceAdmin
+	}
+	return metrics.SourceWeb
+}
+
+// passwordResult is the metrics result of a password check that returned err.
+func passwordResult(err error) string {
+	switch err {
+	case nil:
+		return metrics.ResultSuccess
+	case bcrypt.ErrMismatchedHashAndPassword:
+		return metrics.ResultInvalidPassword
+	case user.ErrLockedOut:
+		return metrics.ResultLockedOut
+	case user.ErrDisabled:
+		return metrics.ResultDisabled
+	}
+	return metrics.ResultError
+}
+
+// codeResult is the metrics result of a code check.
+func codeResult(ok bool, err error) string {
+	switch {
+	case ok:
+		return metrics.ResultSuccess
+	case err == nil:
+		return metrics.ResultInvalidCode
+	case err == user.ErrLockedOut:
+		return metrics.ResultLockedOut
+	}
+	return metrics.ResultError
+}
+
+// revokeCertificate revokes an issued certificate, counting the revocation unless it had already been revoked.
+// Certificates are counted here rather than in the cert package, since only the server's metrics are ever scraped.
+func revokeCertificate(serial string) error {
+	i, err := cert.FindIssued(serial)
+	if err != nil {
+		return err
+	}
+	if err := cert.Revoke(serial); err != nil {
+		return err
+	}
+	if !i.Revoked {
+		metrics.CertificatesRevoked.Inc()
+	}
+	return nil
+}
+
+// countAuth counts an authentication attempt made by a request. lockable is the account whose credentials were
+// checked, if any, and an attempt that failed and left it locked is also counted and audited as a lockout, and the
+// user told about it.
+func countAuth(r *http.Request, lockable interface{ Locked() bool }, username, result string) {
+	lockedOut := false
+	switch result {
+	case metrics.ResultInvalidPassword, metrics.ResultInvalidCode, metrics.ResultInvalidLogin:
+		lockedOut = lockable != nil && lockable.Locked()
+	}
+	metrics.CountAuth(authSource(r), result, lockedOut)
+	if lockedOut {
+		auditRequest(r, "lockout", username, audit.Failure, "too many failed attempts")
+		if u, ok := lockable.(*user.User); ok {
+			u, address := *u, clientAddress(r)
+			notifyInBackground(func() error { return NotifyLockedOut(&u, address, Notifiers) })
+		}
+	}
+}
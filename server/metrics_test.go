@@ -0,0 +1,59 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/metrics"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCountAuth(t *testing.T) {
+	lockouts := func(source string) float64 {
+		return testutil.ToFloat64(metrics.Lockouts.WithLabelValues(source))
+	}
+	u := &user.User{Username: "alice"}
+	web := httptest.NewRequest("POST", "/verify-2fa", nil)
+	api := httptest.NewRequest("POST", "/api/v1/enroll/verify", nil)
+
+	before := lockouts(metrics.SourceWeb)
+	countAuth(web, u, u.Username, metrics.ResultInvalidCode)
+	if lockouts(metrics.SourceWeb) != before {
+		t.Errorf("Failed attempt counted as a lockout while the user isn't locked")
+	}
+
+	u.LockedUntil = time.Now().Add(time.Minute)
+	countAuth(api, u, u.Username, metrics.ResultInvalidCode)
+	if lockouts(metrics.SourceWeb) != before || lockouts(metrics.SourceAPI) != 1 {
+		t.Errorf("Attempt that locked the user wasn't counted as an API lockout")
+	}
+	// Once locked, further attempts are refused without being checked and don't lock the user again
+	countAuth(api, u, u.Username, metrics.ResultLockedOut)
+	if lockouts(metrics.SourceAPI) != 1 {
+		t.Errorf("Attempt against a locked user was counted as another lockout")
+	}
+}
+
+func TestRevokeCertificateCount(t *testing.T) {
+	useTestDB(t)
+	saveMaterial(t)
+	CACertPath, CAKeyPath = writeTestCertificate(t, t.TempDir())
+	if err := loadCAMaterial(); err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+	serial := issueTestCertificate(t, "alice")
+
+	before := testutil.ToFloat64(metrics.CertificatesRevoked)
+	for i := 0; i < 2; i++ {
+		if err := revokeCertificate(serial); err != nil {
+			t.Fatalf("Revocation failed with error %s", err)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.CertificatesRevoked) - before; got != 1 {
+		t.Errorf("Revoking a certificate twice counted %v revocations, expected 1", got)
+	}
+	if err := revokeCertificate("00"); err == nil {
+		t.Errorf("Revoking an unknown certificate succeeded")
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/notify"
+	"github.com/alowde/totp-ovpn/user"
+	"log"
+	"time"
+)
+
+// Notifiers deliver invitations, enrollment notices, expiry warnings and lockout alerts to users. If none are
+// configured notifications are only logged.
+var Notifiers []notify.Notifier
+
+// PortalURL is the address users reach the portal at, which emails link to. They don't include a link if it's empty.
+var PortalURL string
+
+// message returns a notification of the given kind for u, with the values shared by every email template filled in.
+func message(u *user.User, kind, subject, body string) notify.Message {
+	return notify.Message{
+		Username: u.Username,
+		Email:    u.Email,
+		Kind:     kind,
+		Subject:  subject,
+		Body:     body,
+		Data:     map[string]string{"Brand": Brand.Name, "PortalURL": PortalURL},
+	}
+}
+
+// sendNotice delivers m through notifiers, recording the outcome in the audit log under action.
+func sendNotice(notifiers []notify.Notifier, action string, m notify.Message) error {
+	var detail string
+	if serial := m.Data["Serial"]; serial != "" {
+		detail = "serial " + serial
+	}
+	if len(notifiers) == 0 {
+		notifiers = []notify.Notifier{notify.Log{}}
+	}
+	if err := notify.All(notifiers, m); err != nil {
+		audit.Record(audit.Event{Action: action, User: m.Username, Outcome: audit.Error, Detail: err.Error()})
+		return err
+	}
+	audit.Record(audit.Event{Action: action, User: m.Username, Outcome: audit.Success, Detail: detail})
+	return nil
+}
+
+// NotifyInvited sends a new user their username and initial password, if they have an email address to send it to.
+// The password is only included in emails, not in other notifications.
+func NotifyInvited(u *user.User, password string, notifiers []notify.Notifier) error {
+	if u.Email == "" {
+		return nil
+	}
+	m := message(u, notify.KindInvitation, "You've been invited to the VPN",
+		fmt.Sprintf("An account named %s has been created for you on the VPN.", u.Username))
+	m.Data["Password"] = password
+	return sendNotice(notifiers, "user.invitation_notice", m)
+}
+
+// NotifyEnrolled tells a user that a certificate was issued to them, so that they notice if it wasn't them.
+func NotifyEnrolled(u *user.User, serial string, expires time.Time, address string, notifiers []notify.Notifier) error {
+	m := message(u, notify.KindEnrolled, "A VPN certificate was issued to you",
+		fmt.Sprintf("A VPN certificate with serial %s was issued to %s. It expires on %s.", serial, u.Username,
+			expires.Format("2 January 2006")))
+	m.Data["Serial"] = serial
+	m.Data["Expires"] = expires.Format("2 January 2006")
+	m.Data["Address"] = address
+	return sendNotice(notifiers, "user.enrolled_notice", m)
+}
+
+// NotifyLockedOut tells a user that their account was locked after too many failed attempts.
+func NotifyLockedOut(u *user.User, address string, notifiers []notify.Notifier) error {
+	until := u.LockedUntil.Format("2 January 2006 15:04 MST")
+	m := message(u, notify.KindLockout, "Your VPN account has been locked",
+		fmt.Sprintf("The VPN account %s was locked after too many failed login attempts until %s.", u.Username, until))
+	m.Data["Until"] = until
+	m.Data["Address"] = address
+	return sendNotice(notifiers, "user.lockout_notice", m)
+}
+
+// notifyInBackground runs a notification without holding up the response, since mail servers can be slow.
+func notifyInBackground(send func() error) {
+	go func() {
+		if err := send(); err != nil {
+			log.Printf("While sending notification: %s", err)
+		}
+	}()
+}
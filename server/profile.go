@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/pem"
+	"fmt"
+	"github.com/alowde/totp-ovpn/cert"
+	"net/http"
+	"text/template"
+)
+
+// VPNRemote is the remote line written to downloaded OpenVPN profiles, e.g. "vpn.example.com 1194 udp".
+var VPNRemote = "localhost 1194 udp"
+
+var profileTemplate = template.Must(template.New("profile").Parse(`client
+dev tun
+nobind
+persist-key
+persist-tun
+remote {{.Remote}}
+remote-cert-tls server
+auth-user-pass
+# The private key generated alongside your CSR
+key {{.User}}.key
+<ca>
+{{.CA}}</ca>
+<cert>
+{{.Cert}}</cert>
+`))
+
+// downloadProfile returns an OpenVPN client profile containing the certificate chosen as for downloadCertificate.
+func downloadProfile(w http.ResponseWriter, r *http.Request) {
+	s, _, ok := currentSession(w, r)
+	ca := currentCA()
+	if !ok || ca == nil {
+		http.Error(w, "nope", http.StatusNotFound)
+		return
+	}
+
+	der, ok := sessionCertificate(s, r)
+	if !ok {
+		http.Error(w, "nope", http.StatusNotFound)
+		return
+	}
+	writeProfile(w, ca, s.User, der)
+}
+
+// writeProfile writes a profile for a certificate issued by ca. The caller passes the CA it checked rather than reading
+// it again, since it can be reloaded at any time.
+func writeProfile(w http.ResponseWriter, ca *cert.CA, username string, der []byte) {
+	params := struct {
+		Remote string
+		User   string
+		CA     string
+		Cert   string
+	}{
+		VPNRemote,
+		username,
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate().Raw})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+
+	w.Header().Set("Content-Type", "application/x-openvpn-profile")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+".ovpn"))
+	_ = profileTemplate.Execute(w, params)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyMode serves plain HTTP on ListenAddr for a reverse proxy that terminates TLS, instead of serving HTTPS directly.
+// The redirector and ACME aren't used in this mode, and admin API client certificates can't be checked since the
+// proxy ends the TLS connection.
+var ProxyMode bool
+
+// TrustedProxies are the addresses or CIDRs of reverse proxies whose forwarding headers are believed. These headers are
+// ignored on requests from any other address. Peers connecting to a unix socket are always trusted, since they have no
+// address and only local processes can reach the socket.
+var TrustedProxies []string
+
+// ForwardedHeader is the header the trusted proxies record the client's address in, either X-Forwarded-For or
+// Forwarded. The other header is ignored, since a proxy that only sets one passes the other through from the client.
+// X-Forwarded-Proto is only read along with X-Forwarded-For.
+var ForwardedHeader = "X-Forwarded-For"
+
+var trustedNets []*net.IPNet
+
+// parseTrustedProxies parses TrustedProxies, accepting single addresses as well as CIDRs, and checks ForwardedHeader.
+func parseTrustedProxies() error {
+	switch http.CanonicalHeaderKey(ForwardedHeader) {
+	case "X-Forwarded-For", "Forwarded":
+	default:
+		return errors.Errorf("forwarded header %s isn't X-Forwarded-For or Forwarded", ForwardedHeader)
+	}
+	nets := make([]*net.IPNet, 0, len(TrustedProxies))
+	for _, p := range TrustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return errors.Errorf("invalid trusted proxy address %s", p)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return errors.Wrapf(err, "invalid trusted proxy network %s", p)
+		}
+		nets = append(nets, n)
+	}
+	trustedNets = nets
+	return nil
+}
+
+func trustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// unixPeerKey is the context key marking requests that arrived over a unix socket.
+type unixPeerKey struct{}
+
+// markUnixPeer is an http.Server ConnContext that marks connections accepted on a unix socket.
+func markUnixPeer(ctx context.Context, c net.Conn) context.Context {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if _, ok := c.(*net.UnixConn); ok {
+		return context.WithValue(ctx, unixPeerKey{}, true)
+	}
+	return ctx
+}
+
+// trustedPeer reports whether the host directly connected to us is a trusted proxy.
+func trustedPeer(r *http.Request) bool {
+	if unix, _ := r.Context().Value(unixPeerKey{}).(bool); unix {
+		return true
+	}
+	return trustedProxy(peerIP(r))
+}
+
+// peerIP returns the address of the host directly connected to us, which may be a proxy.
+func peerIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedHop is a client or proxy recorded in a forwarding header, along with the scheme it connected with if known.
+type forwardedHop struct {
+	ip    net.IP
+	proto string
+}
+
+// forwardedHops returns the hops recorded in a request's ForwardedHeader, ordered from the original client to the proxy
+// nearest to us.
+func forwardedHops(r *http.Request) []forwardedHop {
+	var hops []forwardedHop
+	if http.CanonicalHeaderKey(ForwardedHeader) == "Forwarded" {
+		for _, v := range r.Header.Values("Forwarded") {
+			for _, element := range strings.Split(v, ",") {
+				var hop forwardedHop
+				for _, pair := range strings.Split(element, ";") {
+					key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if !ok {
+						continue
+					}
+					value = strings.Trim(value, `"`)
+					switch strings.ToLower(key) {
+					case "for":
+						hop.ip = parseForwardedNode(value)
+					case "proto":
+						hop.proto = strings.ToLower(value)
+					}
+				}
+				hops = append(hops, hop)
+			}
+		}
+		return hops
+	}
+
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, node := range strings.Split(v, ",") {
+			hops = append(hops, forwardedHop{ip: parseForwardedNode(strings.TrimSpace(node))})
+		}
+	}
+	return hops
+}
+
+// parseForwardedNode parses an address as it appears in a forwarding header, with or without a port. Obfuscated and
+// unknown nodes return nil.
+func parseForwardedNode(node string) net.IP {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return net.ParseIP(node[1:end])
+		}
+		return nil
+	}
+	if ip := net.ParseIP(node); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
+
+// originHop returns the client a request came from. Forwarding headers are only followed while each hop is a trusted
+// proxy, so a client can't claim another address by sending the headers itself. It reports whether the request came
+// through a trusted proxy.
+func originHop(r *http.Request) (forwardedHop, bool) {
+	origin := forwardedHop{ip: peerIP(r)}
+	if !trustedPeer(r) {
+		return origin, false
+	}
+	hops := forwardedHops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].ip == nil {
+			break
+		}
+		origin = hops[i]
+		if !trustedProxy(origin.ip) {
+			break
+		}
+	}
+	return origin, true
+}
+
+// requestSecure reports whether the client connected over HTTPS, either directly or to a trusted proxy.
+func requestSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	origin, proxied := originHop(r)
+	if !proxied {
+		return false
+	}
+	proto := origin.proto
+	if proto == "" && http.CanonicalHeaderKey(ForwardedHeader) == "X-Forwarded-For" {
+		proto, _, _ = strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	}
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	old, oldHeader := TrustedProxies, ForwardedHeader
+	defer func() { TrustedProxies, ForwardedHeader = old, oldHeader; _ = parseTrustedProxies() }()
+	TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		header    string
+		remote    string
+		headers   map[string]string
+		want      string
+		wantHTTPS bool
+	}{
+		// Headers from an untrusted peer are ignored
+		{"X-Forwarded-For", "192.0.2.1:1234", map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https"}, "192.0.2.1", false},
+		{"X-Forwarded-For", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https"}, "198.51.100.7", true},
+		{"X-Forwarded-For", "10.0.0.2:1234", map[string]string{"X-Forwarded-Proto": "http"}, "10.0.0.2", false},
+		// A client can't hide behind an address it puts in the header itself
+		{"X-Forwarded-For", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "203.0.113.9, 198.51.100.7, 10.0.0.3"}, "198.51.100.7", false},
+		// Nor by sending the header the proxy doesn't set
+		{"X-Forwarded-For", "10.0.0.2:1234", map[string]string{"Forwarded": "for=198.51.100.7:5555", "X-Forwarded-For": "203.0.113.9"}, "203.0.113.9", false},
+		{"X-Forwarded-For", "10.0.0.2:1234", map[string]string{"Forwarded": "for=198.51.100.7;proto=https"}, "10.0.0.2", false},
+		{"Forwarded", "10.0.0.2:1234", map[string]string{"Forwarded": `for=198.51.100.7;proto=https, for="[2001:db8::1]:8080"`}, "198.51.100.7", true},
+		{"Forwarded", "[2001:db8::1]:443", map[string]string{"Forwarded": `For="[2001:db8::17]:4711";Proto=https`}, "2001:db8::17", true},
+		{"Forwarded", "10.0.0.2:1234", map[string]string{"Forwarded": "for=unknown;proto=https"}, "10.0.0.2", false},
+		{"forwarded", "10.0.0.2:1234", map[string]string{"Forwarded": "for=198.51.100.7", "X-Forwarded-For": "203.0.113.9"}, "198.51.100.7", false},
+		{"Forwarded", "10.0.0.2:1234", map[string]string{"X-Forwarded-For": "198.51.100.7", "X-Forwarded-Proto": "https"}, "10.0.0.2", false},
+	}
+	for _, test := range tests {
+		ForwardedHeader = test.header
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		if got := clientIP(r); got == nil || got.String() != test.want {
+			t.Errorf("Client for %s with %v using %s was %s, expected %s", test.remote, test.headers, test.header, got, test.want)
+		}
+		if got := requestSecure(r); got != test.wantHTTPS {
+			t.Errorf("Request from %s with %v using %s secure was %t, expected %t", test.remote, test.headers, test.header, got, test.wantHTTPS)
+		}
+	}
+
+	ForwardedHeader = "X-Real-IP"
+	if err := parseTrustedProxies(); err == nil {
+		t.Errorf("Unsupported forwarded header was accepted")
+	}
+	ForwardedHeader = "X-Forwarded-For"
+	TrustedProxies = []string{"not an address"}
+	if err := parseTrustedProxies(); err == nil {
+		t.Errorf("Invalid trusted proxy was accepted")
+	}
+}
+
+func TestUnixSocketProxy(t *testing.T) {
+	old := TrustedProxies
+	defer func() { TrustedProxies = old; _ = parseTrustedProxies() }()
+	TrustedProxies = nil
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "portal.sock")
+	l, err := listen(unixPrefix + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := make(chan string, 1)
+	srv := newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- clientIP(r).String()
+	}))
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return new(net.Dialer).DialContext(ctx, "unix", path)
+		},
+	}}
+	for _, addr := range []string{"198.51.100.7", "203.0.113.9"} {
+		r, err := http.NewRequest("GET", "http://portal/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("X-Forwarded-For", addr)
+		resp, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// Clients must be told apart, or they'd all share one rate limit
+		if got := <-clients; got != addr {
+			t.Errorf("Client behind the unix socket was %s, expected %s", got, addr)
+		}
+	}
+}
+
+func TestSecureCookie(t *testing.T) {
+	useSessionTables(t)
+	old := TrustedProxies
+	defer func() { TrustedProxies = old; _ = parseTrustedProxies() }()
+	TrustedProxies = []string{"127.0.0.1"}
+	if err := parseTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+
+	for proto, secure := range map[string]bool{"https": true, "http": false} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "127.0.0.1:4000"
+		r.Header.Set("X-Forwarded-Proto", proto)
+		w := httptest.NewRecorder()
+		setSessionCookie(w, r, "key")
+		if got := strings.Contains(w.Header().Get("Set-Cookie"), "Secure"); got != secure {
+			t.Errorf("Cookie for %s had Secure %t, expected %t", proto, got, secure)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	old := authLimiter
+	defer func() { authLimiter = old }()
+	authLimiter = newRateLimiter(3)
+
+	h := rateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	attempt := func(method, remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/login", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+	for i := 0; i < 3; i++ {
+		if w := attempt("POST", "192.0.2.1:1000"); w.Code != http.StatusOK {
+			t.Fatalf("Attempt %d was rejected with status %d", i+1, w.Code)
+		}
+	}
+	w := attempt("POST", "192.0.2.1:1001")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("Attempt over the limit returned status %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := attempt("GET", "192.0.2.1:1002"); w.Code != http.StatusOK {
+		t.Errorf("Loading a form counted towards the limit")
+	}
+	if w := attempt("POST", "192.0.2.2:1000"); w.Code != http.StatusOK {
+		t.Errorf("Another client's attempts counted towards the limit")
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthRateLimit is how many password, code and enrollment attempts each client address may make per minute, with
+// bursts of up to the same number. Zero disables the limit.
+var AuthRateLimit = 30
+
+var authLimiter *rateLimiter
+
+// rateLimiter is a token bucket per client, refilled at a steady rate up to its burst size.
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64 // tokens per second
+	burst   float64
+	clients map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		clients: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the client's bucket, returning false along with the time until the next token if it's
+// empty.
+func (l *rateLimiter) allow(client string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	b, ok := l.clients[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// Sweep periodically forgets clients whose buckets have refilled, until ctx is cancelled.
+func (l *rateLimiter) Sweep(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			l.mutex.Lock()
+			for client, b := range l.clients {
+				if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+					delete(l.clients, client)
+				}
+			}
+			l.mutex.Unlock()
+		}
+	}
+}
+
+// rateLimit rejects attempts from clients that have exceeded AuthRateLimit. Only state-changing requests count, so
+// that clients can always load the forms.
+func rateLimit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authLimiter == nil || r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var client string
+		if ip := clientIP(r); ip != nil {
+			client = ip.String()
+		}
+		if ok, wait := authLimiter.allow(client); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			if strings.HasPrefix(r.URL.Path, "/api/") {
+				apiError(w, http.StatusTooManyRequests, "too many requests")
+			} else {
+				http.Error(w, "too many requests", http.StatusTooManyRequests)
+			}
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/user"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ReauthWindow is how long a TOTP code supplied in a session authorises sensitive actions such as downloading a
+// profile or resetting two-factor authentication.
+var ReauthWindow = 5 * time.Minute
+
+// requireFreshTOTP only allows a request through if its session has supplied a TOTP code within ReauthWindow,
+// otherwise asking for a code and returning to the request's URI afterwards.
+func requireFreshTOTP(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, _, ok := currentSession(w, r)
+		if !ok || s.Step != session.StepVerified {
+			http.Error(w, "nope", http.StatusNotFound)
+			return
+		}
+		if time.Since(s.Reauthenticated) > ReauthWindow {
+			_ = renderPageReauth(w, r, r.URL.RequestURI(), s.CSRF)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// safeRedirect only allows redirects to local paths, so that the next parameter can't send users elsewhere.
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// reauthenticate accepts a TOTP code from a verified session, authorising sensitive actions for ReauthWindow.
+func reauthenticate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, u, ok := currentSession(w, r)
+	if !ok || s.Step != session.StepVerified {
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageAuthError(w, r, T(requestLanguage(r), "error.session"))
+		return
+	}
+
+	if !codeAccepted(r, "reauth", u, r.PostFormValue("code")) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPage2FAFail(w, r)
+		return
+	}
+
+	s.Reauthenticated = time.Now()
+	if err := saveSession(w, r, s); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, safeRedirect(r.PostFormValue("next")), http.StatusSeeOther)
+}
+
+// resetOTP confirms and then removes the user's enrolled TOTP device, ending all of their sessions.
+func resetOTP(w http.ResponseWriter, r *http.Request) {
+	s, u, ok := currentSession(w, r)
+	if !ok {
+		http.Error(w, "nope", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		_ = renderPageOTPResetConfirm(w, r, s.CSRF)
+		return
+	}
+
+	if err := u.Update((*user.User).ResetOTP); err != nil {
+		auditError(r, "otp.reset", u.Username, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, "otp.reset", u.Username, audit.Success, "")
+	if err := sessionTable.RevokeAll(u.Username); err != nil {
+		log.Printf("While revoking sessions for %s: %s", u.Username, err)
+	}
+	_ = renderPageOTPReset(w, r, csrfToken(r))
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/user"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSafeRedirect(t *testing.T) {
+	for next, want := range map[string]string{
+		"/profile":            "/profile",
+		"//evil.example.com":  "/",
+		"/\\evil.example.com": "/",
+		"https://example.com": "/",
+		"":                    "/",
+	} {
+		if got := safeRedirect(next); got != want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
+
+func TestRequireFreshTOTP(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+	var reached bool
+	h := requireFreshTOTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+
+	u := user.New("alice", "password")
+	tests := []struct {
+		name            string
+		step            session.Step
+		reauthenticated time.Time
+		wantCode        int
+		wantReached     bool
+	}{
+		{"not verified", session.StepAuthenticated, time.Now(), http.StatusNotFound, false},
+		{"never reauthenticated", session.StepVerified, time.Time{}, http.StatusOK, false},
+		{"reauthentication expired", session.StepVerified, time.Now().Add(-ReauthWindow - time.Second), http.StatusOK, false},
+		{"recently reauthenticated", session.StepVerified, time.Now(), http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := testSession(t, u, tt.step)
+			s.Reauthenticated = tt.reauthenticated
+			key, err := sessionTable.Save(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			reached = false
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, withSession(httptest.NewRequest(http.MethodGet, "/profile", nil), key))
+			if w.Code != tt.wantCode {
+				t.Errorf("Request returned status %d, want %d", w.Code, tt.wantCode)
+			}
+			if reached != tt.wantReached {
+				t.Errorf("Handler reached = %v, want %v", reached, tt.wantReached)
+			}
+		})
+	}
+}
+
+func TestReauthenticate(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+
+	u := user.New("alice", "password")
+	_, key := testSession(t, u, session.StepVerified)
+	k, err := otp.NewKeyFromURL(u.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.GenerateCode(k.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(code string) *httptest.ResponseRecorder {
+		form := url.Values{"code": {code}, "next": {"/profile"}}
+		r := httptest.NewRequest(http.MethodPost, "/reauth", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		reauthenticate(w, withSession(r, key))
+		return w
+	}
+
+	w := post(code)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/profile" {
+		t.Fatalf("Valid code returned status %d and location %q", w.Code, w.Header().Get("Location"))
+	}
+	if s, _ := sessionTable.Get(key); time.Since(s.Reauthenticated) > time.Minute {
+		t.Errorf("Session wasn't marked as reauthenticated")
+	}
+	if w := post(code); w.Code != http.StatusForbidden {
+		t.Errorf("Replayed code returned status %d", w.Code)
+	}
+}
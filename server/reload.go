@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/cert"
+	"github.com/pkg/errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ReloadCheckInterval is how often the portal certificate and CA files are checked for changes, which are then loaded
+// without a restart. The files are also reloaded on SIGHUP. Zero disables the checks, leaving only SIGHUP.
+var ReloadCheckInterval = time.Minute
+
+// materialMutex guards the portal certificate, CA and OCSP responder, which can be replaced while the server runs.
+var materialMutex sync.RWMutex
+
+var portalCertificate *tls.Certificate
+var ocspResponder *cert.OCSPResponder
+
+// currentCA returns the CA used to sign client certificates, or nil if signing isn't configured.
+func currentCA() *cert.CA {
+	materialMutex.RLock()
+	defer materialMutex.RUnlock()
+	return ca
+}
+
+// getCertificate is the tls.Config GetCertificate callback, so that each new connection uses the latest certificate.
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	materialMutex.RLock()
+	defer materialMutex.RUnlock()
+	if portalCertificate == nil {
+		return nil, errors.New("no portal certificate loaded")
+	}
+	return portalCertificate, nil
+}
+
+// routeOCSP serves OCSP requests POSTed to /ocsp and sent in GET paths under /ocsp/. Both are handled directly, since
+// clients don't follow a redirect from /ocsp to /ocsp/.
+func routeOCSP(mux *http.ServeMux) {
+	mux.Handle("/ocsp", http.HandlerFunc(serveOCSP))
+	mux.Handle("/ocsp/", http.HandlerFunc(serveOCSP))
+}
+
+// serveOCSP passes OCSP requests to the current responder.
+func serveOCSP(w http.ResponseWriter, r *http.Request) {
+	materialMutex.RLock()
+	responder := ocspResponder
+	materialMutex.RUnlock()
+	if responder == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	responder.ServeHTTP(w, r)
+}
+
+// loadPortalCertificate reads the portal's certificate and key from CertPath and KeyPath. A pair that doesn't match or
+// a certificate that has already expired is rejected, leaving the current certificate in place.
+func loadPortalCertificate() error {
+	c, err := tls.LoadX509KeyPair(CertPath, KeyPath)
+	if err != nil {
+		return errors.Wrap(err, "while loading portal certificate")
+	}
+	if c.Leaf == nil {
+		if c.Leaf, err = x509.ParseCertificate(c.Certificate[0]); err != nil {
+			return errors.Wrap(err, "while parsing portal certificate")
+		}
+	}
+	if time.Now().After(c.Leaf.NotAfter) {
+		return errors.Errorf("portal certificate expired on %s", c.Leaf.NotAfter.Format(time.RFC3339))
+	}
+
+	materialMutex.Lock()
+	portalCertificate = &c
+	materialMutex.Unlock()
+	return nil
+}
+
+// loadCAMaterial reads the signing CA and builds its OCSP responder, replacing the current ones only if both succeed.
+// An external signer already connected is kept, so that only the CA certificate is reread from such signers.
+func loadCAMaterial() error {
+	if CACertPath == "" {
+		return nil
+	}
+	var newCA *cert.CA
+	var err error
+	if old := currentCA(); old != nil && (CASignerSocket != "" || PKCS11Module != "") {
+		newCA, err = reloadCAFromSigner(old.Signer())
+	} else {
+		newCA, err = loadCA()
+	}
+	if err != nil {
+		return errors.Wrap(err, "while loading CA")
+	}
+	responder, err := newOCSPResponder(newCA)
+	if err != nil {
+		return errors.Wrap(err, "while creating OCSP responder")
+	}
+
+	materialMutex.Lock()
+	ca, ocspResponder = newCA, responder
+	materialMutex.Unlock()
+	return nil
+}
+
+// reloadMaterial reloads the portal certificate and CA, auditing the outcome. Material that fails to load is left as it
+// was.
+func reloadMaterial() error {
+	var failed error
+	if !acmeEnabled() && !ProxyMode {
+		if err := loadPortalCertificate(); err != nil {
+			audit.Record(audit.Event{Action: "reload.portal_certificate", Outcome: audit.Error, Detail: err.Error()})
+			failed = err
+		}
+	}
+	if err := loadCAMaterial(); err != nil {
+		audit.Record(audit.Event{Action: "reload.ca", Outcome: audit.Error, Detail: err.Error()})
+		failed = err
+	}
+	if failed == nil {
+		audit.Record(audit.Event{Action: "reload", Outcome: audit.Success})
+	}
+	return failed
+}
+
+// fileStamp identifies a version of a file well enough to notice it being replaced.
+type fileStamp struct {
+	modified time.Time
+	size     int64
+}
+
+// materialStamps returns the current stamps of every configured certificate and key file.
+func materialStamps() map[string]fileStamp {
+	stamps := make(map[string]fileStamp)
+	paths := []string{CACertPath, CAKeyPath, OCSPCertPath, OCSPKeyPath}
+	if !acmeEnabled() && !ProxyMode {
+		paths = append(paths, CertPath, KeyPath)
+	}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if fi, err := os.Stat(path); err == nil {
+			stamps[path] = fileStamp{fi.ModTime(), fi.Size()}
+		}
+	}
+	return stamps
+}
+
+func stampsChanged(a, b map[string]fileStamp) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for path, s := range a {
+		if b[path] != s {
+			return true
+		}
+	}
+	return false
+}
+
+// watchMaterial reloads the portal certificate and CA on SIGHUP, or when any of their files change, until ctx is
+// cancelled.
+func watchMaterial(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if ReloadCheckInterval > 0 {
+		t := time.NewTicker(ReloadCheckInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	stamps := materialStamps()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			if !stampsChanged(stamps, materialStamps()) {
+				continue
+			}
+		}
+		// Take the stamps before reloading, so that a file replaced again during the reload is noticed next time, but
+		// a broken file isn't retried until it changes
+		stamps = materialStamps()
+		_ = reloadMaterial()
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"github.com/alowde/totp-ovpn/cert"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// saveMaterial restores the reloadable material and its configuration when a test finishes.
+func saveMaterial(t *testing.T) {
+	certPath, keyPath, caCertPath, caKeyPath, interval := CertPath, KeyPath, CACertPath, CAKeyPath, ReloadCheckInterval
+	oldCert, oldCA, oldResponder := portalCertificate, ca, ocspResponder
+	t.Cleanup(func() {
+		CertPath, KeyPath, CACertPath, CAKeyPath, ReloadCheckInterval = certPath, keyPath, caCertPath, caKeyPath, interval
+		portalCertificate, ca, ocspResponder = oldCert, oldCA, oldResponder
+	})
+}
+
+func servedCertificate(t *testing.T) []byte {
+	c, err := getCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Certificate[0]
+}
+
+func TestReloadPortalCertificate(t *testing.T) {
+	saveMaterial(t)
+	dir := t.TempDir()
+	CertPath, KeyPath = writeTestCertificate(t, dir)
+	if err := loadPortalCertificate(); err != nil {
+		t.Fatalf("Failed to load certificate with error %s", err)
+	}
+	first := servedCertificate(t)
+
+	writeTestCertificate(t, dir)
+	if err := reloadMaterial(); err != nil {
+		t.Fatalf("Failed to reload certificate with error %s", err)
+	}
+	second := servedCertificate(t)
+	if bytes.Equal(first, second) {
+		t.Errorf("Reloaded certificate wasn't served")
+	}
+
+	if err := ioutil.WriteFile(KeyPath, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadMaterial(); err == nil {
+		t.Errorf("Invalid key was accepted")
+	}
+	if !bytes.Equal(servedCertificate(t), second) {
+		t.Errorf("Certificate was replaced by an invalid one")
+	}
+}
+
+func TestReloadCA(t *testing.T) {
+	saveMaterial(t)
+	CACertPath, CAKeyPath = writeTestCertificate(t, t.TempDir())
+	if err := loadCAMaterial(); err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+	loaded := currentCA()
+	if loaded == nil || ocspResponder == nil {
+		t.Fatalf("CA or OCSP responder wasn't loaded")
+	}
+
+	// A key belonging to a different certificate must not replace the working pair
+	_, otherKey := writeTestCertificate(t, t.TempDir())
+	raw, err := ioutil.ReadFile(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(CAKeyPath, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCAMaterial(); err == nil {
+		t.Errorf("Mismatched CA key was accepted")
+	}
+	if currentCA() != loaded {
+		t.Errorf("CA was replaced by an invalid one")
+	}
+}
+
+func TestWatchMaterial(t *testing.T) {
+	saveMaterial(t)
+	dir := t.TempDir()
+	CertPath, KeyPath = writeTestCertificate(t, dir)
+	CACertPath, CAKeyPath = "", ""
+	if err := loadPortalCertificate(); err != nil {
+		t.Fatal(err)
+	}
+	first := servedCertificate(t)
+
+	ReloadCheckInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watchMaterial(ctx)
+		close(done)
+	}()
+	// Registered after saveMaterial, so the watcher has stopped before the material is restored
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	writeTestCertificate(t, dir)
+	// Make sure the change is visible even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	for _, path := range []string{CertPath, KeyPath} {
+		if err := os.Chtimes(path, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if !bytes.Equal(servedCertificate(t), first) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Errorf("Changed certificate in %s wasn't reloaded", filepath.Base(CertPath))
+}
+
+func TestRouteOCSP(t *testing.T) {
+	saveMaterial(t)
+	CACertPath, CAKeyPath = writeTestCertificate(t, t.TempDir())
+	if err := loadCAMaterial(); err != nil {
+		t.Fatalf("Failed to load CA with error %s", err)
+	}
+	ocspResponder.Lookup = func(serial string) (*cert.Issued, error) {
+		return &cert.Issued{Serial: serial}, nil
+	}
+	mux := http.NewServeMux()
+	routeOCSP(mux)
+
+	issuer := currentCA().Certificate()
+	raw, err := ocsp.CreateRequest(issuer, issuer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := httptest.NewRequest(http.MethodPost, "/ocsp", bytes.NewReader(raw))
+	post.Header.Set("Content-Type", "application/ocsp-request")
+	get := httptest.NewRequest(http.MethodGet, "/ocsp/"+url.PathEscape(base64.StdEncoding.EncodeToString(raw)), nil)
+
+	for _, r := range []*http.Request{post, get} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %s returned status %d", r.Method, r.URL.Path, w.Code)
+			continue
+		}
+		if _, err := ocsp.ParseResponse(w.Body.Bytes(), issuer); err != nil {
+			t.Errorf("%s %s returned an invalid response: %s", r.Method, r.URL.Path, err)
+		}
+	}
+}
@@ -1,16 +1,25 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
 	"fmt"
+	"github.com/alowde/totp-ovpn/audit"
 	"github.com/alowde/totp-ovpn/cert"
+	"github.com/alowde/totp-ovpn/metrics"
 	"github.com/alowde/totp-ovpn/session"
 	"github.com/alowde/totp-ovpn/user"
+	"github.com/alowde/totp-ovpn/webhook"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
-	"os/signal"
+	"sync"
+	"time"
 )
 
 var KeyPath string = "key.pem"
@@ -18,54 +27,253 @@ var CertPath string = "cert.pem"
 
 var MaxCSRSize int64 = 10 * 1024
 
+// PersistentSessions keeps sessions in the database so that enrollments in progress survive a restart.
+var PersistentSessions bool
+
+// SessionSecretPath points to a file holding a secret shared by every replica of the portal. If set, sessions are
+// sealed into the session cookie instead of being held by the server, and PersistentSessions is ignored. Logouts and
+// revocations are recorded in the database, so replicas only honour each other's if they share it.
+var SessionSecretPath string
+
+// SessionKeyRotation is how often the key used to seal session cookies changes.
+var SessionKeyRotation = session.DefaultRotation
+
+// SessionSweepInterval is how often expired sessions are removed from the session table.
+var SessionSweepInterval = time.Minute
+
+// SlidingSessions extends a session's expiry every time it's used, rather than expiring it a fixed time after login.
+var SlidingSessions bool
+
 var sessionTable *session.SessionTable
 
-func Run() error {
+// Run serves the portal until ctx is cancelled, fails /readyz for DrainDelay, then stops accepting connections and
+// waits up to ShutdownTimeout for requests in progress to finish.
+func Run(ctx context.Context) error {
 
-	sessionTable = session.NewSessionTable(0)
+	if SessionSweepInterval <= 0 {
+		return errors.Errorf("session sweep interval of %s isn't positive", SessionSweepInterval)
+	}
 
-	// Always redirect http->https
-	go func() {
-		if err := http.ListenAndServe(":80", http.HandlerFunc(redirectTLS)); err != nil {
-			log.Fatalf("HTTP ListenAndServe error: %v", err)
+	switch {
+	case SessionSecretPath != "":
+		secret, err := ioutil.ReadFile(SessionSecretPath)
+		if err != nil {
+			return errors.Wrap(err, "while reading session secret")
+		}
+		sealer, err := session.NewSealer(bytes.TrimSpace(secret), SessionKeyRotation)
+		if err != nil {
+			return err
+		}
+		sessionTable = session.NewSealedSessionTable(0, sealer, session.NewBoltRevocations("session_revocations"))
+		adminSessions = session.NewSealedSessionTable(0, sealer, session.NewBoltRevocations("admin_session_revocations"))
+	case PersistentSessions:
+		sessionTable = session.NewSessionTableWithStore(0, session.NewBoltStore())
+		adminSessions = session.NewSessionTable(0)
+	default:
+		sessionTable = session.NewSessionTable(0)
+		adminSessions = session.NewSessionTable(0)
+	}
+
+	draining.Store(false)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go sessionTable.Sweep(ctx, SessionSweepInterval)
+	go adminSessions.Sweep(ctx, SessionSweepInterval)
+	if err := metrics.RegisterSessions("portal", sessionTable); err != nil {
+		return err
+	}
+	if err := metrics.RegisterSessions("admin", adminSessions); err != nil {
+		return err
+	}
+	if MetricsAddr != "" {
+		if err := metrics.RegisterScriptCounts(); err != nil {
+			return err
+		}
+	}
+
+	if ProxyMode && acmeEnabled() {
+		return errors.New("ACME can't be used in proxy mode, since the proxy terminates TLS")
+	}
+	if err := parseTrustedProxies(); err != nil {
+		return err
+	}
+	authLimiter = nil
+	if AuthRateLimit > 0 {
+		authLimiter = newRateLimiter(AuthRateLimit)
+		go authLimiter.Sweep(ctx, time.Minute)
+	}
+
+	mux := http.NewServeMux()
+
+	if !acmeEnabled() && !ProxyMode {
+		if err := loadPortalCertificate(); err != nil {
+			return err
 		}
+	}
+	if err := loadCAMaterial(); err != nil {
+		return err
+	}
+	if CACertPath != "" {
+		routeOCSP(mux)
+	}
+	// The watcher replaces the server's certificates and CA, so it must have stopped by the time Run returns
+	var watcher sync.WaitGroup
+	watcher.Add(1)
+	go func() {
+		defer watcher.Done()
+		watchMaterial(ctx)
+	}()
+	defer func() {
+		cancel()
+		watcher.Wait()
 	}()
 
-	http.Handle("/", http.HandlerFunc(renderEnrollUser))
-	http.Handle("/qr", http.HandlerFunc(renderQR))
-	http.Handle("/upload-csr", http.HandlerFunc(acceptCSR))
-	http.Handle("/verify-2fa", http.HandlerFunc(verify2FA))
+	if err := loadAPITokens(); err != nil {
+		return err
+	}
+	tlsConfig, err := apiTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.GetCertificate = getCertificate
+	var redirectHandler http.Handler = http.HandlerFunc(redirectTLS)
+	if acmeEnabled() {
+		m, err := newACMEManager()
+		if err != nil {
+			return err
+		}
+		tlsConfig.GetCertificate = m.GetCertificate
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+		redirectHandler = m.HTTPHandler(redirectHandler)
+	}
+
+	if err := LoadTemplates(); err != nil {
+		return errors.Wrap(err, "while loading templates")
+	}
+	if TemplateDir != "" {
+		mux.Handle("/static/", staticHandler())
+	}
+
+	if ExpiryCheckInterval > 0 {
+		go watchExpiry(ctx)
+	}
+	if len(webhook.Endpoints) > 0 {
+		go webhook.Run(ctx)
+	}
 
-	if err := http.ListenAndServeTLS(":443", CertPath, KeyPath, nil); err != nil {
+	addPortalRoutes(mux)
+	mux.Handle("/api/v1/", apiHandler())
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", readyz)
+	mux.Handle("/admin/", adminHandler())
+
+	l, err := listen(ListenAddr)
+	if err != nil {
 		return err
 	}
+	srv := newServer(metrics.Instrument(withLanguage(mux)))
+	srv.TLSConfig = tlsConfig
+	servers := []*http.Server{srv}
+	errs := make(chan error, 3)
+	if ProxyMode {
+		go func() { errs <- srv.Serve(l) }()
+	} else {
+		go func() { errs <- srv.ServeTLS(l, "", "") }()
+	}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-	<-signalChan
+	if RedirectAddr != "" && !ProxyMode {
+		rl, err := listen(RedirectAddr)
+		if err != nil {
+			_ = srv.Close()
+			return err
+		}
+		redirect := newServer(redirectHandler)
+		servers = append(servers, redirect)
+		go func() { errs <- redirect.Serve(rl) }()
+	}
+
+	if MetricsAddr != "" {
+		ml, err := listen(MetricsAddr)
+		if err != nil {
+			for _, s := range servers {
+				_ = s.Close()
+			}
+			return err
+		}
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler())
+		metricsMux.HandleFunc("/healthz", healthz)
+		metricsMux.HandleFunc("/readyz", readyz)
+		m := newServer(metricsMux)
+		servers = append(servers, m)
+		go func() { errs <- m.Serve(ml) }()
+	}
 
-	return nil
+	select {
+	case <-ctx.Done():
+		draining.Store(true)
+		select {
+		case <-time.After(DrainDelay):
+		case err = <-errs:
+		}
+	case err = <-errs:
+		draining.Store(true)
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancelShutdown()
+	for _, s := range servers {
+		if e := s.Shutdown(shutdownCtx); e != nil {
+			log.Printf("While shutting down: %s", e)
+		}
+	}
+	return err
 }
 
-func redirectTLS(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, "https://"+r.Host+r.RequestURI, http.StatusFound)
+func renderEnrollUser(w http.ResponseWriter, r *http.Request) {
+	// Users who have logged in manage their account from the dashboard instead
+	if s, ok := sessionTable.GetRequest(r); ok && s.Step == session.StepVerified && r.URL.Path == "/" {
+		http.Redirect(w, r, "/dashboard", http.StatusSeeOther)
+		return
+	}
+	_ = renderPageEnrollUser(w, r, csrfToken(r))
 }
 
-func renderEnrollUser(w http.ResponseWriter, _ *http.Request) {
-	fmt.Println(renderPageEnrollUser(w))
+// addPortalRoutes registers the pages used by people enrolling and managing their own account.
+func addPortalRoutes(mux *http.ServeMux) {
+	mux.Handle("/", csrfProtect(http.HandlerFunc(renderEnrollUser)))
+	mux.Handle("/qr", http.HandlerFunc(renderQR))
+	mux.Handle("/upload-csr", rateLimit(csrfProtect(http.HandlerFunc(acceptCSR))))
+	mux.Handle("/verify-2fa", rateLimit(csrfProtect(http.HandlerFunc(verify2FA))))
+	mux.Handle("/certificate", requireFreshTOTP(http.HandlerFunc(downloadCertificate)))
+	mux.Handle("/profile", requireFreshTOTP(http.HandlerFunc(downloadProfile)))
+	mux.Handle("/reauth", rateLimit(csrfProtect(http.HandlerFunc(reauthenticate))))
+	mux.Handle("/reset-otp", csrfProtect(requireFreshTOTP(http.HandlerFunc(resetOTP))))
+	mux.Handle("/logout", csrfProtect(http.HandlerFunc(logout)))
+	mux.Handle("/login", rateLimit(csrfProtect(http.HandlerFunc(login))))
+	mux.Handle("/dashboard", csrfProtect(http.HandlerFunc(dashboard)))
+	mux.Handle("/dashboard/revoke", csrfProtect(requireFreshTOTP(http.HandlerFunc(revokeOwnCertificate))))
+	mux.Handle("/recovery-codes", csrfProtect(requireFreshTOTP(http.HandlerFunc(regenerateRecoveryCodes))))
+	mux.Handle("/change-password", rateLimit(csrfProtect(requireFreshTOTP(http.HandlerFunc(changePassword)))))
 }
 
 // Render a QR image that encodes a user's TOTP secret
 func renderQR(w http.ResponseWriter, r *http.Request) {
-	formUser := r.URL.Query().Get("user")
-
-	if !sessionTable.ValidRequest(formUser, r) {
+	// The QR code reveals the user's TOTP secret, so it's only shown once per session and never once the user has
+	// enrolled a device
+	s, u, ok := currentSession(w, r)
+	if !ok {
 		http.Error(w, "nope", http.StatusNotFound)
 		return
 	}
-
-	u, err := user.FromDB(formUser)
-	if err != nil {
+	switch ok, err := revealSecret(s, u); {
+	case err != nil:
+		http.Error(w, "nope", http.StatusInternalServerError)
+		return
+	case !ok:
 		http.Error(w, "nope", http.StatusNotFound)
 		return
 	}
@@ -96,40 +304,182 @@ func acceptCSR(w http.ResponseWriter, r *http.Request) {
 
 	req, err := cert.NewRequestFromReader(io.Reader(file))
 	if err != nil {
-		fmt.Println(err)
+		auditRequest(r, "enroll.csr", "", audit.Failure, err.Error())
+		lang := requestLanguage(r)
+		w.WriteHeader(http.StatusBadRequest)
+		_ = renderPageAuthError(w, r, T(lang, "error.csr", translateError(lang, err, "error.invalid_csr")))
 		return
 	}
 
 	u, err := user.FromDB(req.Username)
 	if err != nil {
 		if _, ok := errors.Cause(err).(user.ErrUserNotFound); ok {
+			countAuth(r, nil, req.Username, metrics.ResultUnknownUser)
+			auditRequest(r, "enroll.csr", req.Username, audit.Failure, "unknown user")
 			w.WriteHeader(http.StatusForbidden)
-			_ = renderPageAuthError(w, "user or password invalid")
+			_ = renderPageAuthError(w, r, T(requestLanguage(r), "error.credentials"))
 			return
 		}
+		auditError(r, "enroll.csr", req.Username, err)
 		http.Error(w, "internal error", http.StatusInternalServerError)
 		return
 	}
 
-	if err := u.ValidatePassword(r.PostForm.Get("password")); err != nil {
+	err = u.CheckPassword(r.PostForm.Get("password"))
+	if err == nil && u.Disabled {
+		err = user.ErrDisabled
+	}
+	countAuth(r, u, u.Username, passwordResult(err))
+	if err != nil {
+		auditRequest(r, "enroll.csr", u.Username, audit.Failure, refusal(err))
+		message := "error.credentials"
+		if err == user.ErrLockedOut {
+			message = "error.locked_out"
+		}
 		w.WriteHeader(http.StatusForbidden)
-		_ = renderPageAuthError(w, "user or password invalid")
+		_ = renderPageAuthError(w, r, T(requestLanguage(r), message))
 		return
 	}
 
-	// User and password are OK, create a session cookie and allow the enrollment of a QR code
-	cookie := http.Cookie{
-		Name:     "totp-ovpn-session",
-		Value:    sessionTable.Add(u.Username),
-		MaxAge:   session.DefaultSessionTime,
-		HttpOnly: true,
-		Secure:   true,
+	// User and password are OK. End any session the client already holds, so that a session planted before login
+	// can't be carried through it, and create a new session holding the CSR until the user has verified their TOTP code.
+	if old, ok := sessionTable.GetRequest(r); ok {
+		_ = sessionTable.Revoke(old.ID)
+	}
+	s, _, err := sessionTable.Add(u.Username)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
 	}
-	http.SetCookie(w, &cookie)
-	_ = renderPageQR(w, u.Username)
+	s.Step = session.StepAuthenticated
+	s.Data["csr"] = req.CSR()
+	bindSession(s, r)
+	if err := saveSession(w, r, s); err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	auditRequest(r, "enroll.csr", u.Username, audit.Success, "")
+	_ = renderPageQR(w, r, u.Username, !u.Initialised, s.CSRF)
 	return
 }
 
+// verify2FA checks the TOTP code for a session that has uploaded a CSR, and if it's valid signs the pending CSR.
 func verify2FA(w http.ResponseWriter, r *http.Request) {
-	renderPage2FAFail(w)
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024)
+	_ = r.ParseMultipartForm(10 * 1024)
+
+	s, u, ok := currentSession(w, r)
+	if !ok || s.Step != session.StepAuthenticated {
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPageAuthError(w, r, T(requestLanguage(r), "error.session"))
+		return
+	}
+
+	if !codeAccepted(r, "enroll.verify", u, r.PostForm.Get("code")) {
+		w.WriteHeader(http.StatusForbidden)
+		_ = renderPage2FAFail(w, r)
+		return
+	}
+
+	req, err := issueCertificate(r, s, u)
+	if err == errNoCA {
+		http.Error(w, "certificate signing is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	// The session is now fully authenticated, so rotate it
+	s.Step = session.StepVerified
+	s.Reauthenticated = time.Now()
+	delete(s.Data, "csr")
+	s.Data["certificate"] = req.Certificate().Raw
+	s, key, err := sessionTable.Rotate(s)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, r, key)
+	_ = renderPageEnrolled(w, r, u.Username, s.CSRF)
+}
+
+var errNoCA = errors.New("certificate signing is not configured")
+
+// issueCertificate signs and records the CSR held by a session, marking the user as initialised.
+func issueCertificate(r *http.Request, s *session.Session, u *user.User) (*cert.Request, error) {
+	req, err := signSessionCSR(s)
+	if err != nil {
+		auditError(r, "certificate.issue", u.Username, err)
+		return nil, err
+	}
+	auditRequest(r, "certificate.issue", u.Username, audit.Success, "serial "+req.Serial())
+	owner, address := *u, clientAddress(r)
+	notifyInBackground(func() error {
+		return NotifyEnrolled(&owner, req.Serial(), req.Certificate().NotAfter, address, Notifiers)
+	})
+
+	if !u.Initialised {
+		if err := u.Update(func(current *user.User) error { current.Initialised = true; return nil }); err != nil {
+			auditError(r, "enroll.complete", u.Username, err)
+		}
+	}
+	return req, nil
+}
+
+func signSessionCSR(s *session.Session) (*cert.Request, error) {
+	ca := currentCA()
+	if ca == nil {
+		return nil, errNoCA
+	}
+	req, err := cert.NewRequestFromReader(bytes.NewReader(s.Data["csr"]))
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.SignRequest(req); err != nil {
+		return nil, errors.Wrap(err, "while signing certificate")
+	}
+	if err := cert.Record(req); err != nil {
+		return nil, errors.Wrap(err, "while recording certificate")
+	}
+	metrics.CertificatesIssued.Inc()
+	return req, nil
+}
+
+// downloadCertificate returns the certificate issued during a session, or one of the user's certificates chosen with
+// ?serial=, as a PEM file.
+func downloadCertificate(w http.ResponseWriter, r *http.Request) {
+	s, _, ok := currentSession(w, r)
+	if !ok || s.Step != session.StepVerified {
+		http.Error(w, "nope", http.StatusNotFound)
+		return
+	}
+	der, ok := sessionCertificate(s, r)
+	if !ok {
+		http.Error(w, "nope", http.StatusNotFound)
+		return
+	}
+	writeCertificate(w, s.User, der)
+}
+
+// sessionCertificate returns the DER encoding of the certificate a request asks for: one of the session user's
+// unrevoked certificates if ?serial= is given, otherwise the certificate issued during the session.
+func sessionCertificate(s *session.Session, r *http.Request) ([]byte, bool) {
+	serial := r.URL.Query().Get("serial")
+	if serial == "" {
+		der, ok := s.Data["certificate"]
+		return der, ok
+	}
+	i, err := cert.FindIssued(serial)
+	if err != nil || i.Username != s.User || i.Revoked {
+		return nil, false
+	}
+	return i.DER, true
+}
+
+func writeCertificate(w http.ResponseWriter, username string, der []byte) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+".crt"))
+	_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: der})
 }
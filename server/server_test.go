@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/user"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed server certificate and key to dir, returning their paths.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "portal"},
+		DNSNames:     []string{"portal"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestRunShutdown(t *testing.T) {
+	dir := t.TempDir()
+	oldCert, oldKey, oldListen, oldRedirect, oldInterval := CertPath, KeyPath, ListenAddr, RedirectAddr, ExpiryCheckInterval
+	defer func() {
+		CertPath, KeyPath, ListenAddr, RedirectAddr, ExpiryCheckInterval = oldCert, oldKey, oldListen, oldRedirect, oldInterval
+	}()
+	CertPath, KeyPath = writeTestCertificate(t, dir)
+	socket := filepath.Join(dir, "portal.sock")
+	ListenAddr, RedirectAddr, ExpiryCheckInterval = unixPrefix+socket, "", 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- Run(ctx) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	var resp *http.Response
+	var err error
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get("https://portal/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Server didn't start: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Start page returned status %d", resp.StatusCode)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned error %s after shutdown", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run didn't return after its context was cancelled")
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket wasn't removed on shutdown")
+	}
+}
+
+func TestRedirectTLS(t *testing.T) {
+	old := ListenAddr
+	defer func() { ListenAddr = old }()
+
+	tests := []struct {
+		listen, host, want string
+	}{
+		{":443", "vpn.example.com", "https://vpn.example.com/login?x=1"},
+		{":443", "vpn.example.com:80", "https://vpn.example.com/login?x=1"},
+		{":8443", "vpn.example.com:8080", "https://vpn.example.com:8443/login?x=1"},
+		{":443", "[2001:db8::1]:80", "https://[2001:db8::1]/login?x=1"},
+		{"unix:/run/portal.sock", "vpn.example.com", "https://vpn.example.com/login?x=1"},
+	}
+	for _, test := range tests {
+		ListenAddr = test.listen
+		r := httptest.NewRequest("GET", "/login?x=1", nil)
+		r.Host = test.host
+		w := httptest.NewRecorder()
+		redirectTLS(w, r)
+		if got := w.Header().Get("Location"); got != test.want {
+			t.Errorf("Redirect for %s with %s went to %s, expected %s", test.host, test.listen, got, test.want)
+		}
+	}
+}
+
+func TestRunSweepInterval(t *testing.T) {
+	old := SessionSweepInterval
+	defer func() { SessionSweepInterval = old }()
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		SessionSweepInterval = interval
+		if err := Run(context.Background()); err == nil {
+			t.Errorf("Run accepted a session sweep interval of %s", interval)
+		}
+	}
+}
+
+// useSessionTables gives a test empty in-memory portal and admin session tables.
+func useSessionTables(t *testing.T) {
+	portal, admins := sessionTable, adminSessions
+	sessionTable, adminSessions = session.NewSessionTable(0), session.NewSessionTable(0)
+	t.Cleanup(func() { sessionTable, adminSessions = portal, admins })
+}
+
+func TestSessionCookieMaxAge(t *testing.T) {
+	useSessionTables(t)
+	sessionTable = session.NewSessionTable(900)
+
+	w := httptest.NewRecorder()
+	setSessionCookie(w, httptest.NewRequest("GET", "/", nil), "key")
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge != 900 {
+		t.Errorf("Session cookie doesn't last as long as the session: %v", cookies)
+	}
+}
+
+func TestRenderQR(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+	sealer, err := session.NewSealer(make([]byte, 32), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionTable = session.NewSealedSessionTable(0, sealer, nil)
+
+	get := func(key string) int {
+		w := httptest.NewRecorder()
+		renderQR(w, withSession(httptest.NewRequest(http.MethodGet, "/qr", nil), key))
+		return w.Code
+	}
+	newSession := func() string {
+		s, _, err := sessionTable.Add("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Step = session.StepAuthenticated
+		key, err := sessionTable.Save(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	_, key := testSession(t, user.New("alice", "password"), session.StepAuthenticated)
+	if code := get(key); code != http.StatusOK {
+		t.Fatalf("QR code request returned status %d", code)
+	}
+	// The sealed cookie sent before the QR code was shown still opens, but mustn't show the secret again
+	if code := get(key); code != http.StatusNotFound {
+		t.Errorf("Replayed session was shown the QR code again, status %d", code)
+	}
+
+	if code := get(newSession()); code != http.StatusOK {
+		t.Errorf("New session wasn't shown the QR code, status %d", code)
+	}
+
+	u, err := user.FromDB("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Initialised = true
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(newSession()); code != http.StatusNotFound {
+		t.Errorf("Enrolled user was shown the QR code, status %d", code)
+	}
+}
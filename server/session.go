@@ -0,0 +1,145 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/user"
+	"log"
+	"net/http"
+	"time"
+)
+
+// saveSession stores a session and sends the session cookie, which changes on every save when sessions are sealed.
+func saveSession(w http.ResponseWriter, r *http.Request, s *session.Session) error {
+	key, err := sessionTable.Save(s)
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, r, key)
+	return nil
+}
+
+// setSessionCookie sends the session cookie, marked Secure if the client connected over HTTPS as it always will unless
+// the portal is behind a proxy.
+func setSessionCookie(w http.ResponseWriter, r *http.Request, key string) {
+	cookie := http.Cookie{
+		Name:     session.CookieName,
+		Value:    key,
+		MaxAge:   int(sessionTable.SessionTime() / time.Second),
+		HttpOnly: true,
+		Secure:   requestSecure(r),
+		SameSite: http.SameSiteStrictMode,
+	}
+	http.SetCookie(w, &cookie)
+}
+
+// currentSession returns the session belonging to a request's cookie along with its user. If sliding sessions are
+// enabled the session's expiry is extended and a fresh cookie sent.
+func currentSession(w http.ResponseWriter, r *http.Request) (*session.Session, *user.User, bool) {
+	s, ok := sessionTable.GetRequest(r)
+	if !ok {
+		return nil, nil, false
+	}
+	u, ok := checkSession(s, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	if SlidingSessions {
+		key, err := sessionTable.Refresh(s)
+		if err != nil {
+			log.Printf("While refreshing session for %s: %s", s.User, err)
+		} else {
+			setSessionCookie(w, r, key)
+		}
+	}
+	return s, u, true
+}
+
+// checkSession returns the user a session belongs to. Sessions used from a client they weren't issued to, and sessions
+// belonging to disabled users are rejected. Sessions created before the user's credentials were last reset are revoked
+// and rejected.
+func checkSession(s *session.Session, r *http.Request) (*user.User, bool) {
+	if !bindingMatches(s, r) {
+		auditRequest(r, "session.reject", s.User, audit.Failure, "used from a different client")
+		return nil, false
+	}
+
+	u, err := user.FromDB(s.User)
+	if err != nil || u.Disabled {
+		return nil, false
+	}
+
+	if s.Created.Before(u.SessionsNotBefore) {
+		if err := sessionTable.Revoke(s.ID); err != nil {
+			log.Printf("While revoking session for %s: %s", s.User, err)
+		}
+		return nil, false
+	}
+	return u, true
+}
+
+// logout ends the session belonging to the request and clears the session cookie.
+func logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s, ok := sessionTable.GetRequest(r); ok {
+		if err := sessionTable.Revoke(s.ID); err != nil {
+			auditError(r, "logout", s.User, err)
+		} else {
+			auditRequest(r, "logout", s.User, audit.Success, "")
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     session.CookieName,
+		Value:    "",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   requestSecure(r),
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// revealSecret records that a session is being shown the user's TOTP secret, returning false if the session has already
+// been shown it or isn't allowed to see it. The record is kept with the user rather than in the session, since a sealed
+// session cookie captured beforehand could otherwise be replayed to see the secret again.
+func revealSecret(s *session.Session, u *user.User) (bool, error) {
+	if s.Step != session.StepAuthenticated {
+		return false, nil
+	}
+	var ok bool
+	err := u.Update(func(current *user.User) error {
+		if ok = !current.Initialised && current.QRShownTo != s.ID; ok {
+			current.QRShownTo = s.ID
+		}
+		return nil
+	})
+	return ok && err == nil, err
+}
+
+// codeAccepted checks a TOTP code supplied by a user, counting failures towards their lockout and auditing the attempt
+// as action.
+func codeAccepted(r *http.Request, action string, u *user.User, code string) bool {
+	ok, err := u.CheckCode(code)
+	auditCode(r, action, u, ok, err)
+	return ok
+}
+
+// auditCode records the outcome of checking a user's second factor in the audit log and metrics.
+func auditCode(r *http.Request, action string, u *user.User, ok bool, err error) {
+	countAuth(r, u, u.Username, codeResult(ok, err))
+	username := u.Username
+	switch {
+	case ok:
+		auditRequest(r, action, username, audit.Success, "")
+	case err == nil:
+		auditRequest(r, action, username, audit.Failure, "invalid code")
+	case err == user.ErrLockedOut:
+		auditRequest(r, action, username, audit.Failure, refusal(err))
+	default:
+		auditError(r, action, username, err)
+	}
+}
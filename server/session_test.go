@@ -0,0 +1,74 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/session"
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/alowde/totp-ovpn/user"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// useTestDB points the store at an empty database for the duration of a test.
+func useTestDB(t *testing.T) {
+	path := store.Path
+	store.Path = filepath.Join(t.TempDir(), "test.db")
+	t.Cleanup(func() { store.Path = path })
+}
+
+// testSession saves u and returns a portal session for them at the given step, along with its key.
+func testSession(t *testing.T, u *user.User, step session.Step) (*session.Session, string) {
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s, _, err := sessionTable.Add(u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Step = step
+	key, err := sessionTable.Save(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, key
+}
+
+// withSession adds a session cookie to a request.
+func withSession(r *http.Request, key string) *http.Request {
+	r.AddCookie(&http.Cookie{Name: session.CookieName, Value: key})
+	return r
+}
+
+func TestCheckSession(t *testing.T) {
+	useTestDB(t)
+	useSessionTables(t)
+
+	u := user.New("alice", "password")
+	s, key := testSession(t, u, session.StepVerified)
+	if _, ok := checkSession(s, httptest.NewRequest(http.MethodGet, "/", nil)); !ok {
+		t.Fatalf("Valid session was rejected")
+	}
+
+	// Resetting the user's credentials ends the session
+	if err := u.ResetPassword("another password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := checkSession(s, httptest.NewRequest(http.MethodGet, "/", nil)); ok {
+		t.Errorf("Session created before a password reset was accepted")
+	}
+	if _, ok := sessionTable.Get(key); ok {
+		t.Errorf("Session created before a password reset wasn't revoked")
+	}
+
+	// Disabled users' sessions are rejected
+	u = user.New("bob", "password")
+	u.Disable()
+	s, _ = testSession(t, u, session.StepVerified)
+	if _, ok := checkSession(s, httptest.NewRequest(http.MethodGet, "/", nil)); ok {
+		t.Errorf("Session of a disabled user was accepted")
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TemplateDir optionally points to a directory overriding the portal's look. Any page template in it replaces the
+// built-in template of the same name, a branding.json file in it sets Brand, catalogs in its locales directory replace
+// or add translated messages, and files under its static directory are served from /static/ so that a logo can be
+// referenced as e.g. /static/logo.png.
+var TemplateDir string
+
+// Branding holds the company details shown on every page.
+type Branding struct {
+	Name           string `json:"name"`
+	Logo           string `json:"logo"`  // URL of a logo image
+	Color          string `json:"color"` // CSS color used for headings and borders
+	HelpText       string `json:"help_text"`
+	SupportContact string `json:"support_contact"`
+}
+
+// Brand is the branding used on every page. Values from TemplateDir's branding.json override it.
+var Brand = Branding{Name: "totp-ovpn", Color: "#212529"}
+
+//go:embed templates/*.html
+var defaultTemplates embed.FS
+
+// templates holds a parsed template set for each page, keyed by the page's file name without extension.
+var templates = mustParseTemplates()
+
+var templateFuncs = template.FuncMap{
+	"action": func(csrf, user, action, label string) adminAction {
+		return adminAction{csrf, user, action, label}
+	},
+}
+
+func builtinTemplates() fs.FS {
+	sub, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+func mustParseTemplates() map[string]*template.Template {
+	t, err := parseTemplates(builtinTemplates(), nil)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// parseTemplates parses every page in fsys, along with the shared templates in files starting with an underscore such
+// as the page layout. Files in override replace files of the same name in fsys.
+func parseTemplates(fsys fs.FS, override fs.FS) (map[string]*template.Template, error) {
+	files := make(map[string][]byte)
+	for _, source := range []fs.FS{fsys, override} {
+		if source == nil {
+			continue
+		}
+		matches, err := fs.Glob(source, "*.html")
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if files[m], err = fs.ReadFile(source, m); err != nil {
+				return nil, errors.Wrapf(err, "while reading template %s", m)
+			}
+		}
+	}
+
+	shared := template.New("").Funcs(templateFuncs)
+	for name, text := range files {
+		if strings.HasPrefix(name, "_") {
+			if _, err := shared.New(name).Parse(string(text)); err != nil {
+				return nil, errors.Wrapf(err, "while parsing template %s", name)
+			}
+		}
+	}
+	if shared.Lookup("layout") == nil {
+		return nil, errors.New("no layout template defined")
+	}
+
+	result := make(map[string]*template.Template)
+	for name, text := range files {
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		t, err := shared.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := t.New(name).Parse(string(text)); err != nil {
+			return nil, errors.Wrapf(err, "while parsing template %s", name)
+		}
+		if t.Lookup("content") == nil {
+			return nil, errors.Errorf("template %s doesn't define content", name)
+		}
+		result[strings.TrimSuffix(name, ".html")] = t
+	}
+	return result, nil
+}
+
+// LoadTemplates applies the overrides in TemplateDir, if any, returning an error if any template fails to parse so that
+// mistakes are caught at startup rather than when a page is first shown.
+func LoadTemplates() error {
+	if TemplateDir == "" {
+		return nil
+	}
+	t, err := parseTemplates(builtinTemplates(), os.DirFS(TemplateDir))
+	if err != nil {
+		return err
+	}
+	c := catalogs
+	if _, err := os.Stat(filepath.Join(TemplateDir, "locales")); err == nil {
+		sub, err := fs.Sub(defaultCatalogs, "locales")
+		if err != nil {
+			return err
+		}
+		if c, err = parseCatalogs(sub, os.DirFS(filepath.Join(TemplateDir, "locales"))); err != nil {
+			return err
+		}
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(TemplateDir, "branding.json"))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return errors.Wrap(err, "while reading branding")
+	default:
+		if err := json.Unmarshal(raw, &Brand); err != nil {
+			return errors.Wrap(err, "while parsing branding")
+		}
+	}
+
+	templates = t
+	catalogs = c
+	return nil
+}
+
+// staticHandler serves files from TemplateDir's static directory.
+func staticHandler() http.Handler {
+	return http.StripPrefix("/static/", http.FileServer(http.Dir(filepath.Join(TemplateDir, "static"))))
+}
+
+// page holds the fields every template uses. Render functions embed it alongside their own fields.
+type page struct {
+	Title string
+	CSRF  string
+	Brand Branding
+	Lang  string
+	Path  string // where the language switcher links to
+}
+
+// newPage returns the page fields for a request, with its title translated from the message ID title.
+func newPage(r *http.Request, title string, csrf string) page {
+	lang := requestLanguage(r)
+	path := r.URL.Path
+	if r.Method != http.MethodGet {
+		// Pages shown in response to a form can't be fetched again, so switch language from the start page instead
+		path = "/"
+	}
+	return page{T(lang, title), csrf, Brand, lang, path}
+}
+
+// T returns the message with the given ID in the page's language, for use in templates as {{.T "id"}}.
+func (p page) T(id string, args ...interface{}) string {
+	return T(p.Lang, id, args...)
+}
+
+// Languages lists the languages the page can be switched to.
+func (p page) Languages() []language {
+	return languages()
+}
+
+// render executes a page's template into a buffer before writing it, so that a failed page is never half sent.
+func render(w http.ResponseWriter, name string, params interface{}) error {
+	t, ok := templates[name]
+	if !ok {
+		return errors.Errorf("no template for page %s", name)
+	}
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, "layout", params); err != nil {
+		log.Printf("While rendering %s: %s", name, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, err := buf.WriteTo(w)
+	return err
+}
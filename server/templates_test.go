@@ -0,0 +1,118 @@
+package server
+
+import (
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/alowde/totp-ovpn/user"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderPages(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	pages := map[string]func(*httptest.ResponseRecorder) error{
+		"qr":                func(w *httptest.ResponseRecorder) error { return renderPageQR(w, r, "alice", true, "tok") },
+		"enroll":            func(w *httptest.ResponseRecorder) error { return renderPageEnrollUser(w, r, "tok") },
+		"enrolled":          func(w *httptest.ResponseRecorder) error { return renderPageEnrolled(w, r, "alice", "tok") },
+		"reauth":            func(w *httptest.ResponseRecorder) error { return renderPageReauth(w, r, "/profile", "tok") },
+		"otp-reset-confirm": func(w *httptest.ResponseRecorder) error { return renderPageOTPResetConfirm(w, r, "tok") },
+		"otp-reset":         func(w *httptest.ResponseRecorder) error { return renderPageOTPReset(w, r, "tok") },
+		"login":             func(w *httptest.ResponseRecorder) error { return renderPageLogin(w, r, "Try again", "tok") },
+		"recovery-confirm":  func(w *httptest.ResponseRecorder) error { return renderPageRecoveryConfirm(w, r, "tok") },
+		"recovery-codes": func(w *httptest.ResponseRecorder) error {
+			return renderPageRecoveryCodes(w, r, []string{"abcd-efgh"}, "tok")
+		},
+		"message": func(w *httptest.ResponseRecorder) error {
+			return renderPageMessage(w, r, "title.password_changed", "All done", "tok")
+		},
+		"auth-error":  func(w *httptest.ResponseRecorder) error { return renderPageAuthError(w, r, "Bad password") },
+		"2fa-fail":    func(w *httptest.ResponseRecorder) error { return renderPage2FAFail(w, r) },
+		"admin-login": func(w *httptest.ResponseRecorder) error { return renderPageAdminLogin(w, r, "", "tok") },
+		"admin-password": func(w *httptest.ResponseRecorder) error {
+			return renderPageAdminPassword(w, r, "title.admin_invited", "alice", "pw", "tok")
+		},
+		"admin-users": func(w *httptest.ResponseRecorder) error {
+			return renderPageAdminUsers(w, r, []adminUserRow{{"alice", true, false, true}}, "tok")
+		},
+		"admin-certificates": func(w *httptest.ResponseRecorder) error {
+			return renderPageAdminCertificates(w, r, []adminIssuedRow{{"ab", "alice", time.Now(), false}}, "tok")
+		},
+		"admin-audit": func(w *httptest.ResponseRecorder) error {
+			events := []audit.Event{{Time: time.Now(), Action: "login", User: "alice", IP: "192.0.2.1", Outcome: audit.Success}}
+			return renderPageAdminAudit(w, r, "alice", events, "tok")
+		},
+		"dashboard": func(w *httptest.ResponseRecorder) error {
+			return renderPageDashboard(w, r, "alice", []dashboardCertificate{{"ab", time.Now(), false, false}}, []user.Login{{Time: time.Now(), Address: "192.0.2.1"}}, 10, "tok")
+		},
+	}
+	if len(pages) != len(templates) {
+		t.Errorf("Testing %d pages but %d templates are defined", len(pages), len(templates))
+	}
+	for name, f := range pages {
+		w := httptest.NewRecorder()
+		if err := f(w); err != nil {
+			t.Errorf("Rendering %s failed with error %s", name, err)
+			continue
+		}
+		if strings.Contains(w.Body.String(), `>title.`) {
+			t.Errorf("Page %s has an untranslated title", name)
+		}
+		if strings.Contains(w.Body.String(), "<form") && !strings.Contains(w.Body.String(), `value="tok"`) {
+			t.Errorf("Page %s has a form without the CSRF token", name)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	_ = renderPageAuthError(w, r, "Bad password")
+	if !strings.Contains(w.Body.String(), "Bad password") {
+		t.Errorf("Auth error page doesn't show its message")
+	}
+}
+
+func TestTemplateOverrides(t *testing.T) {
+	builtin, brand, builtinCatalogs := templates, Brand, catalogs
+	defer func() { templates, Brand, catalogs, TemplateDir = builtin, brand, builtinCatalogs, "" }()
+	r := httptest.NewRequest("GET", "/", nil)
+
+	TemplateDir = t.TempDir()
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(TemplateDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("enroll.html", `{{define "content"}}Custom enrollment{{end}}`)
+	write("branding.json", `{"name": "Example Corp", "support_contact": "helpdesk@example.com"}`)
+	if err := os.Mkdir(filepath.Join(TemplateDir, "locales"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	write("locales/en.json", `{"common.log_in": "Sign in"}`)
+	if err := LoadTemplates(); err != nil {
+		t.Fatalf("Failed to load overrides with error %s", err)
+	}
+
+	w := httptest.NewRecorder()
+	_ = renderPageEnrollUser(w, r, "tok")
+	for _, want := range []string{"Custom enrollment", "Example Corp", "helpdesk@example.com"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Overridden page doesn't contain %q", want)
+		}
+	}
+	w = httptest.NewRecorder()
+	_ = renderPageLogin(w, r, "", "tok")
+	if !strings.Contains(w.Body.String(), `name="password"`) {
+		t.Errorf("Page without an override doesn't use the built-in template")
+	}
+	if !strings.Contains(w.Body.String(), "Sign in") || !strings.Contains(w.Body.String(), "Username") {
+		t.Errorf("Catalog override wasn't merged with the built-in catalog")
+	}
+
+	write("login.html", `{{define "content"}}{{.Missing{{end}}`)
+	if err := LoadTemplates(); err == nil {
+		t.Errorf("Broken override was accepted")
+	}
+	os.Remove(filepath.Join(TemplateDir, "login.html"))
+}
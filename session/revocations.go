@@ -0,0 +1,166 @@
+package session
+
+import (
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// Revocations is the revocation list for sealed sessions, which can't be deleted from the client. Entries are kept
+// until the revoked sessions would have expired anyway. Implementations must be safe for concurrent use.
+type Revocations interface {
+	// RevokeID revokes the session with the given ID until expires.
+	RevokeID(id string, expires time.Time) error
+	// RevokeUser revokes every session created for a user at or before before, until expires.
+	RevokeUser(user string, before, expires time.Time) error
+	// Revoked reports whether a session has been revoked.
+	Revoked(s *Session) (bool, error)
+	// DeleteExpired forgets every entry that expired before now.
+	DeleteExpired(now time.Time) error
+}
+
+// MapRevocations keeps the revocation list in memory. It's forgotten when the process exits and isn't seen by other
+// replicas.
+type MapRevocations struct {
+	mutex          sync.Mutex
+	revokedIDs     map[string]time.Time // Session ID to the time the session would have expired
+	revokedBefore  map[string]time.Time // Username to the time before which all their sessions are revoked
+	revokedExpires map[string]time.Time // Username to the time the revokedBefore entry can be forgotten
+}
+
+func NewMapRevocations() *MapRevocations {
+	return &MapRevocations{
+		revokedIDs:     make(map[string]time.Time),
+		revokedBefore:  make(map[string]time.Time),
+		revokedExpires: make(map[string]time.Time),
+	}
+}
+
+func (m *MapRevocations) RevokeID(id string, expires time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.revokedIDs[id] = expires
+	return nil
+}
+
+func (m *MapRevocations) RevokeUser(user string, before, expires time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.revokedBefore[user] = before
+	m.revokedExpires[user] = expires
+	return nil
+}
+
+func (m *MapRevocations) Revoked(s *Session) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.revokedIDs[s.ID]; ok {
+		return true, nil
+	}
+	if before, ok := m.revokedBefore[s.User]; ok && !s.Created.After(before) {
+		return true, nil
+	}
+	return false, nil
+}
+
+func (m *MapRevocations) DeleteExpired(now time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for k, v := range m.revokedIDs {
+		if now.After(v) {
+			delete(m.revokedIDs, k)
+		}
+	}
+	for k, v := range m.revokedExpires {
+		if now.After(v) {
+			delete(m.revokedBefore, k)
+			delete(m.revokedExpires, k)
+		}
+	}
+	return nil
+}
+
+// revocation is an entry in a BoltRevocations list, revoking either a single session or every session a user was issued
+// up to Before.
+type revocation struct {
+	Key     string `storm:"id"` // "id:" followed by a session ID, or "user:" followed by a username
+	Before  time.Time
+	Expires time.Time `storm:"index"`
+}
+
+// BoltRevocations keeps the revocation list in a bucket of the shared database, so that it survives a restart and is
+// seen by every replica using the same database. Like BoltStore it only holds the database open for each operation.
+type BoltRevocations struct {
+	node string
+}
+
+// NewBoltRevocations returns a revocation list held in the named bucket. Each session table needs a bucket of its own,
+// since usernames are only unique within a table.
+func NewBoltRevocations(node string) *BoltRevocations {
+	return &BoltRevocations{node: node}
+}
+
+func (b BoltRevocations) put(r revocation) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Times are compared as encoded in the index, so they must all be in the same zone
+	r.Before, r.Expires = r.Before.UTC(), r.Expires.UTC()
+	if err := db.From(b.node).Save(&r); err != nil {
+		return errors.Wrap(err, "while saving session revocation")
+	}
+	return nil
+}
+
+func (b BoltRevocations) RevokeID(id string, expires time.Time) error {
+	return b.put(revocation{Key: "id:" + id, Expires: expires})
+}
+
+func (b BoltRevocations) RevokeUser(user string, before, expires time.Time) error {
+	return b.put(revocation{Key: "user:" + user, Before: before, Expires: expires})
+}
+
+func (b BoltRevocations) Revoked(s *Session) (bool, error) {
+	db, err := store.Open()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	node := db.From(b.node)
+	var r revocation
+	switch err := node.One("Key", "id:"+s.ID, &r); err {
+	case nil:
+		return true, nil
+	case storm.ErrNotFound:
+	default:
+		return false, errors.Wrap(err, "while querying session revocations")
+	}
+	switch err := node.One("Key", "user:"+s.User, &r); err {
+	case nil:
+		return !s.Created.After(r.Before), nil
+	case storm.ErrNotFound:
+		return false, nil
+	default:
+		return false, errors.Wrap(err, "while querying session revocations")
+	}
+}
+
+func (b BoltRevocations) DeleteExpired(now time.Time) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.From(b.node).Select(q.Lt("Expires", now.UTC())).Delete(&revocation{}); err != nil && err != storm.ErrNotFound {
+		return errors.Wrap(err, "while deleting expired session revocations")
+	}
+	return nil
+}
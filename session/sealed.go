@@ -0,0 +1,127 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"time"
+)
+
+const tokenVersion = 1
+
+// DefaultRotation is how often a Sealer moves to a new key by default.
+const DefaultRotation = 24 * time.Hour
+
+// Sealer encrypts and authenticates sessions so that they can be stored in the session cookie itself. Keys are derived
+// from a shared secret and the current rotation epoch, so every replica configured with the same secret seals and
+// opens with the same keys and rotates at the same moment without any coordination. Tokens sealed in the previous
+// epoch are still accepted, so a rotation doesn't end sessions early as long as the rotation period is longer than the
+// session time.
+type Sealer struct {
+	secret   []byte
+	rotation time.Duration
+}
+
+// NewSealer returns a Sealer using a secret of at least 32 bytes. If rotation isn't > 0 DefaultRotation is used.
+// Epochs are counted in whole seconds, so a rotation of less than a second is refused.
+func NewSealer(secret []byte, rotation time.Duration) (*Sealer, error) {
+	if len(secret) < 32 {
+		return nil, errors.New("session secret must be at least 32 bytes")
+	}
+	if rotation <= 0 {
+		rotation = DefaultRotation
+	}
+	if rotation < time.Second {
+		return nil, errors.Errorf("session key rotation of %s is less than a second", rotation)
+	}
+	return &Sealer{secret: secret, rotation: rotation}, nil
+}
+
+func (s *Sealer) epoch(t time.Time) uint32 {
+	return uint32(t.Unix() / int64(s.rotation/time.Second))
+}
+
+// aead derives the cipher for an epoch.
+func (s *Sealer) aead(epoch uint32) (cipher.AEAD, error) {
+	info := make([]byte, 4)
+	binary.BigEndian.PutUint32(info, epoch)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, s.secret, []byte("totp-ovpn session"), info), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal encrypts a session into a token suitable for use as a cookie value. The token is laid out as a version byte,
+// the big-endian key epoch, the GCM nonce and the sealed JSON encoding of the session.
+func (s *Sealer) Seal(sess *Session) (string, error) {
+	plain, err := json.Marshal(sess)
+	if err != nil {
+		return "", errors.Wrap(err, "while encoding session")
+	}
+
+	epoch := s.epoch(time.Now())
+	aead, err := s.aead(epoch)
+	if err != nil {
+		return "", err
+	}
+
+	header := make([]byte, 5, 5+aead.NonceSize()+len(plain)+aead.Overhead())
+	header[0] = tokenVersion
+	binary.BigEndian.PutUint32(header[1:], epoch)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	token := append(header, nonce...)
+	token = aead.Seal(token, nonce, plain, header)
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Open authenticates and decrypts a token produced by Seal in the current or previous epoch. It doesn't check whether
+// the session has expired.
+func (s *Sealer) Open(token string) (*Session, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) < 5 || raw[0] != tokenVersion {
+		return nil, errors.New("malformed session token")
+	}
+
+	epoch := binary.BigEndian.Uint32(raw[1:5])
+	if current := s.epoch(time.Now()); epoch != current && epoch+1 != current {
+		return nil, errors.New("session token sealed with a retired key")
+	}
+	aead, err := s.aead(epoch)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < 5+aead.NonceSize() {
+		return nil, errors.New("malformed session token")
+	}
+
+	nonce := raw[5 : 5+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, raw[5+aead.NonceSize():], raw[:5])
+	if err != nil {
+		return nil, errors.New("session token failed authentication")
+	}
+
+	var sess = new(Session)
+	if err := json.Unmarshal(plain, sess); err != nil {
+		return nil, errors.Wrap(err, "while decoding session")
+	}
+	if sess.Data == nil {
+		sess.Data = make(map[string][]byte)
+	}
+	return sess, nil
+}
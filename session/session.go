@@ -1,58 +1,124 @@
 package session
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
-	"fmt"
+	"log"
 	"net/http"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const DefaultSessionTime = 300 // Default session time is 300 seconds
 const sessionKeyLength = 20    // Session keys are 40 bytes
 
-type session struct {
-	key     []byte
-	expires time.Time
+// CookieName is the name of the cookie holding the session key.
+const CookieName = "totp-ovpn-session"
+
+// Step records how far through enrollment a session has progressed.
+type Step int
+
+const (
+	StepNew           Step = iota // Session created but nothing verified yet
+	StepAuthenticated             // Username and password accepted, CSR pending
+	StepVerified                  // TOTP code accepted and certificate issued
+	StepAdmin                     // Administrator logged in to the admin console
+)
+
+// Session is the state held for a user part way through enrollment. Data carries arbitrary per-step state such as
+// the pending CSR. A user may hold several sessions at once, each identified by an ID derived from its secret key so
+// that sessions can be listed and revoked without exposing the key.
+type Session struct {
+	ID      string `storm:"id"`
+	User    string `storm:"index"`
+	Key     []byte
+	Created time.Time
+	Expires time.Time `storm:"index"`
+	Step    Step
+	CSRF    string // Token that must accompany every state-changing request made with this session
+	Data    map[string][]byte
+
+	ClientIP        string    // Address of the client the session was issued to
+	UserAgent       string    // Hash of the User-Agent of the client the session was issued to
+	Reauthenticated time.Time // When the user last supplied a TOTP code in this session
 }
 
-func (s session) valid(key []byte) bool {
-	if time.Now().After(s.expires) {
+func (s Session) valid(key []byte) bool {
+	if s.expired() {
 		return false
 	}
-	if !bytes.Equal(s.key, key) {
-		return false
+	return subtle.ConstantTimeCompare(s.Key, key) == 1
+}
+
+func (s Session) expired() bool {
+	return time.Now().After(s.Expires)
+}
+
+// copy returns a deep copy of the session so that callers can't modify a stored session without calling Save.
+func (s Session) copy() *Session {
+	c := s
+	c.Data = make(map[string][]byte, len(s.Data))
+	for k, v := range s.Data {
+		c.Data[k] = append([]byte(nil), v...)
 	}
-	return true
+	return &c
 }
 
-func (s session) expired() bool {
-	return time.Now().After(s.expires)
+// idFor derives the public session ID from a session key.
+func idFor(key []byte) string {
+	sum := sha256.Sum256(key)
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
 }
 
-func newSession(duration time.Duration) (s session) {
-	s.key = make([]byte, sessionKeyLength)
-	rand.Read(s.key)
-	s.expires = time.Now().Add(duration)
+// NewToken returns a crypto-randomly generated token suitable for use in a cookie or form field.
+func NewToken() string {
+	b := make([]byte, sessionKeyLength)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func newSession(user string, duration time.Duration) (s *Session) {
+	s = &Session{User: user, Data: make(map[string][]byte)}
+	s.Key = make([]byte, sessionKeyLength)
+	rand.Read(s.Key)
+	s.ID = idFor(s.Key)
+	s.Created = time.Now()
+	s.Expires = s.Created.Add(duration)
+	s.CSRF = NewToken()
 	return
 }
 
 // SessionTable is a concurrent-safe session-handling mechanism allowing the addition and validation of users with
 // associated keys. Sessions expire after some time, 5 minutes by default.
+//
+// Sessions are either held in a Store and identified by a random key, or sealed by a Sealer into the cookie value
+// itself so that any replica sharing the secret can validate them. Sealed sessions can't be deleted from the client, so
+// they're checked against a revocation list instead.
 type SessionTable struct {
 	sessionTime time.Duration
-	sessions    map[string]session
-	mutex       *sync.Mutex
+	store       Store
+	sealer      *Sealer
+	revocations Revocations
+
+	created  uint64
+	expired  uint64
+	rejected uint64
+	revoked  uint64
 }
 
-// NewSessionTable returns an initialised *SessionTable. If duration is not > 0 and < 86400 then it will be set to 300
-// seconds (five minutes) by default.
+// NewSessionTable returns an initialised *SessionTable holding sessions in memory. If duration is not > 0 and < 86400
+// then it will be set to 300 seconds (five minutes) by default.
 func NewSessionTable(duration int) *SessionTable {
+	return NewSessionTableWithStore(duration, NewMapStore())
+}
+
+// NewSessionTableWithStore is NewSessionTable with sessions held in the given store.
+func NewSessionTableWithStore(duration int, store Store) *SessionTable {
 	s := new(SessionTable)
-	s.sessions = make(map[string]session)
-	s.mutex = new(sync.Mutex)
+	s.store = store
 	s.sessionTime = DefaultSessionTime * time.Second
 	if duration > 0 && duration < 86400 {
 		s.sessionTime = time.Duration(duration) * time.Second
@@ -60,48 +126,221 @@ func NewSessionTable(duration int) *SessionTable {
 	return s
 }
 
-// Add adds a user to the session table and returns a crypto-randomly generated key.
-func (st *SessionTable) Add(user string) (key string) {
-	st.mutex.Lock()
-	st.sessions[user] = newSession(st.sessionTime)
-	st.mutex.Unlock()
-	return base64.StdEncoding.EncodeToString(st.sessions[user].key)
+// NewSealedSessionTable is NewSessionTable with sessions sealed into the cookie value instead of held by the server,
+// and checked against the given revocation list. If revocations is nil the list is only kept in memory.
+func NewSealedSessionTable(duration int, sealer *Sealer, revocations Revocations) *SessionTable {
+	s := NewSessionTableWithStore(duration, nil)
+	s.sealer = sealer
+	s.revocations = revocations
+	if s.revocations == nil {
+		s.revocations = NewMapRevocations()
+	}
+	return s
 }
 
-// Valid determines whether a user and key are associated with each other and less than sessionTime seconds old.
-func (st *SessionTable) Valid(user string, key string) bool {
-	st.ExpireOldSessions()
-	st.mutex.Lock()
-	defer st.mutex.Unlock()
-	byteKey, err := base64.StdEncoding.DecodeString(key)
+// encode returns the cookie value for a session.
+func (st *SessionTable) encode(s *Session) (string, error) {
+	if st.sealer != nil {
+		return st.sealer.Seal(s)
+	}
+	return base64.StdEncoding.EncodeToString(s.Key), nil
+}
+
+// Add creates a new session for a user, alongside any sessions they already hold, and returns it along with the key
+// to be sent to the client.
+func (st *SessionTable) Add(user string) (s *Session, key string, err error) {
+	s = newSession(user, st.sessionTime)
+	atomic.AddUint64(&st.created, 1)
+	if st.store != nil {
+		if err := st.store.Put(s); err != nil {
+			return nil, "", err
+		}
+	}
+	if key, err = st.encode(s); err != nil {
+		return nil, "", err
+	}
+	return s, key, nil
+}
+
+// Save stores changes made to a session returned by Add or Get, and returns the key to be sent to the client. The key
+// only changes when sessions are sealed, but callers should always send the returned key.
+func (st *SessionTable) Save(s *Session) (key string, err error) {
+	if st.store != nil {
+		if err := st.store.Put(s); err != nil {
+			return "", err
+		}
+	}
+	return st.encode(s)
+}
+
+// Rotate replaces a session with a new one carrying the same state but a new key, ID and CSRF token, and revokes the
+// old session. It should be called whenever a session gains privileges so that a key or token observed beforehand is
+// useless afterwards.
+func (st *SessionTable) Rotate(s *Session) (rotated *Session, key string, err error) {
+	fresh, _, err := st.Add(s.User)
 	if err != nil {
-		return false
+		return nil, "", err
+	}
+	rotated = s.copy()
+	rotated.ID, rotated.Key, rotated.CSRF = fresh.ID, fresh.Key, fresh.CSRF
+	rotated.Created, rotated.Expires = fresh.Created, fresh.Expires
+	if key, err = st.Save(rotated); err != nil {
+		return nil, "", err
+	}
+	if err := st.Revoke(s.ID); err != nil {
+		return nil, "", err
 	}
-	if session, ok := st.sessions[user]; ok {
-		if session.valid(byteKey) {
-			return true
+	return rotated, key, nil
+}
+
+// SessionTime returns how long sessions last after they're created or refreshed.
+func (st *SessionTable) SessionTime() time.Duration {
+	return st.sessionTime
+}
+
+// Refresh extends a session so that it expires sessionTime seconds from now, for sliding expiration, and returns the
+// key to be sent to the client.
+func (st *SessionTable) Refresh(s *Session) (key string, err error) {
+	s.Expires = time.Now().Add(st.sessionTime)
+	return st.Save(s)
+}
+
+// isRevoked checks a sealed session against the revocation list. Sessions that can't be checked are treated as revoked.
+func (st *SessionTable) isRevoked(s *Session) bool {
+	revoked, err := st.revocations.Revoked(s)
+	if err != nil {
+		log.Printf("While checking session revocations: %s", err)
+		return true
+	}
+	return revoked
+}
+
+// Get returns the session identified by key if it hasn't expired. Expired sessions are rejected even if they haven't
+// yet been removed by ExpireOldSessions.
+func (st *SessionTable) Get(key string) (*Session, bool) {
+	s, ok := st.get(key)
+	if !ok {
+		atomic.AddUint64(&st.rejected, 1)
+	}
+	return s, ok
+}
+
+func (st *SessionTable) get(key string) (*Session, bool) {
+	if st.sealer != nil {
+		s, err := st.sealer.Open(key)
+		if err != nil || s.expired() || st.isRevoked(s) {
+			return nil, false
 		}
+		return s, true
+	}
+
+	byteKey, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, false
+	}
+	s, err := st.store.Get(idFor(byteKey))
+	if err != nil || !s.valid(byteKey) {
+		return nil, false
 	}
-	return false
+	return s, true
+}
+
+// Valid determines whether a user and key are associated with each other and less than sessionTime seconds old.
+func (st *SessionTable) Valid(user string, key string) bool {
+	s, ok := st.Get(key)
+	return ok && s.User == user
+}
+
+// GetRequest wraps Get for convenient retrieval of the session belonging to an HTTP request's cookie
+func (st *SessionTable) GetRequest(r *http.Request) (*Session, bool) {
+	cookie, err := r.Cookie(CookieName)
+	if err != nil {
+		return nil, false
+	}
+	return st.Get(cookie.Value)
 }
 
 // ValidRequest wraps Valid for convenient validation of an HTTP request by checking for a valid cookie
 func (st *SessionTable) ValidRequest(user string, r *http.Request) bool {
-	cookie, err := r.Cookie("totp-ovpn-session")
-	if err != nil {
-		fmt.Println("rejected due to cookie not found")
-		return false
+	s, ok := st.GetRequest(r)
+	return ok && s.User == user
+}
+
+// Revoke ends the session with the given ID.
+func (st *SessionTable) Revoke(id string) error {
+	atomic.AddUint64(&st.revoked, 1)
+	if st.sealer != nil {
+		return st.revocations.RevokeID(id, time.Now().Add(st.sessionTime))
+	}
+	return st.store.Delete(id)
+}
+
+// RevokeAll ends every session held by a user.
+func (st *SessionTable) RevokeAll(user string) error {
+	if st.sealer != nil {
+		now := time.Now()
+		return st.revocations.RevokeUser(user, now, now.Add(st.sessionTime))
 	}
-	return st.Valid(user, cookie.Value)
+	return st.store.DeleteUser(user)
 }
 
 // ExpireOldSessions deletes expired sessions from the session table to avoid excessive memory use over time.
 func (st *SessionTable) ExpireOldSessions() {
-	st.mutex.Lock()
-	for k := range st.sessions {
-		if st.sessions[k].expired() {
-			delete(st.sessions, k)
+	now := time.Now()
+	if st.store != nil {
+		n, err := st.store.DeleteExpired(now)
+		if err != nil {
+			log.Printf("While expiring sessions: %s", err)
+		}
+		atomic.AddUint64(&st.expired, uint64(n))
+	}
+	if st.revocations != nil {
+		if err := st.revocations.DeleteExpired(now); err != nil {
+			log.Printf("While expiring session revocations: %s", err)
+		}
+	}
+}
+
+// Sweep calls ExpireOldSessions every interval until the context is cancelled. It returns at once if interval isn't > 0.
+func (st *SessionTable) Sweep(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			st.ExpireOldSessions()
+		}
+	}
+}
+
+// Stats holds counters describing the session table since it was created. Active is -1 when sessions are sealed, as
+// the server has no record of them.
+type Stats struct {
+	Active   int
+	Created  uint64
+	Expired  uint64
+	Rejected uint64
+	Revoked  uint64
+}
+
+// Stats returns the current session counters.
+func (st *SessionTable) Stats() Stats {
+	s := Stats{
+		Active:   -1,
+		Created:  atomic.LoadUint64(&st.created),
+		Expired:  atomic.LoadUint64(&st.expired),
+		Rejected: atomic.LoadUint64(&st.rejected),
+		Revoked:  atomic.LoadUint64(&st.revoked),
+	}
+	if st.store != nil {
+		if n, err := st.store.Count(); err == nil {
+			s.Active = n
 		}
 	}
-	st.mutex.Unlock()
+	return s
 }
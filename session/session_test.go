@@ -0,0 +1,212 @@
+package session
+
+import (
+	"github.com/alowde/totp-ovpn/store"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionTable(t *testing.T) {
+	st := NewSessionTable(0)
+
+	s, key, err := st.Add("alice")
+	if err != nil {
+		t.Fatalf("Failed to add session with error %s", err)
+	}
+	if !st.Valid("alice", key) {
+		t.Errorf("New session isn't valid")
+	}
+	if st.Valid("bob", key) {
+		t.Errorf("Session key is valid for the wrong user")
+	}
+
+	s.Step = StepAuthenticated
+	s.Data["csr"] = []byte("pending")
+	if _, err := st.Save(s); err != nil {
+		t.Fatalf("Failed to save session with error %s", err)
+	}
+	s.Data["csr"][0] = 'x'
+
+	loaded, ok := st.Get(key)
+	if !ok {
+		t.Fatalf("Saved session isn't valid")
+	}
+	if loaded.Step != StepAuthenticated || string(loaded.Data["csr"]) != "pending" {
+		t.Errorf("Session state wasn't stored, got step %d and data %q", loaded.Step, loaded.Data["csr"])
+	}
+
+	second, secondKey, _ := st.Add("alice")
+	if !st.Valid("alice", key) || !st.Valid("alice", secondKey) {
+		t.Errorf("A second session for the same user ended the first")
+	}
+
+	if err := st.Revoke(second.ID); err != nil {
+		t.Fatalf("Failed to revoke session with error %s", err)
+	}
+	if st.Valid("alice", secondKey) {
+		t.Errorf("Revoked session is still valid")
+	}
+	if !st.Valid("alice", key) {
+		t.Errorf("Revoking one session ended another")
+	}
+
+	_, bobKey, _ := st.Add("bob")
+	if err := st.RevokeAll("alice"); err != nil {
+		t.Fatalf("Failed to revoke sessions with error %s", err)
+	}
+	if st.Valid("alice", key) {
+		t.Errorf("Session is still valid after revoking all of the user's sessions")
+	}
+	if !st.Valid("bob", bobKey) {
+		t.Errorf("Revoking all of one user's sessions ended another user's session")
+	}
+}
+
+func TestSealedSessionTable(t *testing.T) {
+	sealer, err := NewSealer([]byte("0123456789abcdef0123456789abcdef"), 0)
+	if err != nil {
+		t.Fatalf("Failed to create sealer with error %s", err)
+	}
+	st := NewSealedSessionTable(0, sealer, nil)
+
+	s, key, err := st.Add("alice")
+	if err != nil {
+		t.Fatalf("Failed to add session with error %s", err)
+	}
+	if !st.Valid("alice", key) {
+		t.Errorf("New session isn't valid")
+	}
+	if st.Valid("bob", key) {
+		t.Errorf("Session token is valid for the wrong user")
+	}
+
+	s.Step = StepAuthenticated
+	s.Data["csr"] = []byte("pending")
+	key, err = st.Save(s)
+	if err != nil {
+		t.Fatalf("Failed to save session with error %s", err)
+	}
+
+	// A second table with the same secret, as on another replica, accepts the token
+	other, _ := NewSealer([]byte("0123456789abcdef0123456789abcdef"), 0)
+	loaded, ok := NewSealedSessionTable(0, other, nil).Get(key)
+	if !ok {
+		t.Fatalf("Sealed session isn't valid on another replica")
+	}
+	if loaded.Step != StepAuthenticated || string(loaded.Data["csr"]) != "pending" {
+		t.Errorf("Session state wasn't sealed, got step %d and data %q", loaded.Step, loaded.Data["csr"])
+	}
+
+	if st.Valid("alice", key[:len(key)-2]+"AA") {
+		t.Errorf("Tampered session token is valid")
+	}
+
+	if err := st.Revoke(s.ID); err != nil {
+		t.Fatalf("Failed to revoke session with error %s", err)
+	}
+	if st.Valid("alice", key) {
+		t.Errorf("Revoked session is still valid")
+	}
+
+	_, key, _ = st.Add("alice")
+	if err := st.RevokeAll("alice"); err != nil {
+		t.Fatalf("Failed to revoke sessions with error %s", err)
+	}
+	if st.Valid("alice", key) {
+		t.Errorf("Session is still valid after revoking all of the user's sessions")
+	}
+}
+
+func TestSessionTable_Stats(t *testing.T) {
+	st := NewSessionTable(0)
+
+	s, key, _ := st.Add("alice")
+	_, _, _ = st.Add("bob")
+	if stats := st.Stats(); stats.Active != 2 || stats.Created != 2 {
+		t.Errorf("Expected 2 active and 2 created sessions, got %+v", stats)
+	}
+
+	s.Expires = time.Now().Add(-time.Second)
+	if _, err := st.Save(s); err != nil {
+		t.Fatalf("Failed to save session with error %s", err)
+	}
+	if st.Valid("alice", key) {
+		t.Errorf("Expired session is valid before being swept")
+	}
+
+	st.ExpireOldSessions()
+	if stats := st.Stats(); stats.Active != 1 || stats.Expired != 1 || stats.Rejected != 1 {
+		t.Errorf("Expected 1 active, 1 expired and 1 rejected session, got %+v", stats)
+	}
+}
+
+func TestNewSealer(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		secret   []byte
+		rotation time.Duration
+		wantErr  bool
+	}{
+		{secret, 0, false},
+		{secret, time.Second, false},
+		{secret, 500 * time.Millisecond, true},
+		{secret[:31], 0, true},
+	}
+	for _, tt := range tests {
+		s, err := NewSealer(tt.secret, tt.rotation)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("NewSealer(%d bytes, %s) error = %v, wantErr %v", len(tt.secret), tt.rotation, err, tt.wantErr)
+			continue
+		}
+		if err == nil {
+			if _, err := s.Seal(newSession("alice", time.Minute)); err != nil {
+				t.Errorf("Sealer with rotation %s failed with error %s", tt.rotation, err)
+			}
+		}
+	}
+}
+
+func TestBoltRevocations(t *testing.T) {
+	path := store.Path
+	store.Path = filepath.Join(t.TempDir(), "test.db")
+	defer func() { store.Path = path }()
+
+	sealer, err := NewSealer([]byte("0123456789abcdef0123456789abcdef"), 0)
+	if err != nil {
+		t.Fatalf("Failed to create sealer with error %s", err)
+	}
+	st := NewSealedSessionTable(0, sealer, NewBoltRevocations("revocations"))
+	s, key, _ := st.Add("alice")
+	_, other, _ := st.Add("bob")
+	if err := st.Revoke(s.ID); err != nil {
+		t.Fatalf("Failed to revoke session with error %s", err)
+	}
+	_, all, _ := st.Add("carol")
+	if err := st.RevokeAll("carol"); err != nil {
+		t.Fatalf("Failed to revoke sessions with error %s", err)
+	}
+
+	// A new table, as after a restart or on another replica, sees the revocations
+	restarted := NewSealedSessionTable(0, sealer, NewBoltRevocations("revocations"))
+	if restarted.Valid("alice", key) || restarted.Valid("carol", all) {
+		t.Errorf("Revoked session is valid after a restart")
+	}
+	if !restarted.Valid("bob", other) {
+		t.Errorf("Unrevoked session isn't valid after a restart")
+	}
+	if !NewSealedSessionTable(0, sealer, NewBoltRevocations("other")).Valid("carol", all) {
+		t.Errorf("Revocation applied to a table using another bucket")
+	}
+	_, later, _ := restarted.Add("carol")
+	if !restarted.Valid("carol", later) {
+		t.Errorf("Session created after revoking all of a user's sessions isn't valid")
+	}
+
+	if err := NewBoltRevocations("revocations").DeleteExpired(time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to delete expired revocations with error %s", err)
+	}
+	if revoked, _ := NewBoltRevocations("revocations").Revoked(s); revoked {
+		t.Errorf("Expired revocation wasn't deleted")
+	}
+}
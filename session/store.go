@@ -0,0 +1,205 @@
+package session
+
+import (
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+// ErrNoSession is returned by a Store when no session exists with the requested ID.
+var ErrNoSession = errors.New("no session")
+
+// Store persists sessions. Implementations must be safe for concurrent use.
+type Store interface {
+	// Get returns the session with the given ID, or ErrNoSession if there isn't one.
+	Get(id string) (*Session, error)
+	// Put adds or replaces the session with ID s.ID.
+	Put(s *Session) error
+	// Delete removes a session if it exists.
+	Delete(id string) error
+	// DeleteUser removes every session belonging to a user.
+	DeleteUser(user string) error
+	// DeleteExpired removes every session that expired before now, returning the number removed.
+	DeleteExpired(now time.Time) (int, error)
+	// Count returns the number of sessions held, including any that have expired but not yet been removed.
+	Count() (int, error)
+}
+
+// MapStore keeps sessions in memory. Sessions are lost when the process exits.
+type MapStore struct {
+	sessions map[string]Session
+	mutex    sync.RWMutex
+}
+
+func NewMapStore() *MapStore {
+	return &MapStore{sessions: make(map[string]Session)}
+}
+
+func (m *MapStore) Get(id string) (*Session, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return s.copy(), nil
+}
+
+func (m *MapStore) Put(s *Session) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sessions[s.ID] = *s.copy()
+	return nil
+}
+
+func (m *MapStore) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *MapStore) DeleteUser(user string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for k, v := range m.sessions {
+		if v.User == user {
+			delete(m.sessions, k)
+		}
+	}
+	return nil
+}
+
+// DeleteExpired scans for expired sessions under a read lock, so that lookups can continue during the scan, and only
+// takes the write lock to delete the sessions it found.
+func (m *MapStore) DeleteExpired(now time.Time) (int, error) {
+	var expired []string
+	m.mutex.RLock()
+	for k, v := range m.sessions {
+		if now.After(v.Expires) {
+			expired = append(expired, k)
+		}
+	}
+	m.mutex.RUnlock()
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var n int
+	for _, k := range expired {
+		// The session may have been replaced since the scan
+		if v, ok := m.sessions[k]; ok && now.After(v.Expires) {
+			delete(m.sessions, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (m *MapStore) Count() (int, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.sessions), nil
+}
+
+// BoltStore keeps sessions in the sessions bucket of the shared database, so that they survive a restart of the server.
+// Like the rest of the database users it only holds the database open for the duration of each operation, so that
+// command line tools can still use the database while the server is running.
+type BoltStore struct{}
+
+func NewBoltStore() *BoltStore {
+	return &BoltStore{}
+}
+
+func (BoltStore) Get(id string) (*Session, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var s = new(Session)
+	if err := db.From("sessions").One("ID", id, s); err != nil {
+		if err == storm.ErrNotFound {
+			return nil, ErrNoSession
+		}
+		return nil, errors.Wrap(err, "while querying sessions")
+	}
+	return s, nil
+}
+
+func (BoltStore) Put(s *Session) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.From("sessions").Save(s); err != nil {
+		return errors.Wrap(err, "while saving session")
+	}
+	return nil
+}
+
+func (BoltStore) Delete(id string) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.From("sessions").DeleteStruct(&Session{ID: id}); err != nil && err != storm.ErrNotFound {
+		return errors.Wrap(err, "while deleting session")
+	}
+	return nil
+}
+
+func (BoltStore) DeleteUser(user string) error {
+	_, err := deleteMatching(q.Eq("User", user))
+	return err
+}
+
+func (BoltStore) DeleteExpired(now time.Time) (int, error) {
+	return deleteMatching(q.Lt("Expires", now))
+}
+
+func (BoltStore) Count() (int, error) {
+	db, err := store.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	n, err := db.From("sessions").Count(&Session{})
+	if err != nil && err != storm.ErrNotFound {
+		return 0, errors.Wrap(err, "while counting sessions")
+	}
+	return n, nil
+}
+
+func deleteMatching(matcher q.Matcher) (int, error) {
+	db, err := store.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	query := db.From("sessions").Select(matcher)
+	n, err := query.Count(&Session{})
+	if err != nil && err != storm.ErrNotFound {
+		return 0, errors.Wrap(err, "while counting sessions")
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := query.Delete(&Session{}); err != nil && err != storm.ErrNotFound {
+		return 0, errors.Wrap(err, "while deleting sessions")
+	}
+	return n, nil
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"sync"
+	"time"
+)
+
+// Path is the location of the database file shared by all packages.
+var Path = "my.db"
+
+// Timeout is how long Open waits for another process to release the database, such as the auth script while it checks
+// a login. Zero waits indefinitely.
+var Timeout time.Duration
+
+// DB wraps a *storm.DB so that several users within one process can hold the database open at the same time. Bolt
+// takes an exclusive lock on the file, so a second storm.Open in the same process would otherwise block until the
+// first handle was closed.
+type DB struct {
+	*storm.DB
+}
+
+var (
+	mutex  sync.Mutex
+	shared *storm.DB
+	refs   int
+)
+
+// Open returns a handle to the database at Path, opening the file if no other handle is currently held. Every
+// successful call to Open must be matched by a call to Close.
+func Open() (*DB, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if shared == nil {
+		db, err := storm.Open(Path, storm.BoltOptions(0600, &bolt.Options{Timeout: Timeout}))
+		if err != nil {
+			return nil, errors.Wrap(err, "while opening database")
+		}
+		shared = db
+	}
+	refs++
+	return &DB{shared}, nil
+}
+
+// Close releases the handle, closing the underlying file once the last handle is released.
+func (d *DB) Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if d.DB == nil {
+		return nil
+	}
+	d.DB = nil
+	refs--
+	if refs > 0 {
+		return nil
+	}
+	db := shared
+	shared = nil
+	return db.Close()
+}
@@ -0,0 +1,40 @@
+package user
+
+import "time"
+
+// MaxFailedAttempts is how many consecutive failed passwords or codes lock an account, and LockoutDuration is how long
+// it stays locked.
+var MaxFailedAttempts = 5
+var LockoutDuration = 15 * time.Minute
+
+// ErrLockedOut is returned when authenticating against an account that has been locked after too many failures.
+var ErrLockedOut = Error{"locked out", "error.locked_out"}
+
+// Lockout tracks failed authentication attempts against an account.
+type Lockout struct {
+	FailedAttempts int
+	LockedUntil    time.Time
+}
+
+// Locked reports whether the account is currently locked.
+func (l *Lockout) Locked() bool {
+	return time.Now().Before(l.LockedUntil)
+}
+
+// Fail records a failed attempt, locking the account once MaxFailedAttempts is reached. It reports whether the account
+// was locked as a result.
+func (l *Lockout) Fail() bool {
+	l.FailedAttempts++
+	if l.FailedAttempts < MaxFailedAttempts {
+		return false
+	}
+	l.FailedAttempts = 0
+	l.LockedUntil = time.Now().Add(LockoutDuration)
+	return true
+}
+
+// Unlock clears any lock and failed attempts.
+func (l *Lockout) Unlock() {
+	l.FailedAttempts = 0
+	l.LockedUntil = time.Time{}
+}
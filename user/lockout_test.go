@@ -0,0 +1,72 @@
+package user
+
+import (
+	"github.com/alowde/totp-ovpn/store"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	var l Lockout
+	for i := 1; i < MaxFailedAttempts; i++ {
+		if l.Fail() {
+			t.Fatalf("Locked after %d failures, expected %d", i, MaxFailedAttempts)
+		}
+	}
+	if l.Locked() {
+		t.Errorf("Locked before reaching MaxFailedAttempts")
+	}
+	if !l.Fail() || !l.Locked() {
+		t.Errorf("Not locked after MaxFailedAttempts failures")
+	}
+	if l.LockedUntil.Before(time.Now().Add(LockoutDuration - time.Minute)) {
+		t.Errorf("Lock is shorter than LockoutDuration")
+	}
+
+	l.Unlock()
+	if l.Locked() || l.FailedAttempts != 0 {
+		t.Errorf("Still locked after Unlock")
+	}
+}
+
+func TestConcurrentFailures(t *testing.T) {
+	path := store.Path
+	store.Path = filepath.Join(t.TempDir(), "test.db")
+	defer func() { store.Path = path }()
+
+	if err := New("alice", "password").Save(); err != nil {
+		t.Fatal(err)
+	}
+	// Every attempt starts from its own copy of the user, as separate requests and processes do
+	var copies []*User
+	for i := 0; i < 4*MaxFailedAttempts; i++ {
+		u, err := FromDB("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		copies = append(copies, u)
+	}
+	var wg sync.WaitGroup
+	for _, u := range copies {
+		wg.Add(1)
+		go func(u *User) {
+			defer wg.Done()
+			if ok, err := u.CheckCode("invalid"); ok {
+				t.Errorf("Invalid code was accepted")
+			} else if err != nil && err != ErrLockedOut {
+				t.Errorf("Failed to check code with error %s", err)
+			}
+		}(u)
+	}
+	wg.Wait()
+
+	u, err := FromDB("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Locked() {
+		t.Errorf("Not locked after %d concurrent failures", len(copies))
+	}
+}
@@ -0,0 +1,57 @@
+package user
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"strings"
+)
+
+// RecoveryCodeCount is how many recovery codes are generated at a time.
+const RecoveryCodeCount = 10
+
+// GenerateRecoveryCodes replaces the user's recovery codes with a new set and returns them. Only hashes of the codes are
+// kept, so they can't be shown again. The caller must save the user, through Update if they already exist.
+func (u *User) GenerateRecoveryCodes() []string {
+	codes := make([]string, RecoveryCodeCount)
+	u.RecoveryCodes = make([][]byte, RecoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		u.RecoveryCodes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes
+}
+
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return sum[:]
+}
+
+// useRecoveryCode checks a recovery code, removing it if it's valid so that it can't be used again. The caller must
+// save the user through Update.
+func (u *User) useRecoveryCode(code string) bool {
+	if code == "" {
+		return false
+	}
+	hash := hashRecoveryCode(code)
+	for i, v := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare(v, hash) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// CheckSecondFactor is CheckCode for portal logins, which also accept one of the user's recovery codes in place of a
+// TOTP code. A recovery code is used up when it's accepted.
+func (u *User) CheckSecondFactor(code string) (bool, error) {
+	return u.attempt(func(current *User) bool {
+		return current.acceptCode(code) || current.useRecoveryCode(code)
+	})
+}
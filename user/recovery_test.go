@@ -0,0 +1,24 @@
+package user
+
+import "testing"
+
+func TestRecoveryCodes(t *testing.T) {
+	u := new(User)
+	codes := u.GenerateRecoveryCodes()
+	if len(codes) != RecoveryCodeCount || len(u.RecoveryCodes) != RecoveryCodeCount {
+		t.Fatalf("Expected %d recovery codes, got %d", RecoveryCodeCount, len(codes))
+	}
+
+	if u.useRecoveryCode("0000-0000") {
+		t.Errorf("Unknown recovery code was accepted")
+	}
+	if !u.useRecoveryCode(" " + codes[3] + " ") {
+		t.Errorf("Valid recovery code was rejected")
+	}
+	if u.useRecoveryCode(codes[3]) {
+		t.Errorf("Recovery code was accepted twice")
+	}
+	if len(u.RecoveryCodes) != RecoveryCodeCount-1 {
+		t.Errorf("Used recovery code wasn't removed")
+	}
+}
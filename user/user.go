@@ -2,6 +2,7 @@ package user
 
 import (
 	"bytes"
+	"github.com/alowde/totp-ovpn/store"
 	"github.com/asdine/storm"
 	"github.com/pkg/errors"
 	"github.com/pquerna/otp"
@@ -10,13 +11,36 @@ import (
 	"image/png"
 	"io"
 	"log"
+	"net/mail"
+	"time"
 )
 
 type User struct {
 	Key         string
 	Username    string `storm:"id"`
+	Email       string // Where email notifications are sent, if set
 	Password    []byte
 	Initialised bool
+	QRShownTo   string // ID of the last portal session shown the TOTP QR code, which can't be shown it again
+	Disabled    bool   // Disabled users can't enroll, log in to the portal or authenticate to the VPN
+	Lockout
+
+	RecoveryCodes [][]byte // Hashes of unused recovery codes, which can stand in for a TOTP code at portal login
+	Logins        []Login  // The most recent successful VPN logins, newest first
+	LastCodeStep  uint64   // The TOTP time step of the last accepted code, so that codes can't be used twice
+
+	// SessionsNotBefore invalidates every portal session created before it. It's set whenever the user's credentials
+	// are reset, so that resets made from another process (such as the command line) still end active sessions.
+	SessionsNotBefore time.Time
+}
+
+// MaxLogins is how many recent VPN logins are kept for each user.
+const MaxLogins = 10
+
+// Login records a successful VPN authentication.
+type Login struct {
+	Time    time.Time
+	Address string // The client's address, if known
 }
 
 type ErrUserNotFound struct {
@@ -27,18 +51,35 @@ func (e ErrUserNotFound) Error() string {
 	return e.err.Error()
 }
 
+func (e ErrUserNotFound) MessageID() string {
+	return "error.user_not_found"
+}
+
+// Error is an authentication failure with a message ID, so that the reason can be shown to users in their own language.
+type Error struct {
+	msg string
+	id  string
+}
+
+func (e Error) Error() string {
+	return e.msg
+}
+
+func (e Error) MessageID() string {
+	return e.id
+}
+
+// ErrDisabled and ErrInvalidPasscode are returned by Verify for disabled users and incorrect codes.
+var ErrDisabled = Error{"user disabled", "error.user_disabled"}
+var ErrInvalidPasscode = Error{"invalid passcode", "error.invalid_passcode"}
+
 func New(name, password string) *User {
 	var u = new(User)
 
-	k, err := totp.Generate(totp.GenerateOpts{
-		Issuer:      "totp-ovpn",
-		AccountName: name,
-	})
-	if err != nil {
+	u.Username = name
+	if err := u.ResetOTP(); err != nil {
 		log.Panic("failed to gen key")
 	}
-	u.Key = k.URL()
-	u.Username = name
 	if err := u.SetPassword(password); err != nil {
 		log.Panicf("unexpected error while trying to set password: %s", err)
 	}
@@ -46,7 +87,7 @@ func New(name, password string) *User {
 }
 
 func FromDB(name string) (*User, error) {
-	db, err := storm.Open("my.db")
+	db, err := store.Open()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -62,6 +103,35 @@ func FromDB(name string) (*User, error) {
 	return u, nil
 }
 
+// All returns every user in the database.
+func All() ([]User, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var users []User
+	if err := db.All(&users); err != nil {
+		return nil, errors.Wrap(err, "while querying DB for users")
+	}
+	return users, nil
+}
+
+// Save writes the user to the database, replacing any existing record with the same username.
+func (u *User) Save() error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := db.Save(u); err != nil {
+		return errors.Wrap(err, "while saving user")
+	}
+	return nil
+}
+
 func (u *User) GenerateQR() (io.Reader, error) {
 
 	key, err := otp.NewKeyFromURL(u.Key)
@@ -86,6 +156,140 @@ func (u *User) SetPassword(password string) error {
 	return nil
 }
 
+// SetEmail sets the address email notifications are sent to, or clears it if address is empty. Addresses with a display
+// name, such as "Alice <alice@example.com>", are reduced to the bare address.
+func (u *User) SetEmail(address string) error {
+	if address == "" {
+		u.Email = ""
+		return nil
+	}
+	a, err := mail.ParseAddress(address)
+	if err != nil {
+		return errors.Wrapf(err, "invalid email address %s", address)
+	}
+	u.Email = a.Address
+	return nil
+}
+
 func (u *User) ValidatePassword(password string) error {
 	return bcrypt.CompareHashAndPassword(u.Password, []byte(password))
 }
+
+// Update applies fn to the user's current record and saves the result in a single transaction, then replaces u with
+// it. Nothing is saved if fn returns an error. Changes to existing users should be made this way rather than with Save,
+// since the record may have changed since u was loaded: another request or process may have counted a failed login or
+// accepted a code, or an administrator may have disabled the user.
+func (u *User) Update(fn func(current *User) error) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return errors.Wrap(err, "while updating user")
+	}
+	defer tx.Rollback()
+
+	var current = new(User)
+	if err := tx.One("Username", u.Username, current); err != nil {
+		if err == storm.ErrNotFound {
+			return ErrUserNotFound{err}
+		}
+		return errors.Wrap(err, "while querying DB for user")
+	}
+	if err := fn(current); err != nil {
+		return err
+	}
+	if err := tx.Save(current); err != nil {
+		return errors.Wrap(err, "while saving user")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "while saving user")
+	}
+	*u = *current
+	return nil
+}
+
+// attempt records an authentication attempt, calling check against the user's current record and counting a failure
+// towards a lockout or clearing the count on success. check must use up anything it accepts, such as a code, on the
+// record it's given, so that the lockout, the check and what it uses up are read and written together and concurrent
+// attempts can't overwrite each other's. It returns ErrLockedOut without calling check if the user is locked.
+func (u *User) attempt(check func(current *User) bool) (ok bool, err error) {
+	err = u.Update(func(current *User) error {
+		if current.Locked() {
+			return ErrLockedOut
+		}
+		if ok = check(current); ok {
+			current.FailedAttempts = 0
+		} else {
+			current.Fail()
+		}
+		return nil
+	})
+	return ok && err == nil, err
+}
+
+// CheckPassword is ValidatePassword for login attempts, counting failures towards a lockout. It returns ErrLockedOut
+// without checking the password if the user is locked.
+func (u *User) CheckPassword(password string) error {
+	if u.Locked() {
+		return ErrLockedOut
+	}
+	// bcrypt is slow, so the password is checked before the record is read for update rather than while holding the
+	// database, and is then refused if it was changed in the meantime
+	hash, err := u.Password, u.ValidatePassword(password)
+	ok, aerr := u.attempt(func(current *User) bool {
+		return err == nil && bytes.Equal(current.Password, hash)
+	})
+	switch {
+	case aerr != nil:
+		return aerr
+	case !ok && err == nil:
+		return bcrypt.ErrMismatchedHashAndPassword
+	}
+	return err
+}
+
+// CheckCode is ValidateCode for login attempts, counting failures towards a lockout and refusing a code that has already
+// been accepted. It returns ErrLockedOut without checking the code if the user is locked.
+func (u *User) CheckCode(passcode string) (bool, error) {
+	return u.attempt(func(current *User) bool {
+		return current.acceptCode(passcode)
+	})
+}
+
+// ResetPassword sets a new password and invalidates any portal sessions the user holds. The caller must save the user,
+// through Update if they already exist.
+func (u *User) ResetPassword(password string) error {
+	if err := u.SetPassword(password); err != nil {
+		return err
+	}
+	u.SessionsNotBefore = time.Now()
+	return nil
+}
+
+// Disable prevents the user from enrolling or authenticating and invalidates any portal sessions they hold. The caller
+// must save the user through Update.
+func (u *User) Disable() {
+	u.Disabled = true
+	u.SessionsNotBefore = time.Now()
+}
+
+// ResetOTP generates a new TOTP key, requiring the user to enroll their device again, and invalidates any portal
+// sessions the user holds. The caller must save the user, through Update if they already exist.
+func (u *User) ResetOTP() error {
+	k, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "totp-ovpn",
+		AccountName: u.Username,
+	})
+	if err != nil {
+		return errors.Wrap(err, "while generating TOTP key")
+	}
+	u.Key = k.URL()
+	u.LastCodeStep = 0
+	u.Initialised = false
+	u.SessionsNotBefore = time.Now()
+	return nil
+}
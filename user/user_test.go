@@ -0,0 +1,25 @@
+package user
+
+import "testing"
+
+func TestSetEmail(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr bool
+	}{
+		{"alice@example.com", "alice@example.com", false},
+		{"Alice <alice@example.com>", "alice@example.com", false},
+		{"", "", false},
+		{"alice", "old@example.com", true},
+	}
+	for _, tt := range tests {
+		u := &User{Email: "old@example.com"}
+		if err := u.SetEmail(tt.address); (err != nil) != tt.wantErr {
+			t.Errorf("SetEmail(%q) error = %v, wantErr %v", tt.address, err, tt.wantErr)
+		}
+		if u.Email != tt.want {
+			t.Errorf("SetEmail(%q) set %q, want %q", tt.address, u.Email, tt.want)
+		}
+	}
+}
@@ -1,22 +1,93 @@
 package user
 
 import (
+	"crypto/subtle"
 	"github.com/pkg/errors"
 	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
+	"time"
 )
 
 func Verify(name, passcode string) (valid bool, e error) {
+	return VerifyFrom(name, passcode, "")
+}
+
+// VerifyFrom is Verify for a client connecting from the given address, which is recorded with the login.
+func VerifyFrom(name, passcode, address string) (valid bool, e error) {
 
 	u, err := FromDB(name)
 	if err != nil {
 		return false, errors.Wrap(err, "while searching for user")
 	}
 
-	k, _ := otp.NewKeyFromURL(u.Key)
-	if totp.Validate(passcode, k.Secret()) {
-		return true, nil
+	if u.Disabled {
+		return false, ErrDisabled
+	}
+
+	// The code is checked against the current record, which may have been disabled since it was loaded
+	ok, err := u.attempt(func(current *User) bool {
+		if current.Disabled || !current.acceptCode(passcode) {
+			return false
+		}
+		current.recordLogin(address)
+		return true
+	})
+	switch {
+	case err != nil:
+		return false, err
+	case u.Disabled:
+		return false, ErrDisabled
+	case !ok:
+		return false, ErrInvalidPasscode
+	}
+	return true, nil
+}
+
+// ValidateCode checks a TOTP code against the user's key.
+func (u *User) ValidateCode(passcode string) bool {
+	_, ok := codeStep(u.Key, passcode, time.Now())
+	return ok
+}
+
+// codeStep returns the time step a TOTP code was generated in, allowing one step of clock drift either way as
+// totp.Validate does. It returns false if the code doesn't match key, an otpauth URL.
+func codeStep(key, passcode string, t time.Time) (uint64, bool) {
+	k, err := otp.NewKeyFromURL(key)
+	if err != nil {
+		return 0, false
+	}
+	opts := totp.ValidateOpts{Period: uint(k.Period()), Digits: k.Digits(), Algorithm: k.Algorithm()}
+	step := uint64(t.Unix()) / k.Period()
+	for _, s := range []uint64{step - 1, step, step + 1} {
+		code, err := totp.GenerateCodeCustom(k.Secret(), time.Unix(int64(s*k.Period()), 0), opts)
+		if err == nil && subtle.ConstantTimeCompare([]byte(code), []byte(passcode)) == 1 {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+// AcceptCode checks a TOTP code that is being used up against key, an otpauth URL. Each code is only accepted once, and
+// codes from a time step before the last accepted code are refused, so an intercepted code can't be replayed within its
+// validity period. last holds the time step of the last accepted code, and is advanced when a code is accepted.
+func AcceptCode(key, passcode string, last *uint64) bool {
+	step, ok := codeStep(key, passcode, time.Now())
+	if !ok || step <= *last {
+		return false
 	}
+	*last = step
+	return true
+}
+
+// acceptCode is AcceptCode for the user's key. The caller must save the user through Update.
+func (u *User) acceptCode(passcode string) bool {
+	return AcceptCode(u.Key, passcode, &u.LastCodeStep)
+}
 
-	return false, errors.New("invalid passcode")
+// recordLogin adds a successful VPN login to the user's recent logins. The caller must save the user through Update.
+func (u *User) recordLogin(address string) {
+	u.Logins = append([]Login{{time.Now(), address}}, u.Logins...)
+	if len(u.Logins) > MaxLogins {
+		u.Logins = u.Logins[:MaxLogins]
+	}
 }
@@ -0,0 +1,120 @@
+package user
+
+import (
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCheckCode(t *testing.T) {
+	path := store.Path
+	store.Path = filepath.Join(t.TempDir(), "test.db")
+	defer func() { store.Path = path }()
+
+	u := New("alice", "password")
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	k, err := otp.NewKeyFromURL(u.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code, err := totp.GenerateCode(k.Secret(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := totp.GenerateCode(k.Secret(), now.Add(-time.Duration(k.Period())*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := u.CheckCode(code); !ok || err != nil {
+		t.Fatalf("Valid code was rejected with error %v", err)
+	}
+	if ok, _ := u.CheckCode(code); ok {
+		t.Errorf("Code was accepted twice")
+	}
+	if previous != code {
+		if ok, _ := u.CheckCode(previous); ok {
+			t.Errorf("Code from before the last accepted code was accepted")
+		}
+	}
+
+	// The accepted code is saved, so it can't be replayed against another copy of the user
+	saved, err := FromDB("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := saved.CheckSecondFactor(code); ok {
+		t.Errorf("Code was accepted twice after reloading the user")
+	}
+
+	if err := saved.ResetOTP(); err != nil {
+		t.Fatal(err)
+	}
+	if saved.LastCodeStep != 0 {
+		t.Errorf("ResetOTP kept the last accepted code step")
+	}
+}
+
+func TestConcurrentCodes(t *testing.T) {
+	path := store.Path
+	store.Path = filepath.Join(t.TempDir(), "test.db")
+	defer func() { store.Path = path }()
+
+	u := New("alice", "password")
+	if err := u.Save(); err != nil {
+		t.Fatal(err)
+	}
+	k, err := otp.NewKeyFromURL(u.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.GenerateCode(k.Secret(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every attempt starts from its own copy of the user, as separate requests and processes do
+	var copies []*User
+	for i := 0; i < 10; i++ {
+		c, err := FromDB("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		copies = append(copies, c)
+	}
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var accepted int
+	for _, c := range copies {
+		wg.Add(1)
+		go func(c *User) {
+			defer wg.Done()
+			if ok, err := c.CheckCode(code); ok {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			} else if err != nil && err != ErrLockedOut {
+				t.Errorf("Failed to check code with error %s", err)
+			}
+		}(c)
+	}
+	wg.Wait()
+	if accepted != 1 {
+		t.Errorf("Code was accepted %d times", accepted)
+	}
+
+	// Changing a copy loaded before the code was accepted mustn't undo it
+	if err := copies[0].Update(func(current *User) error { return current.SetEmail("alice@example.com") }); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := copies[1].CheckCode(code); ok {
+		t.Errorf("Code was accepted again after updating a stale copy of the user")
+	}
+}
@@ -0,0 +1,221 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/alowde/totp-ovpn/store"
+	"github.com/asdine/storm"
+	"github.com/pkg/errors"
+	"log"
+	"time"
+)
+
+// Deliveries are queued in the database rather than sent straight away, so that events recorded by the auth script
+// are delivered by the server, and deliveries an endpoint refused survive a restart.
+
+const queueNode = "webhooks"
+
+// PollInterval is how often the queue is checked for deliveries that are due. Events queued by the server are sent
+// straight away; this mostly affects retries and events queued by the auth script.
+var PollInterval = 30 * time.Second
+
+// RetryDelay is how long after a failed attempt a delivery is retried. It doubles after each further failure, up to
+// MaxRetryDelay.
+var (
+	RetryDelay    = 30 * time.Second
+	MaxRetryDelay = time.Hour
+)
+
+// MaxAttempts is how many times a delivery is attempted before it's dropped. With the default delays the last attempt
+// is made about three hours after the first.
+var MaxAttempts = 10
+
+// batchSize is the most deliveries attempted before the queue is read again.
+const batchSize = 100
+
+// Delivery is an event queued for a single endpoint.
+type Delivery struct {
+	ID          int `storm:"id,increment"`
+	URL         string
+	Type        string
+	EventID     string
+	Payload     []byte
+	Attempts    int
+	NextAttempt time.Time `storm:"index"`
+	LastError   string
+}
+
+// wake prompts Run to check the queue when an event is queued in the same process.
+var wake = make(chan struct{}, 1)
+
+// Enqueue queues an event for every endpoint subscribed to its type, giving it an ID and time if it has none.
+func Enqueue(e Event) error {
+	var endpoints []Endpoint
+	for _, ep := range Endpoints {
+		if ep.subscribed(e.Type) {
+			endpoints = append(endpoints, ep)
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	if e.ID == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return errors.Wrap(err, "while generating webhook event ID")
+		}
+		e.ID = hex.EncodeToString(id)
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "while encoding webhook event")
+	}
+
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.From(queueNode).Begin(true)
+	if err != nil {
+		return errors.Wrap(err, "while starting transaction")
+	}
+	defer tx.Rollback()
+	for _, ep := range endpoints {
+		d := Delivery{URL: ep.URL, Type: e.Type, EventID: e.ID, Payload: payload, NextAttempt: e.Time.UTC()}
+		if err := tx.Save(&d); err != nil {
+			return errors.Wrap(err, "while queueing webhook delivery")
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "while queueing webhook delivery")
+	}
+
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Deliver attempts every delivery that's due, removing those that succeed or have run out of attempts and
+// rescheduling the rest.
+func Deliver() error {
+	for {
+		// Times are compared as encoded in the index, so they must all be in the same zone
+		due, err := dueDeliveries(time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		for i := range due {
+			done := attempt(&due[i], time.Now())
+			if err := finish(&due[i], done); err != nil {
+				return err
+			}
+		}
+		if len(due) < batchSize {
+			return nil
+		}
+	}
+}
+
+// dueDeliveries reads the queue with the database closed again before any delivery is attempted, so that the auth
+// script isn't kept waiting on a slow endpoint.
+func dueDeliveries(now time.Time) ([]Delivery, error) {
+	db, err := store.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var due []Delivery
+	err = db.From(queueNode).Range("NextAttempt", time.Time{}, now, &due, storm.Limit(batchSize))
+	if err != nil && err != storm.ErrNotFound {
+		return nil, errors.Wrap(err, "while querying DB for webhook deliveries")
+	}
+	return due, nil
+}
+
+func finish(d *Delivery, done bool) error {
+	db, err := store.Open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if done {
+		err = db.From(queueNode).DeleteStruct(d)
+	} else {
+		err = db.From(queueNode).Save(d)
+	}
+	if err != nil && err != storm.ErrNotFound {
+		return errors.Wrap(err, "while updating webhook delivery")
+	}
+	return nil
+}
+
+// attempt sends a delivery, reporting whether it's finished with. A failed delivery is rescheduled unless it has used
+// all its attempts.
+func attempt(d *Delivery, now time.Time) bool {
+	var endpoint *Endpoint
+	for i := range Endpoints {
+		if Endpoints[i].URL == d.URL {
+			endpoint = &Endpoints[i]
+		}
+	}
+	if endpoint == nil {
+		log.Printf("Dropping %s webhook for %s, which is no longer configured", d.Type, d.URL)
+		return true
+	}
+
+	err := send(*endpoint, d, now)
+	if err == nil {
+		return true
+	}
+	d.Attempts++
+	d.LastError = err.Error()
+	if d.Attempts >= MaxAttempts {
+		log.Printf("Dropping %s webhook for %s after %d attempts: %s", d.Type, d.URL, d.Attempts, err)
+		return true
+	}
+	d.NextAttempt = now.Add(backoff(d.Attempts)).UTC()
+	log.Printf("Retrying %s webhook for %s at %s: %s", d.Type, d.URL, d.NextAttempt.Format(time.RFC3339), err)
+	return false
+}
+
+// backoff returns the delay after the given number of failed attempts.
+func backoff(attempts int) time.Duration {
+	delay := RetryDelay
+	for i := 1; i < attempts && delay < MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > MaxRetryDelay {
+		delay = MaxRetryDelay
+	}
+	return delay
+}
+
+// Run delivers queued events until ctx is cancelled, checking the queue every PollInterval and whenever an event is
+// queued.
+func Run(ctx context.Context) {
+	ticker := time.NewTicker(PollInterval)
+	defer ticker.Stop()
+	for {
+		if err := Deliver(); err != nil {
+			log.Printf("While delivering webhooks: %s", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
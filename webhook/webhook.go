@@ -0,0 +1,151 @@
+// Package webhook sends events such as enrollments, certificate issuance and lockouts to HTTP endpoints as signed JSON,
+// so that chat ops and ticketing systems can react to them. Deliveries are queued in the database and retried with
+// backoff until the endpoint accepts them.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/alowde/totp-ovpn/audit"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Types of event sent to endpoints.
+const (
+	UserEnrolled       = "user.enrolled"
+	UserLockedOut      = "user.locked_out"
+	CertificateIssued  = "certificate.issued"
+	CertificateRevoked = "certificate.revoked"
+)
+
+// Types lists every event type, for endpoints subscribed to all of them.
+var Types = []string{UserEnrolled, UserLockedOut, CertificateIssued, CertificateRevoked}
+
+// Headers set on each delivery. The signature is "sha256=" followed by the hex HMAC-SHA256 of the timestamp, a dot and
+// the body, keyed with the endpoint's secret; including the timestamp lets receivers reject replayed deliveries.
+const (
+	HeaderEvent     = "X-Webhook-Event"
+	HeaderID        = "X-Webhook-ID"
+	HeaderTimestamp = "X-Webhook-Timestamp"
+	HeaderSignature = "X-Webhook-Signature"
+)
+
+// Event is the JSON body of a delivery. ID is the same for every endpoint and attempt, so receivers can discard
+// duplicates.
+type Event struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Time   time.Time `json:"time"`
+	User   string    `json:"user,omitempty"`
+	Actor  string    `json:"actor,omitempty"`
+	IP     string    `json:"ip,omitempty"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// Endpoint is a URL events are POSTed to. Events lists the types it's sent, or every type if it's empty.
+type Endpoint struct {
+	URL    string
+	Secret []byte
+	Events []string
+}
+
+func (e Endpoint) subscribed(eventType string) bool {
+	if len(e.Events) == 0 {
+		return true
+	}
+	for _, t := range e.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Endpoints are the configured webhook endpoints. No events are queued if it's empty.
+var Endpoints []Endpoint
+
+// Client sends deliveries.
+var Client = &http.Client{Timeout: 10 * time.Second}
+
+// Sign returns the signature of body sent at timestamp, in the form used in HeaderSignature.
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery received with body, and that it was sent no more than maxAge ago. It's
+// intended for receivers written in Go.
+func Verify(secret []byte, h http.Header, body []byte, maxAge time.Duration) error {
+	timestamp, err := strconv.ParseInt(h.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return errors.New("missing or invalid timestamp")
+	}
+	if age := time.Since(time.Unix(timestamp, 0)); age > maxAge || age < -maxAge {
+		return errors.New("timestamp too far from the current time")
+	}
+	if !hmac.Equal([]byte(h.Get(HeaderSignature)), []byte(Sign(secret, timestamp, body))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// send POSTs a delivery's payload to an endpoint, signed with the endpoint's secret.
+func send(e Endpoint, d *Delivery, now time.Time) error {
+	req, err := http.NewRequest(http.MethodPost, e.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return errors.Wrap(err, "while building webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "totp-ovpn")
+	req.Header.Set(HeaderEvent, d.Type)
+	req.Header.Set(HeaderID, d.EventID)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(HeaderSignature, Sign(e.Secret, now.Unix(), d.Payload))
+
+	resp, err := Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "while sending webhook")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// eventType returns the webhook event type of an audited event, or "" if it isn't one endpoints are sent.
+func eventType(e audit.Event) string {
+	switch {
+	case e.Action == "lockout":
+		return UserLockedOut
+	case e.Outcome != audit.Success:
+		return ""
+	case e.Action == "enroll.verify":
+		return UserEnrolled
+	case e.Action == "certificate.issue":
+		return CertificateIssued
+	case e.Action == "certificate.revoke":
+		return CertificateRevoked
+	}
+	return ""
+}
+
+// Sink is an audit.Sink that queues a delivery of each event endpoints are sent.
+type Sink struct{}
+
+func (Sink) Write(e audit.Event) error {
+	t := eventType(e)
+	if t == "" {
+		return nil
+	}
+	return Enqueue(Event{Type: t, Time: e.Time, User: e.User, Actor: e.Actor, IP: e.IP, Detail: e.Detail})
+}
@@ -0,0 +1,179 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/alowde/totp-ovpn/audit"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver records the deliveries it accepts, failing the first failures requests.
+type receiver struct {
+	t        *testing.T
+	secret   []byte
+	failures int
+
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		rc.t.Error(err)
+		return
+	}
+	if err := Verify(rc.secret, r.Header, body, time.Minute); err != nil {
+		rc.t.Errorf("Delivery failed verification: %s", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	if rc.failures > 0 {
+		rc.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	var e Event
+	if err := json.Unmarshal(body, &e); err != nil {
+		rc.t.Errorf("Delivery isn't an event: %s", err)
+	}
+	if r.Header.Get(HeaderEvent) != e.Type || r.Header.Get(HeaderID) != e.ID {
+		rc.t.Errorf("Headers %v don't match event %+v", r.Header, e)
+	}
+	rc.events = append(rc.events, e)
+}
+
+func setEndpoints(t *testing.T, endpoints ...Endpoint) {
+	old := Endpoints
+	Endpoints = endpoints
+	t.Cleanup(func() { Endpoints = old })
+}
+
+func delivery(t *testing.T, url string, e Event) *Delivery {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Delivery{URL: url, Type: e.Type, EventID: e.ID, Payload: payload}
+}
+
+func TestAttempt(t *testing.T) {
+	rc := &receiver{t: t, secret: []byte("secret"), failures: 2}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	setEndpoints(t, Endpoint{URL: ts.URL, Secret: rc.secret})
+
+	e := Event{ID: "1", Type: UserEnrolled, Time: time.Now().UTC(), User: "alice"}
+	d := delivery(t, ts.URL, e)
+	now := time.Now()
+	for i := 1; i <= 2; i++ {
+		if attempt(d, now) {
+			t.Fatalf("Refused delivery was finished with")
+		}
+		if d.Attempts != i || d.LastError == "" {
+			t.Errorf("Failed attempt %d wasn't recorded: %+v", i, d)
+		}
+		if want := now.Add(backoff(i)); !d.NextAttempt.Equal(want) {
+			t.Errorf("Retry %d scheduled for %s, want %s", i, d.NextAttempt, want)
+		}
+	}
+	if !attempt(d, now) {
+		t.Fatalf("Accepted delivery wasn't finished with")
+	}
+	if len(rc.events) != 1 || rc.events[0].ID != e.ID || rc.events[0].User != e.User {
+		t.Errorf("Receiver got %+v, want %+v", rc.events, e)
+	}
+}
+
+func TestAttemptGivesUp(t *testing.T) {
+	rc := &receiver{t: t, secret: []byte("secret"), failures: 100}
+	ts := httptest.NewServer(rc)
+	defer ts.Close()
+	setEndpoints(t, Endpoint{URL: ts.URL, Secret: rc.secret})
+
+	d := delivery(t, ts.URL, Event{ID: "1", Type: UserLockedOut})
+	d.Attempts = MaxAttempts - 1
+	if !attempt(d, time.Now()) {
+		t.Errorf("Delivery was retried after %d attempts", d.Attempts)
+	}
+	if !attempt(delivery(t, "http://removed.invalid/", Event{ID: "2", Type: UserLockedOut}), time.Now()) {
+		t.Errorf("Delivery to an endpoint that's no longer configured was retried")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret, body := []byte("secret"), []byte(`{"id":"1"}`)
+	now := time.Now().Unix()
+	header := func(timestamp int64, signature string) http.Header {
+		h := http.Header{}
+		h.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+		h.Set(HeaderSignature, signature)
+		return h
+	}
+	tests := []struct {
+		name    string
+		header  http.Header
+		wantErr bool
+	}{
+		{"valid", header(now, Sign(secret, now, body)), false},
+		{"wrong secret", header(now, Sign([]byte("other"), now, body)), true},
+		{"replayed", header(now-3600, Sign(secret, now-3600, body)), true},
+		{"timestamp changed", header(now+1, Sign(secret, now, body)), true},
+		{"unsigned", http.Header{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(secret, tt.header, body, time.Minute); (err != nil) != tt.wantErr {
+				t.Errorf("Verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, w := range want {
+		if got := backoff(i + 1); got != w {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+	if got := backoff(20); got != MaxRetryDelay {
+		t.Errorf("backoff(20) = %s, want %s", got, MaxRetryDelay)
+	}
+}
+
+func TestEventType(t *testing.T) {
+	tests := []struct {
+		action  string
+		outcome string
+		want    string
+	}{
+		{"enroll.verify", audit.Success, UserEnrolled},
+		{"enroll.verify", audit.Failure, ""},
+		{"certificate.issue", audit.Success, CertificateIssued},
+		{"certificate.revoke", audit.Success, CertificateRevoked},
+		{"certificate.revoke", audit.Error, ""},
+		{"lockout", audit.Failure, UserLockedOut},
+		{"login", audit.Success, ""},
+	}
+	for _, tt := range tests {
+		if got := eventType(audit.Event{Action: tt.action, Outcome: tt.outcome}); got != tt.want {
+			t.Errorf("eventType(%s, %s) = %q, want %q", tt.action, tt.outcome, got, tt.want)
+		}
+	}
+}
+
+func TestSubscribed(t *testing.T) {
+	all := Endpoint{URL: "http://all"}
+	some := Endpoint{URL: "http://some", Events: []string{UserLockedOut}}
+	if !all.subscribed(CertificateIssued) || !some.subscribed(UserLockedOut) || some.subscribed(CertificateIssued) {
+		t.Errorf("Endpoints weren't subscribed to the right events")
+	}
+}